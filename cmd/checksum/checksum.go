@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+
+	"huskki/rom"
+)
+
+const (
+	actionIdentify = "identify"
+	actionVerify   = "verify"
+	actionFix      = "fix"
+)
+
+func main() {
+	romPath := flag.String("rom", rom.DEFAULT_IMAGE_PATH, "Path to a ROM image dumped with cmd/dumper")
+	action := flag.String("action", actionVerify, "identify, verify or fix")
+	specPath := flag.String("spec", "checksums.json", "Checksum spec, written by identify and read by verify and fix")
+	outPath := flag.String("out", "", "Where fix writes the corrected image (default: <rom>.fixed.bin)")
+	alignment := flag.Int("align", 0x4000, "Block alignment identify searches for checksum ranges on")
+	minBits := flag.Int("min-bits", 16, "Narrowest checksum identify tries, 16 or 32")
+	maxChance := flag.Float64("max-chance", 0.01, "Widths with more chance matches than this are listed by identify but left out of the spec")
+	flag.Parse()
+
+	image, err := rom.LoadImage(*romPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch *action {
+	case actionIdentify:
+		identify(image, *romPath, *specPath, *alignment, *minBits, *maxChance)
+	case actionVerify:
+		spec := loadSpec(*specPath)
+		if !verify(image, spec) {
+			os.Exit(1)
+		}
+	case actionFix:
+		spec := loadSpec(*specPath)
+		fix(image, spec, *romPath, *outPath)
+	default:
+		log.Fatalf("unknown action %q, expected identify, verify or fix", *action)
+	}
+}
+
+func identify(image *rom.Image, romPath, specPath string, alignment, minBits int, maxChance float64) {
+	log.Printf("searching %d bytes on 0x%X boundaries", image.Len(), alignment)
+	regions, tests := rom.IdentifyChecksums(image, alignment, minBits)
+	// Every comparison has a 1 in 2^bits chance of matching randomly, so say how many of the results could be noise
+	chance := map[int]float64{}
+	for _, bits := range []int{16, 32} {
+		if tests[bits] > 0 {
+			chance[bits] = float64(tests[bits]) / math.Pow(2, float64(bits))
+			log.Printf("%d bit: %d comparisons, ~%.2g matches expected by chance", bits, tests[bits], chance[bits])
+		}
+	}
+	if len(regions) == 0 {
+		log.Printf("no checksums found, try a smaller -align")
+		return
+	}
+
+	// A spec full of coincidences would have fix overwrite calibration data, so only widths that can't plausibly
+	// match by chance are written
+	var trusted []*rom.ChecksumRegion
+	for _, region := range regions {
+		if chance[rom.ChecksumAlgorithmByName(region.Algorithm).Bits] > maxChance {
+			fmt.Printf("%s (could be chance, not written)\n", region)
+			continue
+		}
+		fmt.Println(region)
+		trusted = append(trusted, region)
+	}
+	if len(trusted) < len(regions) {
+		log.Printf("left %d possible coincidences out of the spec, check them by hand or raise -max-chance", len(regions)-len(trusted))
+	}
+	if len(trusted) == 0 {
+		return
+	}
+	spec := &rom.ChecksumSpec{Name: filepath.Base(romPath), Regions: trusted}
+	if err := rom.WriteChecksumSpec(specPath, spec); err != nil {
+		log.Fatalf("write %s: %v", specPath, err)
+	}
+	log.Printf("found %d checksums, wrote %s", len(trusted), specPath)
+}
+
+func verify(image *rom.Image, spec *rom.ChecksumSpec) bool {
+	allOk := true
+	for _, region := range spec.Regions {
+		ok, computed, stored, err := region.Verify(image)
+		if err != nil {
+			log.Fatalf("verify %s: %v", region, err)
+		}
+		status := "OK"
+		if !ok {
+			status = "MISMATCH"
+			allOk = false
+		}
+		fmt.Printf("%-8s %s computed 0x%X stored 0x%X\n", status, region, computed, stored)
+	}
+	return allOk
+}
+
+func fix(image *rom.Image, spec *rom.ChecksumSpec, romPath, outPath string) {
+	if outPath == "" {
+		outPath = romPath[:len(romPath)-len(filepath.Ext(romPath))] + ".fixed.bin"
+	}
+	if err := spec.Fix(image); err != nil {
+		log.Fatal(err)
+	}
+	verify(image, spec)
+	if err := image.Save(outPath); err != nil {
+		log.Fatalf("write %s: %v", outPath, err)
+	}
+	log.Printf("wrote %s", outPath)
+}
+
+func loadSpec(path string) *rom.ChecksumSpec {
+	spec, err := rom.LoadChecksumSpec(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return spec
+}
@@ -1,54 +1,223 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
 	"huskki/config"
 	"huskki/drivers"
 	"huskki/ecus"
+	"huskki/events"
+	"huskki/rom"
+	"huskki/store"
 	"huskki/web/handlers"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// driverStopTimeout is how long to wait for the driver to stop polling and put the ECU back in its default session.
+	driverStopTimeout = 10 * time.Second
+	// dashboardBuffer is how many frames the dashboard can fall behind by before the driver waits for it.
+	dashboardBuffer = 1024
 )
 
 func main() {
-	flags, serialFlags, replayFlags, socketCANFlags := config.GetFlags()
+	flags, serialFlags, replayFlags, socketCANFlags, calibrationFlags := config.GetFlags()
+
+	// Everything bike specific comes from the profile, the streams have to be loaded before anything uses them
+	if flags.ECU == "list" {
+		fmt.Print(ecus.Describe())
+		return
+	}
+	profiles, identifications, err := loadECUs(flags, socketCANFlags, replayFlags)
+	if err != nil {
+		log.Fatalf("couldn't load ECU profile: %v", err)
+	}
+	log.Printf("using ECU profiles %s", profiles.Names())
+	store.Load(profiles.Dashboard())
+	for i, profile := range profiles {
+		store.ECUs = append(store.ECUs, &store.ECUInfo{
+			ECU:            cmp.Or(profile.Registration, profile.Name),
+			Profile:        profile.Name,
+			Experimental:   profile.Experimental,
+			Identification: identifications[i],
+		})
+	}
+	if flags.Driver == config.Arduino {
+		store.Link = &store.LinkStats{}
+	}
+
+	// Drivers publish their frames to the hub, the dashboard and the logs each take them from their own subscription
+	hub := events.NewHub()
+	go store.StreamFrames(hub.Subscribe(dashboardBuffer))
+	if flags.CSVLog != "" {
+		csvLog, err := drivers.OpenCSVLog(hub, flags.CSVLog)
+		if err != nil {
+			log.Fatalf("couldn't open csv log: %v", err)
+		}
+		// Closed after the driver has stopped publishing
+		defer func() {
+			if err := csvLog.Close(); err != nil {
+				log.Printf("couldn't close csv log: %v", err)
+			}
+		}()
+	}
 
 	// Create the correct driver
 	var driver drivers.Driver
 	switch flags.Driver {
 	case config.Arduino:
-		driver = drivers.NewArduino(serialFlags, &ecus.K701{})
+		driver = drivers.NewArduino(serialFlags, profiles, hub)
 	case config.SocketCAN:
-		driver = drivers.NewSocketCAN(socketCANFlags, &ecus.K701{})
+		driver = drivers.NewSocketCAN(socketCANFlags, profiles, hub)
 	case config.Replay:
-		driver = drivers.NewReplayer(replayFlags, &ecus.K701{})
+		driver = drivers.NewReplayer(replayFlags, profiles, hub)
 	default:
 		log.Fatalf("unsupported driver type: %s", flags.Driver)
 		return
 	}
 
+	// Ctrl-C or a SIGTERM stops the driver and the server, then the driver's logs are closed behind them
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Start up the driver
-	err := driver.Init()
+	err = driver.Init()
 	if err != nil {
 		log.Printf("couldn't init driver: %s", err)
+		if err = driver.Close(); err != nil {
+			log.Printf("couldn't close driver: %s", err)
+		}
 		return
 	}
+	defer func() {
+		if err := driver.Close(); err != nil {
+			log.Printf("couldn't close driver: %s", err)
+		}
+	}()
 
+	driverDone := make(chan struct{})
 	go func() {
-		err = driver.Run()
-		if err != nil {
+		defer close(driverDone)
+		if err := driver.Run(ctx); err != nil {
 			log.Printf("error running driver: %s", err)
 		}
 	}()
+	defer func() {
+		stop()
+		select {
+		case <-driverDone:
+		case <-time.After(driverStopTimeout):
+			log.Printf("driver didn't stop within %s", driverStopTimeout)
+		}
+	}()
 
 	// Initialise UI
 	dashboard, err := web.NewDashboard()
 	if err != nil {
-		log.Fatalf("couldn't create dashboard: %v", err)
+		log.Printf("couldn't create dashboard: %v", err)
+		return
 	}
 
 	// Initialise Server
 	server := web.NewServer(dashboard)
-	err = server.Start(flags.Addr)
+
+	// Calibration viewer is optional, it needs a definition to know where the tables are in the rom
+	if calibrationFlags.DefinitionPath != "" {
+		calibration, err := newCalibration(calibrationFlags)
+		if err != nil {
+			log.Printf("couldn't create calibration viewer: %v", err)
+			return
+		}
+		server.AddHandlers(calibration.Handlers())
+	}
+
+	err = server.Start(ctx, flags.Addr)
+	if err != nil {
+		log.Printf("couldn't start server: %v", err)
+		return
+	}
+	log.Printf("shutting down")
+}
+
+// loadECUs picks the ECU profiles and reads each ECU's identification if the driver can. Socket CAN asks the ECUs, a
+// replay uses the metadata saved with its log. Only the first ECU can be auto.
+func loadECUs(flags *config.Flags, socketCANFlags *config.SocketCANFlags, replayFlags *config.ReplayFlags) (ecus.Set, []ecus.Identification, error) {
+	profiles, err := ecus.LoadSet(flags.ECU, flags.ProfilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	auto := flags.ProfilePath == "" && strings.TrimSpace(strings.Split(flags.ECU, ",")[0]) == ecus.AUTO_ECU
+	identifications := make([]ecus.Identification, len(profiles))
+
+	switch flags.Driver {
+	case config.SocketCAN:
+		for i, profile := range profiles {
+			// Only UDS ECUs have identification DIDs
+			if !profile.UDS() {
+				continue
+			}
+			// Identification DIDs are standard, so the default profile's CAN IDs are good enough to ask with auto
+			identification, err := drivers.IdentifySocketCAN(socketCANFlags, profile.CAN)
+			if err != nil {
+				log.Printf("couldn't identify %s: %v", profile.Name, err)
+				continue
+			}
+			log.Printf("%s identification: %s", profile.Name, identification)
+			identifications[i] = identification
+			if i == 0 && auto {
+				if profiles[0], err = ecus.IdentifyProfile(identification); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	case config.Replay:
+		metadata, err := drivers.ReadLogMetadata(replayFlags.Path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Printf("couldn't read log metadata: %v", err)
+			}
+			break
+		}
+		log.Printf("log recorded with %d ECUs on %s", len(metadata.ECUs), metadata.Started.Format(time.DateTime))
+		if auto {
+			profiles = nil
+			for i, ecu := range metadata.ECUs {
+				// Logs recorded with a profile file only have its name, the file may not be around anymore
+				profile, err := ecus.Load(ecu.ECU, "")
+				if err != nil && i == 0 {
+					profile, err = ecus.IdentifyProfile(ecu.Identification)
+				}
+				if err != nil {
+					return nil, nil, err
+				}
+				profiles = append(profiles, profile)
+			}
+		}
+		identifications = make([]ecus.Identification, len(profiles))
+		for i := range min(len(profiles), len(metadata.ECUs)) {
+			identifications[i] = metadata.ECUs[i].Identification
+		}
+	}
+
+	profiles, err = ecus.NewSet(profiles...)
+	return profiles, identifications, err
+}
+
+func newCalibration(calibrationFlags *config.CalibrationFlags) (*web.Calibration, error) {
+	definition, err := rom.Load(calibrationFlags.DefinitionPath)
+	if err != nil {
+		return nil, err
+	}
+	image, err := rom.LoadImage(calibrationFlags.RomPath)
 	if err != nil {
-		log.Fatalf("couldn't start server: %v", err)
+		return nil, err
 	}
+	return web.NewCalibration(definition, image)
 }
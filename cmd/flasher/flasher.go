@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"huskki/ecus"
+	"huskki/flash"
+	"huskki/rom"
+	"huskki/sim"
+	"huskki/uds"
+)
+
+func main() {
+	romPath := flag.String("rom", "", "Tuned ROM image to write")
+	ecu := flag.String("ecu", ecus.DEFAULT_ECU, "ECU profile for CAN IDs and security access")
+	profilePath := flag.String("profile", "", "ECU profile JSON, overrides -ecu")
+	specPath := flag.String("spec", "checksums.json", "Checksum spec the image has to pass, see cmd/checksum")
+	start := flag.Uint("start", 0, "First address to write")
+	end := flag.Uint("end", 0, "Address to stop writing at (default: end of the image)")
+	hardwareID := flag.String("hardware-id", "", "Hardware ID the ECU must report before anything is written")
+	hardwareIDDid := flag.Uint("hardware-id-did", flash.DID_ECU_HARDWARE_NUMBER, "DID the hardware ID is read from")
+	batteryDid := flag.Uint("battery-did", 0, "DID the battery voltage is read from, required")
+	batteryExpr := flag.String("battery-expr", "X/1000", "Scales the battery DID, read as a big endian integer X, to volts")
+	minBattery := flag.Float64("min-battery", 12.5, "Lowest battery voltage to start writing at")
+	dryRun := flag.Bool("dry-run", true, "Write to a simulated ECU instead of the bus")
+	simRomPath := flag.String("sim-rom", rom.DEFAULT_IMAGE_PATH, "Dump the simulated ECU starts with")
+	simHardwareID := flag.String("sim-hardware-id", "", "Hardware ID the simulated ECU reports (default: -hardware-id)")
+	simBatteryMillivolts := flag.Uint("sim-battery-mv", 13200, "Battery millivolts the simulated ECU reports")
+	socketCANAddr := flag.String("socket-can-address", "can0", "Socket CAN bus address, only used with -dry-run=false")
+	flag.Parse()
+
+	if *romPath == "" {
+		log.Fatal("-rom is required")
+	}
+	// There's no standard DID for the battery voltage and nothing is written without checking it
+	if *batteryDid == 0 {
+		log.Fatal("-battery-did is required, look it up in the ECU's DID list or a diagnostic log")
+	}
+	profile, err := ecus.Load(*ecu, *profilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	image, err := rom.LoadImage(*romPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	spec, err := rom.LoadChecksumSpec(*specPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *end == 0 {
+		*end = uint(image.Len())
+	}
+
+	var transport uds.Transport
+	var virtualECU *sim.ECU
+	var original []byte
+	if *dryRun {
+		simImage, err := rom.LoadImage(*simRomPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *simHardwareID == "" {
+			*simHardwareID = *hardwareID
+		}
+		if simImage.Len() != image.Len() {
+			log.Fatalf("%s is %d bytes but %s is %d", *simRomPath, simImage.Len(), *romPath, image.Len())
+		}
+		original = simImage.Bytes()
+		virtualECU = sim.NewECU(original, map[uint16][]byte{
+			uint16(*hardwareIDDid): []byte(*simHardwareID),
+			uint16(*batteryDid):    {byte(*simBatteryMillivolts >> 8), byte(*simBatteryMillivolts)},
+		})
+		transport = virtualECU
+		log.Printf("dry run against a simulated ECU loaded with %s", *simRomPath)
+	} else {
+		socket, err := uds.DialIsotp(*socketCANAddr, uint32(profile.CAN.Request), uint32(profile.CAN.Response))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer socket.Close()
+		transport = socket
+		log.Printf("writing to the ECU on %s", *socketCANAddr)
+	}
+
+	written := -1
+	flasher, err := flash.New(uds.NewClient(transport), flash.Options{
+		Start:             uint32(*start),
+		End:               uint32(*end),
+		HardwareIDDid:     uint16(*hardwareIDDid),
+		HardwareID:        *hardwareID,
+		BatteryDid:        uint16(*batteryDid),
+		BatteryExpr:       *batteryExpr,
+		MinBatteryVoltage: *minBattery,
+		Checksums:         spec,
+		Unlock:            profile.Unlock,
+		Progress: func(done float64) {
+			if percent := int(done * 100); percent > written {
+				written = percent
+				log.Printf("written %d%%", percent)
+			}
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Ctrl-C cancels the flash through the same path as a failure, which puts the ECU back in its default session
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = flasher.Flash(ctx, image)
+	stop()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if virtualECU != nil {
+		// Belt and braces on top of the read back, check nothing outside the range was touched either
+		memory := virtualECU.Memory()
+		written := memory[*start:*end]
+		if !bytes.Equal(written, image.Bytes()[*start:*end]) {
+			log.Fatal("simulated ECU doesn't hold the image after writing")
+		}
+		if !bytes.Equal(memory[:*start], original[:*start]) || !bytes.Equal(memory[*end:], original[*end:]) {
+			log.Fatalf("simulated ECU was changed outside 0x%06X-0x%06X", *start, *end)
+		}
+	}
+	log.Printf("wrote 0x%06X-0x%06X", *start, *end)
+}
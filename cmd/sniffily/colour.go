@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+
+	"huskki/utils"
+)
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+)
+
+// pairColours are handed out to request IDs in the order they turn up, so every conversation keeps its colour.
+var pairColours = []string{"\x1b[36m", "\x1b[35m", "\x1b[34m", "\x1b[96m", "\x1b[95m", "\x1b[94m"}
+
+// painter colours exchanges for the terminal, a nil painter leaves everything as is.
+type painter struct {
+	pairs map[uint32]colour
+}
+
+// colour is an ANSI colour, the empty colour paints nothing.
+type colour string
+
+func (c colour) paint(text string) string {
+	if c == "" {
+		return text
+	}
+	return string(c) + text + ansiReset
+}
+
+func newPainter() *painter {
+	return &painter{pairs: map[uint32]colour{}}
+}
+
+// pair is the colour of the conversation on a request ID, or on the response ID for responses without a request.
+func (p *painter) pair(requestID, responseID *utils.HexUint32) colour {
+	if p == nil {
+		return ""
+	}
+	id := requestID
+	if id == nil {
+		id = responseID
+	}
+	if id == nil {
+		return ""
+	}
+	c, ok := p.pairs[uint32(*id)]
+	if !ok {
+		c = colour(pairColours[len(p.pairs)%len(pairColours)])
+		p.pairs[uint32(*id)] = c
+	}
+	return c
+}
+
+func (p *painter) negative() colour {
+	if p == nil {
+		return ""
+	}
+	return ansiRed
+}
+
+func (p *painter) unanswered() colour {
+	if p == nil {
+		return ""
+	}
+	return ansiYellow
+}
+
+func (p *painter) value() colour {
+	if p == nil {
+		return ""
+	}
+	return ansiGreen
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"huskki/drivers"
+	"huskki/ecus"
+	"huskki/models"
+	"huskki/uds"
+	"huskki/utils"
+)
+
+const (
+	// obdFunctionalID is the OBD-II broadcast request ID every emissions ECU answers.
+	obdFunctionalID = 0x7DF
+	// obdPhysicalRequestIDs and obdPhysicalResponseIDs are the 11 bit diagnostic IDs, responses are the request + 8.
+	obdPhysicalRequestIDs  = 0x7E0
+	obdPhysicalResponseIDs = 0x7E8
+	obdPhysicalIDCount     = 8
+	// udsNormalFixed and udsFunctionalFixed are the 29 bit diagnostic IDs, 0x18DA<target><source>.
+	udsNormalFixed     = 0x18DA0000
+	udsFunctionalFixed = 0x18DB0000
+	udsFixedMask       = 0x1FFF0000
+	// udsFunctionalTarget is the OBD-II functional target address in 29 bit IDs.
+	udsFunctionalTarget = 0x33
+
+	// unansweredAfter is how long a request waits for its response before it's shown as unanswered, ECUs that
+	// answer response pending get uds.DefaultPendingTimeout after the last one.
+	unansweredAfter = time.Second
+)
+
+var obdServiceNames = map[byte]string{
+	0x01: "OBD current data",
+	0x02: "OBD freeze frame",
+	0x03: "OBD stored DTCs",
+	0x04: "OBD clear DTCs",
+	0x07: "OBD pending DTCs",
+	0x09: "OBD vehicle information",
+	0x0A: "OBD permanent DTCs",
+}
+
+// Exchange is a request and its response, annotated with whatever the ECU profiles know about it. Either side can
+// be missing: requests that were never answered (tester present with suppressed responses, or the capture ending)
+// and responses whose request was sent before the capture started.
+type Exchange struct {
+	// Time is seconds since the capture's first frame, when the request (or response, if there wasn't one) was seen.
+	Time       float64          `json:"time"`
+	ECU        string           `json:"ecu,omitempty"`
+	RequestID  *utils.HexUint32 `json:"requestId,omitempty"`
+	ResponseID *utils.HexUint32 `json:"responseId,omitempty"`
+	SID        utils.HexUint32  `json:"sid"`
+	Service    string           `json:"service"`
+	Request    string           `json:"request,omitempty"`
+	Response   string           `json:"response,omitempty"`
+	// LatencyMs is from the request to the final response, including any response pending replies.
+	LatencyMs *float64 `json:"latencyMs,omitempty"`
+	// Pending is how many response pending (NRC 0x78) replies came before the final response.
+	Pending int              `json:"pending,omitempty"`
+	DID     *utils.HexUint32 `json:"did,omitempty"`
+	DIDName string           `json:"didName,omitempty"`
+	Address *utils.HexUint32 `json:"address,omitempty"`
+	Length  int              `json:"length,omitempty"`
+	NRC     *utils.HexUint32 `json:"nrc,omitempty"`
+	NRCName string           `json:"nrcName,omitempty"`
+	Values  []*Value         `json:"values,omitempty"`
+
+	requestAt time.Duration
+	// waitingSince is the request, or the last response pending.
+	waitingSince time.Duration
+}
+
+// Value is a value decoded out of a response by the ECU's profile.
+type Value struct {
+	Stream string  `json:"stream"`
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit,omitempty"`
+}
+
+// decoder turns a capture's frames into exchanges.
+type decoder struct {
+	profiles ecus.Set
+	streams  map[string]*models.Stream
+	// extraIDs are diagnostic IDs from -ids on top of the profiles' and the standard ones.
+	extraIDs map[uint32]bool
+
+	reassemblers map[uint32]*uds.Reassembler
+	// pending are requests waiting for their response, by request ID.
+	pending map[uint32]*Exchange
+	started bool
+	start   time.Duration
+	emit    func(*Exchange) error
+}
+
+func newDecoder(profiles ecus.Set, extraIDs map[uint32]bool, emit func(*Exchange) error) *decoder {
+	streams, _ := profiles.Dashboard()
+	return &decoder{
+		profiles:     profiles,
+		streams:      streams,
+		extraIDs:     extraIDs,
+		reassemblers: map[uint32]*uds.Reassembler{},
+		pending:      map[uint32]*Exchange{},
+		emit:         emit,
+	}
+}
+
+// diagnostic reports whether id carries ISO-TP diagnostics rather than broadcast traffic.
+func (d *decoder) diagnostic(id uint32) bool {
+	if d.extraIDs[id] || id == obdFunctionalID {
+		return true
+	}
+	if id >= obdPhysicalRequestIDs && id < obdPhysicalResponseIDs+obdPhysicalIDCount {
+		return true
+	}
+	if id&udsFixedMask == udsNormalFixed || id&udsFixedMask == udsFunctionalFixed {
+		return true
+	}
+	for _, p := range d.profiles {
+		if p.Service != ecus.SERVICE_BROADCAST && (id == uint32(p.CAN.Request) || id == uint32(p.CAN.Response)) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestIDs are the IDs a response on id can be answering, most likely first.
+func (d *decoder) requestIDs(id uint32) []uint32 {
+	var ids []uint32
+	for _, p := range d.profiles {
+		if p.Service != ecus.SERVICE_BROADCAST && id == uint32(p.CAN.Response) {
+			ids = append(ids, uint32(p.CAN.Request))
+		}
+	}
+	switch {
+	case id >= obdPhysicalResponseIDs && id < obdPhysicalResponseIDs+obdPhysicalIDCount:
+		ids = append(ids, id-(obdPhysicalResponseIDs-obdPhysicalRequestIDs), obdFunctionalID)
+	case id&udsFixedMask == udsNormalFixed:
+		target, source := id>>8&0xFF, id&0xFF
+		ids = append(ids, udsNormalFixed|source<<8|target, udsFunctionalFixed|udsFunctionalTarget<<8|target)
+	}
+	return ids
+}
+
+// profile is the profile of the ECU on either ID, or nil.
+func (d *decoder) profile(requestID, responseID *utils.HexUint32) *ecus.Profile {
+	for _, p := range d.profiles {
+		if p.Service == ecus.SERVICE_BROADCAST {
+			continue
+		}
+		if responseID != nil && *responseID == p.CAN.Response || requestID != nil && *requestID == p.CAN.Request {
+			return p
+		}
+	}
+	return nil
+}
+
+func (d *decoder) add(frame drivers.CandumpFrame) error {
+	if !d.started {
+		d.started = true
+		d.start = frame.At
+	}
+	// Any traffic moves the clock on for requests waiting on an answer
+	at := frame.At - d.start
+	if err := d.expire(at); err != nil {
+		return err
+	}
+	if !d.diagnostic(frame.ID) {
+		return nil
+	}
+	reassembler, ok := d.reassemblers[frame.ID]
+	if !ok {
+		reassembler = &uds.Reassembler{}
+		d.reassemblers[frame.ID] = reassembler
+	}
+	message, ok := reassembler.Add(frame.Data)
+	if !ok {
+		return nil
+	}
+	if isRequest(message[0]) {
+		return d.request(frame.ID, message, at)
+	}
+	return d.response(frame.ID, message, at)
+}
+
+// isRequest tells requests from responses by their service ID, responses have 0x40 added and negative ones are 0x7F.
+func isRequest(sid byte) bool {
+	return sid < uds.PositiveResponseOffset || sid >= 0x80 && sid < 0x80+uds.PositiveResponseOffset
+}
+
+func (d *decoder) request(id uint32, message []byte, at time.Duration) error {
+	// A request the ECU didn't answer before the next one, e.g. tester present with suppressed responses
+	if previous, ok := d.pending[id]; ok {
+		delete(d.pending, id)
+		if err := d.finish(previous); err != nil {
+			return err
+		}
+	}
+	requestID := utils.HexUint32(id)
+	exchange := &Exchange{
+		Time:      at.Seconds(),
+		RequestID: &requestID,
+		SID:       utils.HexUint32(message[0]),
+		Request:   fmt.Sprintf("% X", message),
+		requestAt: at,
+
+		waitingSince: at,
+	}
+	d.annotateRequest(exchange, message)
+	d.pending[id] = exchange
+	return nil
+}
+
+func (d *decoder) response(id uint32, message []byte, at time.Duration) error {
+	sid := message[0] - uds.PositiveResponseOffset
+	negative := message[0] == uds.NegativeResponse && len(message) >= 3
+	if negative {
+		sid = message[1]
+	}
+
+	var exchange *Exchange
+	for _, requestID := range d.requestIDs(id) {
+		if pending, ok := d.pending[requestID]; ok && byte(pending.SID) == sid {
+			exchange = pending
+			break
+		}
+	}
+	if exchange == nil {
+		exchange = &Exchange{Time: at.Seconds(), SID: utils.HexUint32(sid)}
+	}
+	if negative && message[2] == uds.NrcResponsePending {
+		exchange.Pending++
+		exchange.waitingSince = at
+		return nil
+	}
+	responseID := utils.HexUint32(id)
+	exchange.ResponseID = &responseID
+	exchange.Response = fmt.Sprintf("% X", message)
+	if exchange.RequestID != nil {
+		delete(d.pending, uint32(*exchange.RequestID))
+		latency := float64(at-exchange.requestAt) / float64(time.Millisecond)
+		exchange.LatencyMs = &latency
+	}
+
+	if negative {
+		nrc := utils.HexUint32(message[2])
+		exchange.NRC = &nrc
+		exchange.NRCName = uds.NRCName(message[2])
+	} else {
+		d.annotateResponse(exchange, message)
+	}
+	return d.finish(exchange)
+}
+
+// annotateRequest fills in what the request asks for, DIDs and addresses.
+func (d *decoder) annotateRequest(exchange *Exchange, message []byte) {
+	switch byte(exchange.SID) {
+	case uds.SidReadDataByIdentifier, uds.SidWriteDataByIdentifier, uds.SidIOControlByIdentifier:
+		if len(message) >= 3 {
+			d.setDID(exchange, uint32(message[1])<<8|uint32(message[2]))
+		}
+	case 0x01:
+		if len(message) >= 2 {
+			d.setDID(exchange, uint32(message[1]))
+		}
+	case uds.SidReadMemoryByAddress:
+		address, length, ok := memoryRequest(message)
+		if ok {
+			exchange.Address = &address
+			exchange.Length = length
+		}
+	}
+}
+
+// memoryRequest reads the address and length of a ReadMemoryByAddress. The K701 sends a 0 format byte followed by a
+// 3 byte address and 1 byte length, anything else uses the standard address and length format identifier.
+func memoryRequest(message []byte) (utils.HexUint32, int, bool) {
+	if len(message) < 2 {
+		return 0, 0, false
+	}
+	addressBytes, lengthBytes := int(message[1]&0x0F), int(message[1]>>4)
+	if message[1] == 0 {
+		addressBytes, lengthBytes = 3, 1
+	}
+	if addressBytes > 4 || lengthBytes > 4 || len(message) < 2+addressBytes+lengthBytes {
+		return 0, 0, false
+	}
+	var address uint32
+	for _, b := range message[2 : 2+addressBytes] {
+		address = address<<8 | uint32(b)
+	}
+	var length int
+	for _, b := range message[2+addressBytes : 2+addressBytes+lengthBytes] {
+		length = length<<8 | int(b)
+	}
+	return utils.HexUint32(address), length, true
+}
+
+// annotateResponse decodes a positive response with the ECU's profile.
+func (d *decoder) annotateResponse(exchange *Exchange, message []byte) {
+	profile := d.profile(exchange.RequestID, exchange.ResponseID)
+	if profile == nil {
+		return
+	}
+	exchange.ECU = profile.Name
+	did, data, ok := profile.ResponseDID(message)
+	if !ok {
+		return
+	}
+	d.setDID(exchange, did)
+	exchange.DIDName = profile.DIDName(did)
+	for _, datum := range profile.ParseDIDBytes(did, data) {
+		value := &Value{Stream: datum.StreamKey, Value: datum.DidValue}
+		if stream, ok := d.streams[datum.StreamKey]; ok {
+			value.Unit = stream.Unit()
+		}
+		exchange.Values = append(exchange.Values, value)
+	}
+}
+
+func (d *decoder) setDID(exchange *Exchange, did uint32) {
+	id := utils.HexUint32(did)
+	exchange.DID = &id
+	if profile := d.profile(exchange.RequestID, exchange.ResponseID); profile != nil {
+		exchange.ECU = profile.Name
+		exchange.DIDName = profile.DIDName(did)
+	}
+}
+
+func (d *decoder) finish(exchange *Exchange) error {
+	if name, ok := obdServiceNames[byte(exchange.SID)]; ok {
+		exchange.Service = name
+	} else {
+		exchange.Service = uds.ServiceName(byte(exchange.SID))
+	}
+	return d.emit(exchange)
+}
+
+// expire emits the requests that have waited too long for a response as unanswered, so they show up live rather than
+// when the next request on their ID comes along.
+func (d *decoder) expire(at time.Duration) error {
+	var expired []*Exchange
+	for id, exchange := range d.pending {
+		timeout := unansweredAfter
+		if exchange.Pending > 0 {
+			timeout = uds.DefaultPendingTimeout
+		}
+		if at-exchange.waitingSince > timeout {
+			expired = append(expired, exchange)
+			delete(d.pending, id)
+		}
+	}
+	return d.finishInOrder(expired)
+}
+
+// close emits the requests still waiting for a response at the end of the capture.
+func (d *decoder) close() error {
+	unanswered := slices.Collect(maps.Values(d.pending))
+	d.pending = map[uint32]*Exchange{}
+	return d.finishInOrder(unanswered)
+}
+
+// finishInOrder emits exchanges taken from the pending map, whose order is random, in capture order.
+func (d *decoder) finishInOrder(exchanges []*Exchange) error {
+	slices.SortFunc(exchanges, func(a, b *Exchange) int {
+		return cmp.Compare(a.requestAt, b.requestAt)
+	})
+	for _, exchange := range exchanges {
+		if err := d.finish(exchange); err != nil {
+			return err
+		}
+	}
+	return nil
+}
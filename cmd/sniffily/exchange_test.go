@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"huskki/drivers"
+	"huskki/ecus"
+)
+
+// testFrame is a frame at ms into the capture, data is hex with or without spaces.
+type testFrame struct {
+	ms   int
+	id   uint32
+	data string
+}
+
+// expected is what an exchange should come out as, unset fields aren't checked. latencyMs is -1 for no latency.
+type expected struct {
+	sid        uint32
+	requestID  uint32
+	responseID uint32
+	did        uint32
+	ecu        string
+	pending    int
+	nrc        uint32
+	latencyMs  float64
+	response   string
+	values     int
+}
+
+func decode(t *testing.T, frames []testFrame) []*Exchange {
+	t.Helper()
+	profile, err := ecus.Lookup("k701")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := ecus.NewSet(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exchanges []*Exchange
+	d := newDecoder(profiles, nil, func(exchange *Exchange) error {
+		exchanges = append(exchanges, exchange)
+		return nil
+	})
+	for _, f := range frames {
+		data, err := hex.DecodeString(strings.ReplaceAll(f.data, " ", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := drivers.CandumpFrame{At: time.Duration(f.ms) * time.Millisecond, HasTime: true, ID: f.id, Data: data}
+		if err = d.add(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = d.close(); err != nil {
+		t.Fatal(err)
+	}
+	return exchanges
+}
+
+func TestDecoder(t *testing.T) {
+	vin := "57 42 30 31 32 33 34 35 36 37 38 39 41 42 43 44 45"
+	tests := []struct {
+		name      string
+		frames    []testFrame
+		exchanges []expected
+	}{
+		{"single frame", []testFrame{
+			{0, 0x7E0, "03 22 01 00 00 00 00 00"},
+			{12, 0x7E8, "05 62 01 00 1B 58 00 00"},
+		}, []expected{
+			{sid: 0x22, requestID: 0x7E0, responseID: 0x7E8, did: 0x0100, ecu: "KTM/Husqvarna K701", latencyMs: 12, response: "62 01 00 1B 58", values: 1},
+		}},
+		{"multi frame response", []testFrame{
+			{0, 0x7E0, "03 22 F1 90 00 00 00 00"},
+			{5, 0x7E8, "10 14 62 F1 90 57 42 30"},
+			{6, 0x7E0, "30 00 00 00 00 00 00 00"},
+			{7, 0x7E8, "21 31 32 33 34 35 36 37"},
+			{8, 0x7E8, "22 38 39 41 42 43 44 45"},
+		}, []expected{
+			{sid: 0x22, requestID: 0x7E0, responseID: 0x7E8, did: 0xF190, latencyMs: 8, response: "62 F1 90 " + vin},
+		}},
+		{"response pending", []testFrame{
+			{0, 0x7E0, "04 31 01 FF 00 00 00 00"},
+			{50, 0x7E8, "03 7F 31 78 00 00 00 00"},
+			{550, 0x7E8, "03 7F 31 78 00 00 00 00"},
+			{900, 0x7E8, "04 71 01 FF 00 00 00 00"},
+		}, []expected{
+			{sid: 0x31, requestID: 0x7E0, responseID: 0x7E8, pending: 2, latencyMs: 900, response: "71 01 FF 00"},
+		}},
+		{"negative response", []testFrame{
+			{0, 0x7E0, "03 22 12 34 00 00 00 00"},
+			{3, 0x7E8, "03 7F 22 31 00 00 00 00"},
+		}, []expected{
+			{sid: 0x22, requestID: 0x7E0, responseID: 0x7E8, did: 0x1234, nrc: 0x31, latencyMs: 3, response: "7F 22 31"},
+		}},
+		{"OBD functional request", []testFrame{
+			{0, 0x7DF, "02 01 0C 00 00 00 00 00"},
+			{20, 0x7E8, "04 41 0C 1B 58 00 00 00"},
+		}, []expected{
+			{sid: 0x01, requestID: 0x7DF, responseID: 0x7E8, did: 0x0C, latencyMs: 20, response: "41 0C 1B 58"},
+		}},
+		{"29 bit IDs", []testFrame{
+			{0, 0x18DA10F1, "03 22 F1 8C 00 00 00 00"},
+			{4, 0x18DAF110, "05 62 F1 8C 12 34 00 00"},
+		}, []expected{
+			{sid: 0x22, requestID: 0x18DA10F1, responseID: 0x18DAF110, did: 0xF18C, latencyMs: 4, response: "62 F1 8C 12 34"},
+		}},
+		{"unanswered requests in capture order", []testFrame{
+			{0, 0x7E0, "02 3E 80 00 00 00 00 00"},
+			{10, 0x7E1, "02 3E 80 00 00 00 00 00"},
+			{20, 0x7E0, "02 10 03 00 00 00 00 00"},
+			{25, 0x7E8, "06 50 03 00 32 01 F4 00"},
+		}, []expected{
+			{sid: 0x3E, requestID: 0x7E0, latencyMs: -1},
+			{sid: 0x10, requestID: 0x7E0, responseID: 0x7E8, latencyMs: 5, response: "50 03 00 32 01 F4"},
+			{sid: 0x3E, requestID: 0x7E1, latencyMs: -1},
+		}},
+		{"response without its request", []testFrame{
+			{0, 0x7E8, "05 62 01 00 1B 58 00 00"},
+		}, []expected{
+			{sid: 0x22, responseID: 0x7E8, did: 0x0100, latencyMs: -1, response: "62 01 00 1B 58", values: 1},
+		}},
+		{"broadcast traffic is ignored", []testFrame{
+			{0, 0x120, "01 02 03 04 05 06 07 08"},
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exchanges := decode(t, test.frames)
+			if len(exchanges) != len(test.exchanges) {
+				t.Fatalf("got %d exchanges, expected %d", len(exchanges), len(test.exchanges))
+			}
+			for i, want := range test.exchanges {
+				checkExchange(t, i, exchanges[i], want)
+			}
+		})
+	}
+}
+
+func checkExchange(t *testing.T, i int, got *Exchange, want expected) {
+	t.Helper()
+	if uint32(got.SID) != want.sid {
+		t.Errorf("exchange %d: SID 0x%02X, expected 0x%02X", i, uint32(got.SID), want.sid)
+	}
+	if id := optional(got.RequestID); id != want.requestID {
+		t.Errorf("exchange %d: request ID 0x%X, expected 0x%X", i, id, want.requestID)
+	}
+	if id := optional(got.ResponseID); id != want.responseID {
+		t.Errorf("exchange %d: response ID 0x%X, expected 0x%X", i, id, want.responseID)
+	}
+	if did := optional(got.DID); did != want.did {
+		t.Errorf("exchange %d: DID 0x%X, expected 0x%X", i, did, want.did)
+	}
+	if want.ecu != "" && got.ECU != want.ecu {
+		t.Errorf("exchange %d: ECU %q, expected %q", i, got.ECU, want.ecu)
+	}
+	if got.Pending != want.pending {
+		t.Errorf("exchange %d: %d pending, expected %d", i, got.Pending, want.pending)
+	}
+	if nrc := optional(got.NRC); nrc != want.nrc {
+		t.Errorf("exchange %d: NRC 0x%X, expected 0x%X", i, nrc, want.nrc)
+	}
+	switch {
+	case want.latencyMs < 0 && got.LatencyMs != nil:
+		t.Errorf("exchange %d: latency %vms, expected none", i, *got.LatencyMs)
+	case want.latencyMs >= 0 && (got.LatencyMs == nil || *got.LatencyMs != want.latencyMs):
+		t.Errorf("exchange %d: latency %v, expected %vms", i, got.LatencyMs, want.latencyMs)
+	}
+	if got.Response != want.response {
+		t.Errorf("exchange %d: response %q, expected %q", i, got.Response, want.response)
+	}
+	if len(got.Values) != want.values {
+		t.Errorf("exchange %d: %d values, expected %d", i, len(got.Values), want.values)
+	}
+}
+
+func optional[T ~uint32](v *T) uint32 {
+	if v == nil {
+		return 0
+	}
+	return uint32(*v)
+}
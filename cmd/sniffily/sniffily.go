@@ -2,45 +2,309 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"maps"
 	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"syscall"
+
+	"huskki/drivers"
+	"huskki/ecus"
+	"huskki/expr"
+	"huskki/utils"
 )
 
 const (
 	sniffLocation = "logs/read.txt"
-	outLocation   = "logs/read_filtered.txt"
 )
 
+// filterVars are what -filter expressions can use, missing values are -1.
+var filterVars = map[string]string{
+	"t":       "seconds since the capture started",
+	"id":      "request CAN ID",
+	"rsp":     "response CAN ID",
+	"sid":     "request service ID, e.g. 0x22",
+	"did":     "DID or OBD-II PID",
+	"addr":    "ReadMemoryByAddress address",
+	"nrc":     "negative response code",
+	"latency": "milliseconds from request to response",
+}
+
 func main() {
-	file, err := os.Open(sniffLocation)
+	inPath := flag.String("in", sniffLocation, "candump capture to decode, candump -L logs or candump's screen output")
+	live := flag.String("live", "", "SocketCAN interface to decode live instead of -in, e.g. can0 or vcan0")
+	teePath := flag.String("tee", "", "With -live, also record every frame to this candump -L log")
+	outPath := flag.String("out", "", "Where to write the exchanges, stdout if empty")
+	asJSON := flag.Bool("json", false, "Write exchanges as JSON, one object per line")
+	colour := flag.String("color", "auto", "Colour request/response pairs: auto (when writing to a terminal), always or never")
+	ecu := flag.String("ecu", ecus.DEFAULT_ECU, "ECU profiles to decode responses with, comma separated")
+	profilePath := flag.String("profile", "", "ECU profile JSONs to decode responses with, comma separated, overrides -ecu")
+	ids := flag.String("ids", "", "Extra diagnostic CAN IDs to reassemble, comma separated hex, on top of the profiles' and the standard OBD-II/UDS ones")
+	filterSource := flag.String("filter", "", `Only show exchanges the expression is true for, e.g. "sid == 0x23 && t > 10" (variables: `+filterUsage()+`)`)
+	flag.Parse()
+
+	profiles, err := ecus.LoadSet(*ecu, *profilePath)
 	if err != nil {
+		log.Fatalf("load ECU profiles: %v", err)
+	}
+	extraIDs := map[uint32]bool{}
+	if *ids != "" {
+		for _, id := range strings.Split(*ids, ",") {
+			parsed, err := utils.ParseHexUint32(id)
+			if err != nil {
+				log.Fatalf("-ids: %v", err)
+			}
+			extraIDs[uint32(parsed)] = true
+		}
+	}
+	var filter *expr.Expression
+	if *filterSource != "" {
+		if filter, err = parseFilter(*filterSource); err != nil {
+			log.Fatalf("-filter: %v", err)
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		outFile, err := os.Create(*outPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer outFile.Close()
+		out = outFile
+	}
+	writer := bufio.NewWriter(out)
+	defer writer.Flush()
+
+	var painter *painter
+	switch *colour {
+	case "always":
+		painter = newPainter()
+	case "auto":
+		if *outPath == "" && !*asJSON && isTerminal(os.Stdout) {
+			painter = newPainter()
+		}
+	case "never":
+	default:
+		log.Fatalf("-color: expected auto, always or never, got %q", *colour)
+	}
+
+	shown, total := 0, 0
+	encoder := json.NewEncoder(writer)
+	d := newDecoder(profiles, extraIDs, func(exchange *Exchange) error {
+		total++
+		if filter != nil {
+			keep, err := filter.Eval(&expr.Env{Vars: exchangeVars(exchange)})
+			if err != nil {
+				return fmt.Errorf("filter: %w", err)
+			}
+			if keep == 0 {
+				return nil
+			}
+		}
+		shown++
+		var err error
+		if *asJSON {
+			err = encoder.Encode(exchange)
+		} else {
+			_, err = fmt.Fprintln(writer, formatExchange(exchange, painter))
+		}
+		// Live exchanges are shown as they happen rather than when the buffer fills
+		if err == nil && *live != "" {
+			err = writer.Flush()
+		}
+		return err
+	})
+
+	if *live != "" {
+		err = sniffLive(*live, *teePath, d)
+	} else {
+		err = sniffFile(*inPath, d)
+	}
+	if err == nil {
+		err = d.close()
+	}
+	if err != nil {
+		_ = writer.Flush()
 		log.Fatal(err)
-		return
 	}
-	defer file.Close()
+	log.Printf("%d of %d exchanges shown", shown, total)
+}
 
-	outFile, err := os.Create(outLocation)
+// sniffFile decodes a candump capture.
+func sniffFile(path string, d *decoder) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
+	lineIndex := 0
 	for scanner.Scan() {
-		line := scanner.Text()
-		if err = scanner.Err(); err != nil {
-			log.Fatal(err)
+		lineIndex++
+		frame, ok, err := drivers.ParseCandumpLine(scanner.Text())
+		if err != nil {
+			log.Printf("line %d: %v", lineIndex, err)
+			continue
 		}
-		if strings.Contains(line, "]  07 23") {
-			_, err = outFile.WriteString(line + "\n")
-			if err != nil {
-				log.Fatal(err)
-				return
+		if !ok {
+			continue
+		}
+		if err = d.add(frame); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// sniffLive decodes the traffic on a SocketCAN interface until interrupted, recording it to teePath if set.
+func sniffLive(interfaceName, teePath string, d *decoder) error {
+	raw, err := drivers.DialRawCAN(interfaceName)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		_ = raw.Close()
+	}()
+
+	var tee *bufio.Writer
+	if teePath != "" {
+		teeFile, err := os.Create(teePath)
+		if err != nil {
+			return err
+		}
+		defer teeFile.Close()
+		tee = bufio.NewWriter(teeFile)
+		defer tee.Flush()
+	}
+
+	log.Printf("sniffing %s, ctrl-c to stop", interfaceName)
+	for {
+		rawFrame, err := raw.Receive()
+		if errors.Is(err, os.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if tee != nil {
+			if _, err = tee.WriteString(rawFrame.CandumpLine(interfaceName) + "\n"); err != nil {
+				return err
 			}
 		}
+		frame, ok := rawFrame.Candump()
+		if !ok {
+			continue
+		}
+		if err = d.add(frame); err != nil {
+			return err
+		}
+	}
+}
+
+func filterUsage() string {
+	var names []string
+	for _, name := range slices.Sorted(maps.Keys(filterVars)) {
+		names = append(names, fmt.Sprintf("%s %s", name, filterVars[name]))
 	}
+	return strings.Join(names, "; ")
+}
 
-	// Flush to disk
-	err = outFile.Sync()
+// parseFilter parses a -filter expression, catching unknown variables up front rather than on the first exchange.
+func parseFilter(source string) (*expr.Expression, error) {
+	filter, err := expr.Parse(source)
 	if err != nil {
-		log.Fatal(err)
-		return
+		return nil, err
+	}
+	for _, name := range filter.Vars() {
+		if _, ok := filterVars[name]; !ok {
+			return nil, fmt.Errorf("unknown variable %q", name)
+		}
+	}
+	if funcs := filter.Funcs(); len(funcs) > 0 {
+		return nil, fmt.Errorf("unknown function %q", funcs[0])
+	}
+	return filter, nil
+}
+
+func exchangeVars(exchange *Exchange) map[string]float64 {
+	optional := func(v *utils.HexUint32) float64 {
+		if v == nil {
+			return -1
+		}
+		return float64(*v)
+	}
+	latency := -1.0
+	if exchange.LatencyMs != nil {
+		latency = *exchange.LatencyMs
+	}
+	return map[string]float64{
+		"t":       exchange.Time,
+		"id":      optional(exchange.RequestID),
+		"rsp":     optional(exchange.ResponseID),
+		"sid":     float64(exchange.SID),
+		"did":     optional(exchange.DID),
+		"addr":    optional(exchange.Address),
+		"nrc":     optional(exchange.NRC),
+		"latency": latency,
+	}
+}
+
+// formatExchange writes an exchange on one line, e.g.
+// 12.345678  7E0>7E8  ReadDataByIdentifier  DID 0x0100 RPM  RPM=1200 rpm  [22 01 00] [62 01 00 12 C0]  3.1ms
+// With a painter the IDs and both sides of the exchange share a colour per request ID, negative responses are red and
+// unanswered requests yellow.
+func formatExchange(exchange *Exchange, painter *painter) string {
+	hexID := func(v *utils.HexUint32) string {
+		if v == nil {
+			return "?"
+		}
+		return fmt.Sprintf("%X", uint32(*v))
+	}
+	pair := painter.pair(exchange.RequestID, exchange.ResponseID)
+	var line strings.Builder
+	fmt.Fprintf(&line, "%12.6f  %s  %-24s", exchange.Time, pair.paint(fmt.Sprintf("%-7s", hexID(exchange.RequestID)+">"+hexID(exchange.ResponseID))), exchange.Service)
+	if exchange.DID != nil {
+		fmt.Fprintf(&line, "  DID 0x%04X", uint32(*exchange.DID))
+		if exchange.DIDName != "" {
+			fmt.Fprintf(&line, " %s", exchange.DIDName)
+		}
+	}
+	if exchange.Address != nil {
+		fmt.Fprintf(&line, "  %s+%d", exchange.Address, exchange.Length)
+	}
+	if exchange.NRC != nil {
+		line.WriteString("  " + painter.negative().paint(fmt.Sprintf("NRC %s %s", exchange.NRC, exchange.NRCName)))
+	}
+	for _, v := range exchange.Values {
+		value := fmt.Sprintf("%s=%g", v.Stream, v.Value)
+		if v.Unit != "" {
+			value += " " + v.Unit
+		}
+		line.WriteString("  " + painter.value().paint(value))
+	}
+	response := pair
+	if exchange.ResponseID == nil {
+		response = painter.unanswered()
+	}
+	fmt.Fprintf(&line, "  %s %s", pair.paint("["+exchange.Request+"]"), response.paint("["+exchange.Response+"]"))
+	if exchange.LatencyMs != nil {
+		fmt.Fprintf(&line, "  %.1fms", *exchange.LatencyMs)
+	}
+	if exchange.Pending > 0 {
+		fmt.Fprintf(&line, " after %d pending", exchange.Pending)
 	}
+	return line.String()
 }
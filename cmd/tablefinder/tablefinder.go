@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"huskki/rom"
+)
+
+func main() {
+	romPath := flag.String("rom", rom.DEFAULT_IMAGE_PATH, "Path to a ROM image dumped with cmd/dumper")
+	outPath := flag.String("out", "candidates.json", "Where to write candidate definitions, .json or .xdf")
+	minScore := flag.Float64("min-score", 0, "Only keep candidates scoring at least this (0..1)")
+	options := rom.DefaultFinderOptions
+	flag.IntVar(&options.MinAxisLength, "min-axis", options.MinAxisLength, "Minimum breakpoints in an axis")
+	flag.IntVar(&options.MaxAxisLength, "max-axis", options.MaxAxisLength, "Maximum breakpoints in an axis")
+	flag.IntVar(&options.MaxGap, "max-gap", options.MaxGap, "Maximum bytes between an axis and the next axis or data")
+	flag.IntVar(&options.MinCells, "min-cells", options.MinCells, "Minimum cells in a table")
+	flag.Float64Var(&options.MaxRoughness, "max-roughness", options.MaxRoughness, "Maximum relative change in slope between neighbouring cells")
+	flag.Parse()
+
+	image, err := rom.LoadImage(*romPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("scanning %d bytes", image.Len())
+
+	var candidates []*rom.Candidate
+	for _, c := range rom.FindTables(image, options) {
+		if c.Score >= *minScore {
+			candidates = append(candidates, c)
+		}
+	}
+
+	for _, c := range candidates {
+		axisBits := c.Table.X.Data.Bits
+		endian := "BE"
+		if c.Table.Data.LittleEndian {
+			endian = "LE"
+		}
+		fmt.Printf("0x%05X  %2dx%-2d  axis %2d bit  data %2d bit %s  score %.2f\n",
+			uint32(c.Table.Data.Address), c.Table.Rows, c.Table.Cols, axisBits, c.Table.Data.Bits, endian, c.Score)
+	}
+	log.Printf("found %d candidate tables", len(candidates))
+
+	definition := rom.CandidatesDefinition(fmt.Sprintf("Candidates from %s", filepath.Base(*romPath)), candidates)
+	switch strings.ToLower(filepath.Ext(*outPath)) {
+	case ".xdf":
+		err = rom.WriteXDF(*outPath, definition)
+	default:
+		err = rom.WriteJSON(*outPath, definition)
+	}
+	if err != nil {
+		log.Fatalf("write %s: %v", *outPath, err)
+	}
+	log.Printf("wrote %s", *outPath)
+}
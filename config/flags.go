@@ -15,11 +15,28 @@ const (
 type Flags struct {
        Driver DriverType
        Addr   string
+       // ECU names registered ECU profiles, comma separated to poll several ECUs on the same bus. "auto" identifies the
+       // first ECU and "list" prints them all.
+       ECU string
+       // ProfilePath is a comma separated list of ECU profile JSONs, it overrides ECU.
+       ProfilePath string
+       // CSVLog is a CSV to write every frame to as well, whichever the driver.
+       CSVLog string
 }
 
+// SerialProtocol is how the Arduino frames DIDs on the serial port.
+type SerialProtocol string
+
+const (
+	SerialAuto   SerialProtocol = "auto"
+	SerialBinary SerialProtocol = "binary"
+	SerialCSV    SerialProtocol = "csv"
+)
+
 type SerialFlags struct {
 	SerialPort string
 	BaudRate   int
+	Protocol   SerialProtocol
 }
 
 type ReplayFlags struct {
@@ -31,32 +48,50 @@ type ReplayFlags struct {
 
 type SocketCANFlags struct {
 	SocketCanAddr string
+	// Capture records every frame on the bus to a candump log next to the RAWLOG.
+	Capture bool
+}
+
+type CalibrationFlags struct {
+	RomPath        string
+	DefinitionPath string
 }
 
 const DEFAULT_BAUD_RATE = 115200
 
-func GetFlags() (*Flags, *SerialFlags, *ReplayFlags, *SocketCANFlags) {
+func GetFlags() (*Flags, *SerialFlags, *ReplayFlags, *SocketCANFlags, *CalibrationFlags) {
 	flags := &Flags{}
 	var driverStr string
 	flag.StringVar(&driverStr, "driver", "socket-can", "driver type to use to communicate with vehicle")
 	flag.StringVar(&flags.Addr, "addr", ":8080", "http listen address")
+	flag.StringVar(&flags.ECU, "ecu", "auto", "ECU profiles to use, comma separated for several ECUs e.g. 'auto,bosch-abs'. 'auto' picks the first from the ECU's identification, 'list' shows them all")
+	flag.StringVar(&flags.ProfilePath, "profile", "", "ECU profile JSONs describing DIDs, streams and charts, comma separated for several ECUs, overrides -ecu")
+	flag.StringVar(&flags.CSVLog, "csv-log", "", "Also write every frame to this CSV as millis,DID,data rows, replays like a DIDLOG")
 
 	serial := &SerialFlags{}
 	flag.StringVar(&serial.SerialPort, "serial-port", "auto", "serial device path or 'auto'")
 	flag.IntVar(&serial.BaudRate, "baud", DEFAULT_BAUD_RATE, "baud rate")
+	var protocolStr string
+	flag.StringVar(&protocolStr, "serial-protocol", string(SerialAuto), "Arduino output: 'binary' AA 55 frames, 'csv' millis,DID,data_hex rows or 'auto' to tell from the stream")
 
 	replay := &ReplayFlags{}
-	flag.StringVar(&replay.Path, "replay", "", "Path to .bin to replay")
+	flag.StringVar(&replay.Path, "replay", "", "Path to a RAWLOG .bin, a DIDLOG .csv or a candump .log/.txt capture to replay")
 	flag.Float64Var(&replay.Speed, "replay-speed", 1.0, "Replay speed multiplier (0 = as fast as possible)")
 	flag.BoolVar(&replay.Loop, "replay-loop", false, "Loop replay at EOF")
 	flag.IntVar(&replay.SkipFrames, "replay-skip-frames", 0, "Skips X amount of frames from start")
 
 	socketCAN := &SocketCANFlags{}
 	flag.StringVar(&socketCAN.SocketCanAddr, "socket-can-address", "can0", "Socket CAN bus address")
+	flag.BoolVar(&socketCAN.Capture, "can-capture", true, "Record every CAN frame to a candump .log next to the RAWLOG")
+
+	calibration := &CalibrationFlags{}
+	flag.StringVar(&calibration.RomPath, "rom", "rom.bin", "Path to a ROM image dumped with cmd/dumper")
+	flag.StringVar(&calibration.DefinitionPath, "rom-def", "", "Path to a .xdf or .json calibration definition for the ROM, enables the calibration page")
 
 	flag.Parse()
 
 	flags.Driver = DriverType(driverStr)
+	serial.Protocol = SerialProtocol(protocolStr)
 
-	return flags, serial, replay, socketCAN
+	return flags, serial, replay, socketCAN, calibration
 }
@@ -2,14 +2,19 @@ package drivers
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"huskki/config"
 	"huskki/ecus"
+	"huskki/events"
+	"huskki/store"
 	"huskki/utils"
 	"log"
-	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.bug.st/serial"
 	"go.bug.st/serial/enumerator"
@@ -17,10 +22,28 @@ import (
 
 type Arduino struct {
 	*config.SerialFlags
-	ecuProcessor ecus.ECUProcessor
+	profiles ecus.Set
+	hub      *events.Hub
+
+	// commandLock keeps one command in flight, replies only say which command they answer. It also guards port and
+	// disconnected, which Run swaps on every reconnect, disconnected closes when the port goes away.
+	commandLock  sync.Mutex
 	port         serial.Port
+	disconnected chan struct{}
+	replies      chan commandReply
+	// sequences and clock are only touched by the read loop.
+	sequences sequenceTracker
+	clock     deviceClock
+	// takesCommands is set once the sketch answers, older ones don't.
+	takesCommands atomic.Bool
+
+	rawLog  *FrameLog
+	logPath string
 }
 
+// reconnectInterval is how often to look for the Arduino while it's unplugged.
+const reconnectInterval = time.Second
+
 var (
 	badLenErr = errors.New("error data length outside range")
 	badCrcErr = errors.New("error frame checksum does not match")
@@ -35,39 +58,196 @@ var preferredVIDs = map[string]bool{
 	"0403": true, // FTDI
 }
 
-func NewArduino(serialFlags *config.SerialFlags, ecuProcessor ecus.ECUProcessor) *Arduino {
+func NewArduino(serialFlags *config.SerialFlags, profiles ecus.Set, hub *events.Hub) *Arduino {
 	driver := &Arduino{
-		serialFlags,
-		ecuProcessor,
-		nil,
+		SerialFlags: serialFlags,
+		profiles:    profiles,
+		hub:         hub,
+		replies:     make(chan commandReply, 4),
 	}
 	return driver
 }
 
 func (a *Arduino) Init() error {
-	port, err := getArduinoPort(a.SerialPort, a.BaudRate)
+	switch a.Protocol {
+	case config.SerialAuto, config.SerialBinary, config.SerialCSV:
+	default:
+		return fmt.Errorf("unknown serial protocol %q, expected auto, binary or csv", a.Protocol)
+	}
+
+	filePath := utils.NextAvailableFilename(LOG_DIR, LOG_NAME, LOG_EXT)
+	rawLog, err := OpenRawLog(a.hub, filePath)
 	if err != nil {
 		return err
 	}
+	a.rawLog = rawLog
+	a.logPath = filePath
+	if err = writeLogMetadata(filePath, config.Arduino); err != nil {
+		log.Printf("couldn't write log metadata: %v", err)
+	}
+
+	// Run waits for it if it isn't plugged in yet
+	port, err := getArduinoPort(a.SerialPort, a.BaudRate)
+	if err != nil {
+		log.Printf("arduino not connected: %v", err)
+		return nil
+	}
 	a.port = port
 	return nil
 }
 
-func (a *Arduino) Run() error {
-	filePath := utils.NextAvailableFilename(LOG_DIR, LOG_NAME, LOG_EXT)
+// Run reads the Arduino until ctx is cancelled, waiting for it whenever it's unplugged.
+func (a *Arduino) Run(ctx context.Context) error {
+	// Every connection appends to the same rawlog, the Arduino resets when the port opens so its millis start again
+	// like they would after a brown out
+	port := a.port
+	for connections := 0; ctx.Err() == nil; connections++ {
+		if port == nil {
+			if port = a.waitForPort(ctx); port == nil {
+				break
+			}
+		}
+		if connections > 0 && store.Link != nil {
+			store.Link.Reconnects.Add(1)
+		}
+		err := a.readPort(ctx, port)
+		if ctx.Err() != nil {
+			break
+		}
+		log.Printf("arduino disconnected: %v", err)
+		port = nil
+	}
+	return nil
+}
 
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		log.Fatalf("couldn't open rawlog: %v", err)
+// Close closes the port if Run never got to it, and the rawlog.
+func (a *Arduino) Close() error {
+	a.commandLock.Lock()
+	if a.port != nil {
+		_ = a.port.Close()
+		a.port = nil
+	}
+	a.commandLock.Unlock()
+	if a.rawLog == nil {
+		return nil
+	}
+	return a.rawLog.Close()
+}
+
+// readPort pushes the profile and reads frames until the port goes away or ctx is cancelled, then closes it.
+func (a *Arduino) readPort(ctx context.Context, port serial.Port) error {
+	disconnected := make(chan struct{})
+	a.commandLock.Lock()
+	a.port, a.disconnected = port, disconnected
+	a.commandLock.Unlock()
+	a.sequences = sequenceTracker{}
+	// The Arduino resets when the port opens, its millis start again whether or not they go backwards in the log
+	if a.clock.started {
+		a.clock.restart()
+	}
+	a.takesCommands.Store(false)
+	if store.Link != nil {
+		store.Link.Connected.Store(true)
 	}
 
-	defer func() { _ = file.Close() }()
+	// Commands go out straight away, their replies tell the protocol apart too
+	var pushing sync.WaitGroup
+	pushing.Add(1)
+	go func() {
+		defer pushing.Done()
+		a.pushProfile(ctx)
+	}()
 
-	logWriter := bufio.NewWriterSize(file, 1<<20)
-	defer func() { _ = logWriter.Flush() }()
+	// Stopping puts the ECU back in its default session while the read loop is still around for the reply, closing
+	// the port then ends the read loop
+	stopping := context.AfterFunc(ctx, func() {
+		if a.takesCommands.Load() {
+			// ctx is already cancelled, the command still gets its own timeout
+			if err := a.DefaultSession(context.WithoutCancel(ctx)); err != nil {
+				log.Printf("couldn't put the ECU back in its default session: %v", err)
+			} else {
+				log.Printf("ECU back in its default session")
+			}
+		}
+		_ = port.Close()
+	})
 
-	go processBinary(a.port, a.ecuProcessor, logWriter)
-	return nil
+	defer func() {
+		stopping()
+		// Unblock a command waiting on a reply that won't come before taking the port away
+		close(disconnected)
+		pushing.Wait()
+		a.commandLock.Lock()
+		_ = port.Close()
+		a.port = nil
+		a.commandLock.Unlock()
+		if store.Link != nil {
+			store.Link.Connected.Store(false)
+		}
+	}()
+
+	reader := bufio.NewReader(port)
+	protocol := a.Protocol
+	if protocol == config.SerialAuto {
+		var err error
+		if protocol, err = detectSerialProtocol(reader); err != nil {
+			return fmt.Errorf("detect serial protocol: %w", err)
+		}
+		log.Printf("arduino is sending %s frames", protocol)
+	}
+
+	if protocol == config.SerialCSV {
+		return processCSV(reader, a.profiles, a.hub, a)
+	}
+	return processBinary(reader, a.profiles, a.hub, a)
+}
+
+// waitForPort polls for the Arduino until it's plugged in, the configured port or any with one of preferredVIDs. It
+// returns nil if ctx is cancelled first.
+func (a *Arduino) waitForPort(ctx context.Context) serial.Port {
+	log.Printf("waiting for the arduino")
+	ticker := time.NewTicker(reconnectInterval)
+	defer ticker.Stop()
+	for {
+		port, err := getArduinoPort(a.SerialPort, a.BaudRate)
+		if err == nil {
+			return port
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// onSequence counts dropped frames in store.Link.
+func (a *Arduino) onSequence(seq uint16) {
+	dropped, restarted := a.sequences.next(seq)
+	if restarted {
+		log.Printf("arduino restarted")
+	}
+	if dropped > 0 {
+		log.Printf("arduino dropped %d frames", dropped)
+	}
+	if store.Link != nil {
+		store.Link.Sequenced.Store(true)
+		store.Link.Dropped.Add(uint64(dropped))
+	}
+}
+
+// at maps the frame's millis to the host's clock, recording the mapping in the log's metadata as it goes.
+func (a *Arduino) at(millis uint32) time.Time {
+	at, restarted := a.clock.at(millis, time.Now())
+	if restarted {
+		log.Printf("arduino millis went backwards, syncing its clock again")
+	}
+	if sync, ok := a.clock.record(); ok {
+		if err := recordLogClock(a.logPath, sync); err != nil {
+			log.Printf("couldn't record clock sync: %v", err)
+		}
+	}
+	return at
 }
 
 func getArduinoPort(port string, baud int) (serial.Port, error) {
@@ -75,18 +255,18 @@ func getArduinoPort(port string, baud int) (serial.Port, error) {
 	if port == "auto" {
 		name, err := autoSelectPort()
 		if err != nil {
-			log.Fatalf("auto-select: %v", err)
+			return nil, fmt.Errorf("auto-select: %w", err)
 		}
 		port = name
 	}
 	mode := &serial.Mode{BaudRate: baud}
 	serialPort, err := serial.Open(port, mode)
 	if err != nil {
-		log.Fatalf("couldn't open serial %s: %v", port, err)
+		return nil, fmt.Errorf("open serial %s: %w", port, err)
 	}
 	log.Printf("connected to %s @ %d", port, baud)
 
-	return serialPort, err
+	return serialPort, nil
 }
 
 func autoSelectPort() (string, error) {
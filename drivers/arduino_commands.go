@@ -0,0 +1,297 @@
+package drivers
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"huskki/ecus"
+	"huskki/uds"
+)
+
+// Commands the monitor sketch takes from the host, framed as [AA 5A][cmd:u8][len:u8][payload:len][crc8]. It answers
+// each one with [AA 5B][cmd:u8][len:u8][status:u8, data:len-1][crc8], or a "!cmd,status data" line when it's sending
+// CSV. The CRC covers everything after the magic bytes, the same CRC-8 as DID frames.
+const (
+	// CMD_VERSION asks for the firmware version, the sketch also sends the reply unprompted when it boots.
+	CMD_VERSION byte = 0x01
+	// CMD_CLEAR_DIDS empties the list of DIDs the sketch polls.
+	CMD_CLEAR_DIDS byte = 0x02
+	// CMD_ADD_DID adds a DID to poll, [DID:u16 BE][interval ms:u16 BE] where 0 polls it as often as possible.
+	CMD_ADD_DID byte = 0x03
+	// CMD_SECURITY unlocks each security level listed in the payload in turn.
+	CMD_SECURITY byte = 0x04
+	// CMD_READ_DTCS reads every DTC, the reply's data is the ECU's whole ReadDTCInformation response.
+	CMD_READ_DTCS byte = 0x05
+	// CMD_DEFAULT_SESSION stops polling and puts the ECU back in its default session, locking it again.
+	CMD_DEFAULT_SESSION byte = 0x06
+)
+
+// Reply statuses
+const (
+	REPLY_OK          byte = 0x00
+	REPLY_BAD_COMMAND byte = 0x01
+	REPLY_FULL        byte = 0x02
+	REPLY_ECU_ERROR   byte = 0x03
+)
+
+const (
+	// commandTimeout allows for the sketch finishing a poll, which can wait 1.5s on the ECU, before it reads the command.
+	commandTimeout = 3 * time.Second
+	// versionAttempts is how many times to ask for the version on connect, the board resets when the port opens and
+	// ignores the first commands while it boots and unlocks the ECU.
+	versionAttempts = 5
+	// maxIntervalMs is the longest poll interval a command can carry.
+	maxIntervalMs = 0xFFFF
+)
+
+var (
+	magicBytesCommand = []byte{0xAA, 0x5A}
+	magicBytesReply   = []byte{0xAA, 0x5B}
+
+	commandTimeoutErr = errors.New("error no reply from arduino")
+	commandFailedErr  = errors.New("error arduino command failed")
+	disconnectedErr   = errors.New("error arduino disconnected")
+)
+
+var replyStatusNames = map[byte]string{
+	REPLY_BAD_COMMAND: "bad command",
+	REPLY_FULL:        "DID list full",
+	REPLY_ECU_ERROR:   "ECU didn't answer",
+}
+
+// commandReply is the sketch's answer to a command, status is the first byte of payload.
+type commandReply struct {
+	cmd     byte
+	payload []byte
+}
+
+// PolledDID is a DID for the sketch to poll and how often.
+type PolledDID struct {
+	DID      uint16
+	Interval time.Duration
+}
+
+// writeCommand frames a command for the sketch.
+func writeCommand(writer io.Writer, cmd byte, payload []byte) error {
+	if len(payload) > 0xFF {
+		return fmt.Errorf("command payload is %d bytes, at most 255 fit", len(payload))
+	}
+	_, err := writer.Write(record(magicBytesCommand, []byte{cmd, byte(len(payload))}, payload))
+	return err
+}
+
+// readReplyFrame reads a reply after its magic bytes.
+func readReplyFrame(bufferReader *bufio.Reader) (commandReply, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(bufferReader, hdr); err != nil {
+		return commandReply{}, err
+	}
+	tail := make([]byte, int(hdr[1])+1)
+	if _, err := io.ReadFull(bufferReader, tail); err != nil {
+		return commandReply{}, err
+	}
+	payload := tail[:hdr[1]]
+	crc := crc8UpdateBuf(0x00, hdr)
+	crc = crc8UpdateBuf(crc, payload)
+	if crc != tail[hdr[1]] {
+		return commandReply{}, badCrcErr
+	}
+	return commandReply{cmd: hdr[0], payload: payload}, nil
+}
+
+// parseReplyLine parses the CSV form of a reply, e.g. "!01,00 68 75 73 6B", the "!" already checked.
+func parseReplyLine(line string) (commandReply, error) {
+	cmdText, payloadText, ok := strings.Cut(strings.TrimPrefix(line, "!"), ",")
+	if !ok {
+		return commandReply{}, fmt.Errorf("%q: want !cmd,status data: %w", line, badCSVErr)
+	}
+	cmd, err := hex.DecodeString(strings.TrimSpace(cmdText))
+	if err != nil || len(cmd) != 1 {
+		return commandReply{}, fmt.Errorf("%q: bad command: %w", line, badCSVErr)
+	}
+	payload, err := hex.DecodeString(strings.Join(strings.Fields(payloadText), ""))
+	if err != nil {
+		return commandReply{}, fmt.Errorf("%q: bad reply data: %w", line, badCSVErr)
+	}
+	return commandReply{cmd: cmd[0], payload: payload}, nil
+}
+
+// onReply hands replies from the read loop to whoever sent the command, dropping any that nobody is waiting for.
+func (a *Arduino) onReply(reply commandReply) {
+	select {
+	case a.replies <- reply:
+	default:
+		log.Printf("dropped arduino reply to command 0x%02X", reply.cmd)
+	}
+}
+
+// command sends a command and waits for its reply, returning the reply's data after the status. Cancelling ctx stops
+// the wait so the next command isn't held up behind it.
+func (a *Arduino) command(ctx context.Context, cmd byte, payload []byte) ([]byte, error) {
+	a.commandLock.Lock()
+	defer a.commandLock.Unlock()
+
+	if a.port == nil {
+		return nil, fmt.Errorf("command 0x%02X: %w", cmd, disconnectedErr)
+	}
+	// Replies to commands that timed out would otherwise answer this one
+	for len(a.replies) > 0 {
+		<-a.replies
+	}
+	if err := writeCommand(a.port, cmd, payload); err != nil {
+		return nil, fmt.Errorf("send command 0x%02X: %w", cmd, err)
+	}
+
+	timer := time.NewTimer(commandTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case reply := <-a.replies:
+			if reply.cmd != cmd {
+				continue
+			}
+			if len(reply.payload) == 0 {
+				return nil, fmt.Errorf("command 0x%02X: empty reply: %w", cmd, commandFailedErr)
+			}
+			if status := reply.payload[0]; status != REPLY_OK {
+				return reply.payload[1:], fmt.Errorf("command 0x%02X: %s: %w", cmd, replyStatusNames[status], commandFailedErr)
+			}
+			return reply.payload[1:], nil
+		case <-timer.C:
+			return nil, fmt.Errorf("command 0x%02X: %w", cmd, commandTimeoutErr)
+		case <-a.disconnected:
+			return nil, fmt.Errorf("command 0x%02X: %w", cmd, disconnectedErr)
+		case <-ctx.Done():
+			return nil, fmt.Errorf("command 0x%02X: %w", cmd, ctx.Err())
+		}
+	}
+}
+
+// FirmwareVersion asks the sketch what it is, e.g. "huskki-monitor 2".
+func (a *Arduino) FirmwareVersion(ctx context.Context) (string, error) {
+	version, err := a.command(ctx, CMD_VERSION, nil)
+	return string(version), err
+}
+
+// SetDIDs replaces the DIDs the sketch polls.
+func (a *Arduino) SetDIDs(ctx context.Context, dids []PolledDID) error {
+	if _, err := a.command(ctx, CMD_CLEAR_DIDS, nil); err != nil {
+		return err
+	}
+	for _, did := range dids {
+		intervalMs := min(did.Interval.Milliseconds(), maxIntervalMs)
+		payload := []byte{byte(did.DID >> 8), byte(did.DID), byte(intervalMs >> 8), byte(intervalMs)}
+		if _, err := a.command(ctx, CMD_ADD_DID, payload); err != nil {
+			return fmt.Errorf("add DID 0x%04X: %w", did.DID, err)
+		}
+	}
+	return nil
+}
+
+// SetSecurityLevels has the sketch unlock each level in turn.
+func (a *Arduino) SetSecurityLevels(ctx context.Context, levels []ecus.SecurityLevel) error {
+	payload := make([]byte, len(levels))
+	for i, level := range levels {
+		payload[i] = byte(level)
+	}
+	_, err := a.command(ctx, CMD_SECURITY, payload)
+	return err
+}
+
+// ReadDTCs has the sketch read the ECU's DTCs.
+func (a *Arduino) ReadDTCs(ctx context.Context) ([]uds.DTC, error) {
+	response, err := a.command(ctx, CMD_READ_DTCS, nil)
+	if err != nil {
+		return nil, err
+	}
+	return uds.ParseDTCs(response)
+}
+
+// DefaultSession has the sketch stop polling and put the ECU back in its default session.
+func (a *Arduino) DefaultSession(ctx context.Context) error {
+	_, err := a.command(ctx, CMD_DEFAULT_SESSION, nil)
+	return err
+}
+
+// pushProfile sets the sketch up to poll the first ECU's profile instead of the DIDs it was flashed with. Sketches
+// from before the command channel never answer, they keep polling their own list. Cancelling ctx abandons the push
+// between or during commands.
+func (a *Arduino) pushProfile(ctx context.Context) {
+	var (
+		version string
+		err     error
+	)
+	for range versionAttempts {
+		if ctx.Err() != nil {
+			return
+		}
+		if version, err = a.FirmwareVersion(ctx); !errors.Is(err, commandTimeoutErr) {
+			break
+		}
+	}
+	if errors.Is(err, disconnectedErr) || ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		log.Printf("arduino doesn't take commands, it polls the DIDs it was flashed with: %v", err)
+		return
+	}
+	log.Printf("arduino firmware %s", version)
+	a.takesCommands.Store(true)
+
+	profile := a.profiles[0]
+	if len(a.profiles) > 1 {
+		log.Printf("arduino only polls %s, the first ECU", profile.Name)
+	}
+	if !profile.UDS() {
+		log.Printf("arduino only reads UDS DIDs, not pushing profile %s", profile.Name)
+		return
+	}
+
+	var dids []PolledDID
+	for _, did := range profile.PolledDIDs() {
+		// The sketch's commands and frames only have room for 16 bit DIDs
+		if did > 0xFFFF {
+			log.Printf("arduino can't poll DID 0x%X, it's wider than 16 bits", did)
+			continue
+		}
+		dids = append(dids, PolledDID{DID: uint16(did), Interval: profile.PollInterval(did)})
+	}
+	if err = a.SetDIDs(ctx, dids); err != nil {
+		log.Printf("couldn't set arduino DIDs: %v", err)
+		return
+	}
+
+	if profile.Secured() {
+		// The sketch only knows the K701's seed/key
+		if profile.Security.Algorithm != "k701" {
+			log.Printf("arduino can't unlock %s security", profile.Security.Algorithm)
+		} else {
+			levels := profile.Security.UnlockLevels
+			if len(levels) == 0 {
+				levels = []ecus.SecurityLevel{profile.Security.Level}
+			}
+			if err = a.SetSecurityLevels(ctx, levels); err != nil {
+				log.Printf("arduino couldn't unlock the ECU: %v", err)
+			}
+		}
+	}
+	log.Printf("arduino polling %d DIDs from %s", len(dids), profile.Name)
+
+	dtcs, err := a.ReadDTCs(ctx)
+	if err != nil {
+		log.Printf("couldn't read DTCs: %v", err)
+		return
+	}
+	log.Printf("%d DTCs stored", len(dtcs))
+	for _, dtc := range dtcs {
+		log.Printf("DTC %s status 0x%02X", dtc, dtc.Status)
+	}
+}
@@ -2,171 +2,219 @@ package drivers
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"time"
 
 	"huskki/ecus"
+	"huskki/events"
+	"huskki/store"
 )
 
-var magicBytes = []byte{0xAA, 0x55}
+var (
+	magicBytes   = []byte{0xAA, 0x55}
+	magicBytesV2 = []byte{0xAA, 0x56}
+	magicBytesV3 = []byte{0xAA, 0x57}
+	magicBytesV4 = []byte{0xAA, 0x58}
+)
+
+// serialLink gets what the Arduino sends besides DID frames, logs are read without one.
+type serialLink interface {
+	// onReply is passed replies to commands.
+	onReply(reply commandReply)
+	// onSequence is passed the sequence number of every numbered frame, in the order they arrive.
+	onSequence(seq uint16)
+	// at maps a frame's millis to when it happened on the host's clock, it's called as each frame arrives.
+	at(millis uint32) time.Time
+}
 
-// processBinary consumes binary did log data with layout:
-// [AA 55][millis:u32 LE][DID:u16 BE][len:u8][data:len][crc8:u8]
-func processBinary(reader io.Reader, processor ecus.ECUProcessor, logWriter *bufio.Writer) {
+// frameReader reads the next frame off a stream, returning io.EOF once the stream ends. Other errors only lose the
+// frame they were reading.
+type frameReader func() (ecu uint8, did uint32, value []byte, timestamp uint32, err error)
+
+// processBinary consumes binary did log data from the Arduino, see readBinaryFrame for the layout.
+func processBinary(reader io.Reader, profiles ecus.Set, hub *events.Hub, link serialLink) error {
 	bufferReader := bufio.NewReader(reader)
-	frames := 0
+	return processFrames(func() (uint8, uint32, []byte, uint32, error) {
+		return readBinaryFrame(bufferReader, link)
+	}, profiles, hub, link)
+}
 
+// processFrames publishes frames until the reader fails, counting them in store.Link. Frames are stamped with link's
+// clock, or when they arrive without one. Frames that don't read are skipped, anything else, like the port going
+// away, stops it and is returned. EOF returns nil.
+func processFrames(readFrame frameReader, profiles ecus.Set, hub *events.Hub, link serialLink) error {
 	for {
-		did, value, timestamp, err := readBinaryFrame(bufferReader)
+		ecu, did, value, timestamp, err := readFrame()
 		if err != nil {
-			if err != io.EOF {
+			if isFrameErr(err) {
 				log.Printf("read frame: %v", err)
+				if store.Link != nil {
+					store.Link.Errors.Add(1)
+				}
 				continue
 			}
-			// TODO: this would be a cool place to broadcast the frame to a channel or thro an event hub to be consumed elsewhere
-			return
-		}
-
-		// TODO: extract the following to a logger that consumes frames from the aforementioned event hub or channel
-
-		// Save the entire frame including crc and magic bytes, this lets us replay with the same logic
-		// We could probably just save it on read but this way we have a bit more control over what data gets logged
-		if logWriter != nil {
-			// rebuild exact record
-			dl := len(value)
-			rec := make([]byte, 2+7+dl+1)
-			rec[0], rec[1] = 0xAA, 0x55
-
-			// header
-			m := timestamp
-			rec[2] = byte(m)
-			rec[3] = byte(m >> 8)
-			rec[4] = byte(m >> 16)
-			rec[5] = byte(m >> 24)
-			rec[6] = byte(did >> 8)
-			rec[7] = byte(did)
-			rec[8] = byte(dl)
-
-			// payload
-			copy(rec[9:9+dl], value)
-
-			// crc
-			crc := crc8UpdateBuf(0x00, rec[2:6])  // millis
-			crc = crc8Update(crc, rec[6])         // did hi
-			crc = crc8Update(crc, rec[7])         // did lo
-			crc = crc8Update(crc, rec[8])         // len
-			crc = crc8UpdateBuf(crc, rec[9:9+dl]) // payload
-			rec[9+dl] = crc
-
-			if _, err := logWriter.Write(rec); err != nil {
-				log.Printf("raw write: %v", err)
-			} else {
-				frames++
-				if (frames % WRITE_EVERY_N_FRAMES) == 0 {
-					_ = logWriter.Flush()
-				}
+			if err == io.EOF {
+				return nil
 			}
+			return err
 		}
 
-		// broadcast the frames via eventhub
-		didData := processor.ParseDIDBytes(did, value)
-		addDidDataToStream(didData)
+		if store.Link != nil {
+			store.Link.Frames.Add(1)
+		}
+		at := time.Now()
+		if link != nil {
+			at = link.at(timestamp)
+		}
+		publish(hub, profiles, ecu, did, value, timestamp, at)
 	}
 }
 
-// readBinaryFrame reads a single frame with layout:
-// [AA 55][millis:u32 LE][DID:u16 BE][len:u8][data:len][crc8]
-func readBinaryFrame(bufferReader *bufio.Reader) (did uint32, value []byte, timestamp uint32, err error) {
-	// resync on magic AA 55
+// isFrameErr reports whether err only lost the frame being read rather than the stream.
+func isFrameErr(err error) bool {
+	return errors.Is(err, badCrcErr) || errors.Is(err, badLenErr) || errors.Is(err, badCSVErr) || errors.Is(err, longLineErr)
+}
+
+// readBinaryFrame reads a single frame with any of the layouts:
+// v1 [AA 55][millis:u32 LE][DID:u16 BE][len:u8][data:len][crc8]
+// v2 [AA 56][millis:u32 LE][ecu:u8][DID:u16 BE][len:u8][data:len][crc8]
+// v3 [AA 57][seq:u16 LE][millis:u32 LE][ecu:u8][DID:u16 BE][len:u8][data:len][crc8]
+// v4 [AA 58][millis:u32 LE][ecu:u8][DID:u32 BE][len:u8][data:len][crc8]
+// v1 frames are from the first ECU, the rest carry the ECU's index in the session's ecus.Set. v3 frames are numbered by
+// the Arduino, the numbers and replies to commands in between frames go to link if it's set. v4 frames are only
+// written to logs, for DIDs that don't fit in 16 bits like 29-bit CAN IDs.
+func readBinaryFrame(bufferReader *bufio.Reader, link serialLink) (ecu uint8, did uint32, value []byte, timestamp uint32, err error) {
+	// resync on magic AA 55, AA 56, AA 57 or AA 58
+	var version byte
 	for {
 		firstByte, err := bufferReader.ReadByte()
 		if err != nil {
-			return 0, nil, 0, err
+			return 0, 0, nil, 0, err
 		}
 		if firstByte != magicBytes[0] {
 			continue
 		}
 		secondByte, err := bufferReader.ReadByte()
 		if err != nil {
-			return 0, nil, 0, err
+			return 0, 0, nil, 0, err
 		}
 		if secondByte == magicBytes[1] {
+			version = 1
+			break
+		}
+		if secondByte == magicBytesV2[1] {
+			version = 2
+			break
+		}
+		if secondByte == magicBytesV3[1] {
+			version = 3
 			break
 		}
+		if secondByte == magicBytesV4[1] {
+			version = 4
+			break
+		}
+		if secondByte == magicBytesReply[1] {
+			reply, err := readReplyFrame(bufferReader)
+			if err != nil {
+				return 0, 0, nil, 0, err
+			}
+			if link != nil {
+				link.onReply(reply)
+			}
+			continue
+		}
 		// otherwise keep scanning
 	}
 
-	// header: millis(4 LE) + did(2 BE) + len(1)
-	header := make([]byte, 7)
+	// header: [seq(2 LE)] + millis(4 LE) + [ecu(1)] + did(2 or 4 BE) + len(1)
+	header := make([]byte, 7, 10)
+	switch version {
+	case 2:
+		header = header[:8]
+	case 3, 4:
+		header = header[:10]
+	}
 	if _, err = io.ReadFull(bufferReader, header); err != nil {
-		return 0, nil, 0, err
+		return 0, 0, nil, 0, err
 	}
-	dataLength := int(header[6])
+	dataLength := int(header[len(header)-1])
 	if dataLength < 0 || dataLength > 64 {
-		return 0, nil, 0, fmt.Errorf("error data length %d: %w", dataLength, badLenErr)
+		return 0, 0, nil, 0, fmt.Errorf("error data length %d: %w", dataLength, badLenErr)
 	}
 
 	// payload + crc
 	tail := make([]byte, dataLength+1)
 	if _, err = io.ReadFull(bufferReader, tail); err != nil {
-		return 0, nil, 0, err
+		return 0, 0, nil, 0, err
 	}
 	data := tail[:dataLength]
 	crcRx := tail[dataLength]
 
-	// verify CRC over: millis(4) + did_hi + did_lo + len + data
-	crc := crc8UpdateBuf(0x00, header[:4]) // millis
-	crc = crc8Update(crc, header[4])       // did hi
-	crc = crc8Update(crc, header[5])       // did lo
-	crc = crc8Update(crc, header[6])       // len
-	crc = crc8UpdateBuf(crc, data)         // payload
+	// verify CRC over: [seq(2)] + millis(4) + [ecu] + did + len + data
+	crc := crc8UpdateBuf(0x00, header) // header
+	crc = crc8UpdateBuf(crc, data)     // payload
 	if crc != crcRx {
-		return 0, nil, 0, badCrcErr
+		return 0, 0, nil, 0, badCrcErr
 	}
 
 	// parse fields
+	if version == 3 {
+		if link != nil {
+			link.onSequence(uint16(header[0]) | uint16(header[1])<<8)
+		}
+		header = header[2:]
+	}
 	millis := uint32(header[0]) |
 		uint32(header[1])<<8 |
 		uint32(header[2])<<16 |
 		uint32(header[3])<<24
 
-	// TODO: add 24 bit did support
-	did = uint32(header[4])<<8 | uint32(header[5])
-	value = append([]byte(nil), data...)
+	didBytes := header[4:6]
+	if version >= 2 {
+		ecu = header[4]
+		didBytes = header[5 : len(header)-1]
+	}
+	for _, b := range didBytes {
+		did = did<<8 | uint32(b)
+	}
 	timestamp = millis
 
-	return did, data, timestamp, nil
+	return ecu, did, data, timestamp, nil
 }
 
-// TODO: rewrite all the logging to support 24 bit dids
-func (p *SocketCAN) writeFrameToBinary(did uint32, data []byte) error {
-	ms := p.millis()
-	hdr := []byte{
-		byte(ms), byte(ms >> 8), byte(ms >> 16), byte(ms >> 24),
-		byte(did >> 8), byte(did),
-		byte(len(data)),
+// writeBinaryFrame writes a frame readBinaryFrame can read back. Frames from the first ECU are written as v1 so logs
+// from a single ECU session read the same as they always have, and only DIDs wider than 16 bits need v4.
+func writeBinaryFrame(writer io.Writer, ecu uint8, did uint32, data []byte, millis uint32) error {
+	magic := magicBytes
+	hdr := []byte{byte(millis), byte(millis >> 8), byte(millis >> 16), byte(millis >> 24)}
+	switch {
+	case did > 0xFFFF:
+		magic = magicBytesV4
+		hdr = append(hdr, ecu, byte(did>>24), byte(did>>16))
+	case ecu != 0:
+		magic = magicBytesV2
+		hdr = append(hdr, ecu)
 	}
-	crc := byte(0x00)
-	crc = crc8UpdateBuf(crc, hdr[:4])
-	crc = crc8Update(crc, hdr[4])
-	crc = crc8Update(crc, hdr[5])
-	crc = crc8Update(crc, hdr[6])
+	hdr = append(hdr, byte(did>>8), byte(did), byte(len(data)))
+	_, err := writer.Write(record(magic, hdr, data))
+	return err
+}
+
+// record frames hdr and data the way every record on the serial link and in the RAWLOG is,
+// [magic][hdr][data][crc8] with the CRC over everything after the magic bytes.
+func record(magic, hdr, data []byte) []byte {
+	crc := crc8UpdateBuf(0x00, hdr)
 	crc = crc8UpdateBuf(crc, data)
 
-	if _, err := p.writer.Write(magicBytes); err != nil {
-		return err
-	}
-	if _, err := p.writer.Write(hdr); err != nil {
-		return err
-	}
-	if _, err := p.writer.Write(data); err != nil {
-		return err
-	}
-	if _, err := p.writer.Write([]byte{crc}); err != nil {
-		return err
-	}
-	return nil
+	rec := make([]byte, 0, len(magic)+len(hdr)+len(data)+1)
+	rec = append(rec, magic...)
+	rec = append(rec, hdr...)
+	rec = append(rec, data...)
+	return append(rec, crc)
 }
 
 // CRC-8-CCITT helpers (poly 0x07, init 0x00)
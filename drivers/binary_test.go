@@ -0,0 +1,49 @@
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	frames := []struct {
+		ecu    uint8
+		did    uint32
+		data   []byte
+		millis uint32
+		magic  []byte
+	}{
+		{0, 0x0100, []byte{0x1B, 0x58}, 508, magicBytes},
+		{1, 0xF40D, []byte{0x2A}, 512, magicBytesV2},
+		{0, 0xE5002, []byte{0x01}, 515, magicBytesV4},
+		{2, 0x18FEF100, []byte{0, 1, 2, 3, 4, 5, 6, 7}, 520, magicBytesV4},
+		{3, 0x0009, []byte{}, 0xFFFFFFFF, magicBytesV2},
+	}
+	var b bytes.Buffer
+	for _, frame := range frames {
+		start := b.Len()
+		if err := writeBinaryFrame(&b, frame.ecu, frame.did, frame.data, frame.millis); err != nil {
+			t.Fatal(err)
+		}
+		if magic := b.Bytes()[start : start+2]; !bytes.Equal(magic, frame.magic) {
+			t.Errorf("DID 0x%X from ECU %d written as % X, expected % X", frame.did, frame.ecu, magic, frame.magic)
+		}
+	}
+
+	reader := bufio.NewReader(&b)
+	for _, want := range frames {
+		ecu, did, data, millis, err := readBinaryFrame(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ecu != want.ecu || did != want.did || !bytes.Equal(data, want.data) || millis != want.millis {
+			t.Errorf("read back ECU %d DID 0x%X % X at %d, wrote ECU %d DID 0x%X % X at %d", ecu, did, data, millis, want.ecu, want.did, want.data, want.millis)
+		}
+	}
+	if _, _, _, _, err := readBinaryFrame(reader, nil); !errors.Is(err, io.EOF) {
+		t.Fatalf("got %v after the last frame, expected EOF", err)
+	}
+}
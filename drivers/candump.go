@@ -0,0 +1,253 @@
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	CANDUMP_EXT = ".log"
+	// canFrameSize is sizeof(struct can_frame), CAN FD frames aren't enabled on raw sockets.
+	canFrameSize = 16
+)
+
+// RawCAN is a raw socket that sees every frame on an interface, including the ones other sockets on this machine
+// send, with the kernel's receive timestamps. The driver's own socket doesn't timestamp frames, this is for recording
+// and watching the bus.
+type RawCAN struct {
+	Interface string
+	socket    *os.File
+	rawConn   syscall.RawConn
+	buf, oob  []byte
+	// closed tells a closed socket apart from a failing one, the raw conn doesn't return os.ErrClosed itself.
+	closed atomic.Bool
+}
+
+// RawFrame is a frame off a RawCAN. ID keeps the kernel's extended, remote and error flags.
+type RawFrame struct {
+	At   time.Time
+	ID   uint32
+	Data []byte
+}
+
+// DialRawCAN opens a raw socket on interfaceName, error frames included.
+func DialRawCAN(interfaceName string) (*RawCAN, error) {
+	ifi, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return nil, fmt.Errorf("lookup interface %s: %w", interfaceName, err)
+	}
+	fd, err := unix.Socket(unix.AF_CAN, unix.SOCK_RAW, unix.CAN_RAW)
+	if err != nil {
+		return nil, fmt.Errorf("open raw socket: %w", err)
+	}
+	// Error frames are worth having in a trace of something going wrong
+	if err = unix.SetsockoptInt(fd, unix.SOL_CAN_RAW, unix.CAN_RAW_ERR_FILTER, unix.CAN_ERR_MASK); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("enable error frames: %w", err)
+	}
+	if err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMP, 1); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("enable timestamps: %w", err)
+	}
+	if err = unix.Bind(fd, &unix.SockaddrCAN{Ifindex: ifi.Index}); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("bind raw socket: %w", err)
+	}
+	// Non-blocking so the runtime poller owns the fd and closing it stops Receive
+	if err = unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("set raw socket non-blocking: %w", err)
+	}
+	socket := os.NewFile(uintptr(fd), "raw-can")
+	rawConn, err := socket.SyscallConn()
+	if err != nil {
+		_ = socket.Close()
+		return nil, err
+	}
+	return &RawCAN{
+		Interface: interfaceName,
+		socket:    socket,
+		rawConn:   rawConn,
+		buf:       make([]byte, canFrameSize),
+		oob:       make([]byte, unix.CmsgSpace(binary.Size(unix.Timeval{}))),
+	}, nil
+}
+
+// Receive waits for the next frame. Once the socket is closed it returns an error wrapping os.ErrClosed.
+func (r *RawCAN) Receive() (*RawFrame, error) {
+	for {
+		var n, oobn int
+		var recvErr error
+		err := r.rawConn.Read(func(fd uintptr) bool {
+			n, oobn, _, _, recvErr = unix.Recvmsg(int(fd), r.buf, r.oob, 0)
+			return !errors.Is(recvErr, unix.EAGAIN)
+		})
+		if err == nil {
+			err = recvErr
+		}
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil && r.closed.Load() {
+			return nil, fmt.Errorf("receive: %w", os.ErrClosed)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n < canFrameSize {
+			continue
+		}
+		length := min(int(r.buf[4]), 8)
+		return &RawFrame{
+			At:   receiveTime(r.oob[:oobn]),
+			ID:   binary.NativeEndian.Uint32(r.buf[0:4]),
+			Data: bytes.Clone(r.buf[8 : 8+length]),
+		}, nil
+	}
+}
+
+func (r *RawCAN) Close() error {
+	r.closed.Store(true)
+	return r.socket.Close()
+}
+
+// receiveTime is the kernel's SO_TIMESTAMP for the frame, or now if the kernel didn't send one.
+func receiveTime(oob []byte) time.Time {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Now()
+	}
+	for _, m := range messages {
+		if m.Header.Level != unix.SOL_SOCKET || m.Header.Type != unix.SCM_TIMESTAMP {
+			continue
+		}
+		var tv unix.Timeval
+		if binary.Read(bytes.NewReader(m.Data), binary.NativeEndian, &tv) == nil {
+			return time.Unix(tv.Unix())
+		}
+	}
+	return time.Now()
+}
+
+// CandumpLine writes the frame as a candump -L line, e.g. "(1700000000.123456) can0 7E8#0462F18A00".
+func (f *RawFrame) CandumpLine(interfaceName string) string {
+	var line strings.Builder
+	fmt.Fprintf(&line, "(%d.%06d) %s ", f.At.Unix(), f.At.Nanosecond()/1000, interfaceName)
+	switch {
+	case f.ID&unix.CAN_ERR_FLAG != 0:
+		fmt.Fprintf(&line, "%08X#", f.ID&(unix.CAN_ERR_MASK|unix.CAN_ERR_FLAG))
+	case f.ID&unix.CAN_EFF_FLAG != 0:
+		fmt.Fprintf(&line, "%08X#", f.ID&unix.CAN_EFF_MASK)
+	default:
+		fmt.Fprintf(&line, "%03X#", f.ID&unix.CAN_SFF_MASK)
+	}
+	if f.ID&unix.CAN_RTR_FLAG != 0 {
+		line.WriteString("R")
+	} else {
+		fmt.Fprintf(&line, "%X", f.Data)
+	}
+	return line.String()
+}
+
+// Candump is the frame the way ParseCandumpLine would read it back, ok is false for remote and error frames.
+func (f *RawFrame) Candump() (frame CandumpFrame, ok bool) {
+	if f.ID&(unix.CAN_ERR_FLAG|unix.CAN_RTR_FLAG) != 0 {
+		return frame, false
+	}
+	return CandumpFrame{
+		At:      time.Duration(f.At.UnixMicro()) * time.Microsecond,
+		HasTime: true,
+		ID:      f.ID & unix.CAN_EFF_MASK,
+		Data:    f.Data,
+	}, true
+}
+
+// canCapture records every frame on the interface to a candump log (candump -L format) next to the RAWLOG. The
+// RAWLOG only has the DIDs that changed, this has the whole bus to debug the driver and the ECU with afterwards, e.g.
+// with canplayer or Wireshark.
+type canCapture struct {
+	raw *RawCAN
+
+	mu      sync.Mutex
+	logFile *os.File
+	writer  *bufio.Writer
+
+	done chan struct{}
+}
+
+func candumpPath(logPath string) string {
+	return strings.TrimSuffix(logPath, LOG_EXT) + CANDUMP_EXT
+}
+
+// openCANCapture opens a raw socket on interfaceName and the candump log next to the RAWLOG at logPath, run starts
+// capturing.
+func openCANCapture(interfaceName string, logPath string) (*canCapture, error) {
+	raw, err := DialRawCAN(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(candumpPath(logPath), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		_ = raw.Close()
+		return nil, fmt.Errorf("open candump log: %w", err)
+	}
+	return &canCapture{
+		raw:     raw,
+		logFile: file,
+		writer:  bufio.NewWriterSize(file, 1<<20),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// run writes frames to the log until the capture is closed.
+func (c *canCapture) run() {
+	defer close(c.done)
+	for {
+		frame, err := c.raw.Receive()
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Printf("can capture stopped: %v", err)
+			}
+			return
+		}
+		if err = c.write(frame); err != nil {
+			log.Printf("can capture write failed: %v", err)
+			return
+		}
+	}
+}
+
+func (c *canCapture) write(frame *RawFrame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.writer.WriteString(frame.CandumpLine(c.raw.Interface) + "\n")
+	return err
+}
+
+func (c *canCapture) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.writer.Flush()
+}
+
+// Close stops capturing and flushes the log.
+func (c *canCapture) Close() error {
+	err := c.raw.Close()
+	<-c.done
+	c.flush()
+	_ = c.logFile.Close()
+	return err
+}
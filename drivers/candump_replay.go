@@ -0,0 +1,215 @@
+package drivers
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"huskki/ecus"
+	"huskki/uds"
+)
+
+const (
+	// canMaxID is the largest extended CAN ID, candump writes error frames above it.
+	canMaxID = 0x1FFFFFFF
+	// candumpDateLayout is candump -tA's timestamp.
+	candumpDateLayout = "2006-01-02 15:04:05.000000"
+)
+
+// CandumpFrame is one frame read from a candump capture.
+type CandumpFrame struct {
+	// At is the frame's timestamp, HasTime is false for captures taken without one.
+	At      time.Duration
+	HasTime bool
+	ID      uint32
+	Data    []byte
+}
+
+// IsCandumpLog reports whether path is a candump capture rather than a RAWLOG, by its extension.
+func IsCandumpLog(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case CANDUMP_EXT, ".txt":
+		return true
+	}
+	return false
+}
+
+// ParseCandumpLine reads a frame from either of candump's formats:
+// log (-L)   (1700000000.123456) can0 7E8#0562F18A4B54
+// screen     (1700000000.123456)  can0  7E8   [6]  05 62 F1 8A 4B 54
+// The timestamp is optional on screen lines, and may be relative (-tz) or a date (-tA). ok is false for lines that
+// aren't data frames, e.g. remote and error frames.
+func ParseCandumpLine(line string) (frame CandumpFrame, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return frame, false, nil
+	}
+	if strings.HasPrefix(line, "(") {
+		end := strings.IndexByte(line, ')')
+		if end < 0 {
+			return frame, false, fmt.Errorf("unterminated timestamp")
+		}
+		if frame.At, err = parseCandumpTime(line[1:end]); err != nil {
+			return frame, false, err
+		}
+		frame.HasTime = true
+		line = line[end+1:]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return frame, false, fmt.Errorf("expected an interface and a frame")
+	}
+	var id, data string
+	if i := strings.IndexByte(fields[1], '#'); i >= 0 {
+		id, data = fields[1][:i], fields[1][i+1:]
+		if strings.HasPrefix(data, "R") {
+			return frame, false, nil
+		}
+		// CAN FD frames have a second # and a flags nibble before the data
+		if strings.HasPrefix(data, "#") && len(data) > 1 {
+			data = data[2:]
+		}
+	} else {
+		if len(fields) < 3 || !strings.HasPrefix(fields[2], "[") {
+			return frame, false, fmt.Errorf("expected ID#DATA or ID [LEN] DATA")
+		}
+		length, err := strconv.Atoi(strings.Trim(fields[2], "[]"))
+		if err != nil {
+			return frame, false, fmt.Errorf("length %s: %w", fields[2], err)
+		}
+		if len(fields) > 3 && fields[3] == "remote" {
+			return frame, false, nil
+		}
+		if len(fields) < 3+length {
+			return frame, false, fmt.Errorf("expected %d bytes", length)
+		}
+		// candump -a prints the data as ASCII after the bytes, which are all that's needed
+		id, data = fields[1], strings.Join(fields[3:3+length], "")
+	}
+
+	parsed, err := strconv.ParseUint(id, 16, 32)
+	if err != nil {
+		return frame, false, fmt.Errorf("ID %s: %w", id, err)
+	}
+	if parsed > canMaxID {
+		return frame, false, nil
+	}
+	frame.ID = uint32(parsed)
+	if frame.Data, err = hex.DecodeString(data); err != nil {
+		return frame, false, fmt.Errorf("data %s: %w", data, err)
+	}
+	return frame, true, nil
+}
+
+// parseCandumpTime reads "seconds.micros" timestamps, absolute or relative, and -tA dates.
+func parseCandumpTime(timestamp string) (time.Duration, error) {
+	timestamp = strings.TrimSpace(timestamp)
+	if strings.Contains(timestamp, "-") {
+		at, err := time.Parse(candumpDateLayout, timestamp)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(at.UnixMicro()) * time.Microsecond, nil
+	}
+	seconds, fraction, _ := strings.Cut(timestamp, ".")
+	s, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("timestamp %s: %w", timestamp, err)
+	}
+	// Pad or cut the fraction to microseconds, candump always writes 6 digits but other tools don't
+	fraction = (fraction + "000000")[:6]
+	us, err := strconv.ParseInt(fraction, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("timestamp %s: %w", timestamp, err)
+	}
+	return time.Duration(s)*time.Second + time.Duration(us)*time.Microsecond, nil
+}
+
+// playCandump replays a candump capture: responses on each ECU's response ID are reassembled and decoded like the
+// socket-can driver decodes them, and broadcast profiles decode the frames they know. Captures are often taken with
+// other tools, so the DIDs are read from the responses rather than matched to their requests.
+func (r *Replayer) playCandump(ctx context.Context, reader io.Reader) error {
+	// Response IDs to the ECU's index in the set
+	responders := map[uint32]uint8{}
+	for i, profile := range r.profiles {
+		if profile.Service != ecus.SERVICE_BROADCAST {
+			responders[uint32(profile.CAN.Response)] = uint8(i)
+		}
+	}
+	reassemblers := map[uint32]*uds.Reassembler{}
+
+	scanner := bufio.NewScanner(reader)
+	clock := &replayClock{speed: r.Speed}
+	var (
+		lineIndex int
+		frames    int
+		// first is the first frame's timestamp, frames are published with the millis since
+		first   time.Duration
+		started bool
+	)
+	for scanner.Scan() {
+		lineIndex++
+		frame, ok, err := ParseCandumpLine(scanner.Text())
+		if err != nil {
+			log.Printf("line %d: %v", lineIndex, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if frames < r.SkipFrames {
+			frames++
+			continue
+		}
+		frames++
+
+		at := time.Now()
+		var millis uint32
+		if frame.HasTime {
+			if !started {
+				first, started = frame.At, true
+			}
+			millis = uint32((frame.At - first).Milliseconds())
+			if at, err = clock.wait(ctx, frame.At); err != nil {
+				return err
+			}
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		for i, profile := range r.profiles {
+			if profile.Broadcasts(frame.ID) {
+				publish(r.hub, r.profiles, uint8(i), frame.ID, frame.Data, millis, at)
+			}
+		}
+		ecu, ok := responders[frame.ID]
+		if !ok {
+			continue
+		}
+		reassembler, ok := reassemblers[frame.ID]
+		if !ok {
+			reassembler = &uds.Reassembler{}
+			reassemblers[frame.ID] = reassembler
+		}
+		response, ok := reassembler.Add(frame.Data)
+		if !ok {
+			continue
+		}
+		if did, data, ok := r.profiles[ecu].ResponseDID(response); ok {
+			publish(r.hub, r.profiles, ecu, did, data, millis, at)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	log.Println("end of replay")
+	return nil
+}
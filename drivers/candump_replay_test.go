@@ -0,0 +1,70 @@
+package drivers
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCandumpLine(t *testing.T) {
+	const at = 1_700_000_000*time.Second + 123_456*time.Microsecond
+	response := []byte{0x05, 0x62, 0xF1, 0x8A, 0x4B, 0x54}
+	tests := []struct {
+		name    string
+		line    string
+		ok      bool
+		err     string
+		at      time.Duration
+		hasTime bool
+		id      uint32
+		data    []byte
+	}{
+		{"log", "(1700000000.123456) can0 7E8#0562F18A4B54", true, "", at, true, 0x7E8, response},
+		{"screen", "(1700000000.123456)  can0  7E8   [6]  05 62 F1 8A 4B 54", true, "", at, true, 0x7E8, response},
+		{"screen without a timestamp", "  can0  7E8   [6]  05 62 F1 8A 4B 54", true, "", 0, false, 0x7E8, response},
+		{"screen with ASCII", "  can0  7E8   [3]  41 42 43   'ABC'", true, "", 0, false, 0x7E8, []byte("ABC")},
+		{"relative timestamp", "(000.500000) can0 7E0#0322F190", true, "", 500 * time.Millisecond, true, 0x7E0, []byte{0x03, 0x22, 0xF1, 0x90}},
+		{"short fraction", "(12.5) can0 7E0#00", true, "", 12*time.Second + 500*time.Millisecond, true, 0x7E0, []byte{0x00}},
+		{"date timestamp", "(2023-11-14 22:13:20.123456)  can0  7E8   [2]  01 02", true, "", at, true, 0x7E8, []byte{0x01, 0x02}},
+		{"extended ID", "can0 18DAF110#021001", true, "", 0, false, 0x18DAF110, []byte{0x02, 0x10, 0x01}},
+		{"FD", "(1.000000) can0 7E8##10562F1", true, "", time.Second, true, 0x7E8, []byte{0x05, 0x62, 0xF1}},
+		{"empty data", "can0 123#", true, "", 0, false, 0x123, []byte{}},
+
+		{"blank", "   ", false, "", 0, false, 0, nil},
+		{"log remote frame", "(1.000000) can0 7E0#R", false, "", 0, false, 0, nil},
+		{"screen remote frame", "  can0  7E0   [0]  remote request", false, "", 0, false, 0, nil},
+		{"error frame", "(1.000000) can0 20000080#0000000000000000", false, "", 0, false, 0, nil},
+
+		{"unterminated timestamp", "(1.000000 can0 7E0#00", false, "unterminated", 0, false, 0, nil},
+		{"bad timestamp", "(soon) can0 7E0#00", false, "timestamp", 0, false, 0, nil},
+		{"no frame", "can0", false, "interface and a frame", 0, false, 0, nil},
+		{"no length", "can0 7E0 00 01", false, "ID#DATA", 0, false, 0, nil},
+		{"short screen line", "can0 7E0 [3] 01 02", false, "expected 3 bytes", 0, false, 0, nil},
+		{"bad ID", "can0 XYZ#00", false, "ID XYZ", 0, false, 0, nil},
+		{"odd data", "can0 7E0#012", false, "data 012", 0, false, 0, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame, ok, err := ParseCandumpLine(test.line)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, expected an error containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != test.ok {
+				t.Fatalf("got ok %v, expected %v", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			if frame.At != test.at || frame.HasTime != test.hasTime || frame.ID != test.id || !bytes.Equal(frame.Data, test.data) {
+				t.Fatalf("got %v %v 0x%X % X, expected %v %v 0x%X % X", frame.At, frame.HasTime, frame.ID, frame.Data, test.at, test.hasTime, test.id, test.data)
+			}
+		})
+	}
+}
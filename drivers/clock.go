@@ -0,0 +1,194 @@
+package drivers
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// clockWindow is how much device time each of deviceClock's samples covers.
+	clockWindow = 2000
+	// clockWindows is how many samples the drift is fitted over, a minute's worth.
+	clockWindows = 30
+	// clockRecordEvery is how often, in device millis, the mapping is recorded in the log's metadata.
+	clockRecordEvery = 30_000
+)
+
+// ClockSync is a point on the mapping from the Arduino's millis to the host's clock, recorded in the log's metadata so
+// the RAWLOG's timestamps can be put back on the wall clock.
+type ClockSync struct {
+	// Epoch counts the times the Arduino's millis started again during the log, when it reset or the port was opened
+	// again, so points from before a reset are never applied to the frames after it.
+	Epoch int `json:"epoch"`
+	// DeviceMillis is unwrapped, it keeps counting past the u32's rollover.
+	DeviceMillis int64     `json:"deviceMillis"`
+	Host         time.Time `json:"host"`
+	// DriftPPM is how much faster the Arduino's clock runs than the host's, in parts per million. It's 0 on the point
+	// each epoch starts with, before there's been time to fit it.
+	DriftPPM float64 `json:"driftPpm"`
+}
+
+type clockSample struct {
+	device int64
+	// offset is host unix ms - device ms
+	offset float64
+}
+
+// deviceClock maps the Arduino's millis onto the host's clock. Frames only ever arrive after they were sent, serial
+// buffering only delays them, so the smallest arrival - millis offset in each window is the one with the least jitter
+// in it. A line through the last minute of those gives the offset and the drift between the two crystals.
+type deviceClock struct {
+	epoch      int
+	started    bool
+	lastMillis uint32
+	wraps      int64
+
+	// window is the smallest offset in the window ending at windowEnd, samples are the previous windows'.
+	window    clockSample
+	windowEnd int64
+	samples   []clockSample
+
+	fitted bool
+	// offset is the fitted offset at device ms 0, drift the host ms per device ms over 1.
+	offset, drift float64
+
+	// lastHost keeps mapped times from going backwards when the fit moves.
+	lastHost   time.Time
+	lastRecord int64
+	// recordedStart is set once the epoch's first frame has been recorded.
+	recordedStart bool
+}
+
+// at maps a frame's millis to the host's clock given when it arrived. restarted is true when millis went backwards
+// without rolling over, the Arduino reset and the mapping starts again.
+func (c *deviceClock) at(millis uint32, arrived time.Time) (mapped time.Time, restarted bool) {
+	if c.started && millis < c.lastMillis {
+		if c.lastMillis-millis > 1<<31 {
+			c.wraps++
+		} else {
+			c.restart()
+			restarted = true
+		}
+	}
+	c.lastMillis = millis
+	device := c.wraps<<32 | int64(millis)
+	observed := float64(arrived.UnixMicro())/1000 - float64(device)
+
+	switch {
+	case !c.started:
+		c.started = true
+		c.window = clockSample{device, observed}
+		c.windowEnd = device + clockWindow
+		c.lastRecord = device
+	case device >= c.windowEnd:
+		c.samples = append(c.samples, c.window)
+		if len(c.samples) > clockWindows {
+			c.samples = c.samples[1:]
+		}
+		c.fit()
+		c.window = clockSample{device, observed}
+		c.windowEnd = device + clockWindow
+	case observed < c.window.offset:
+		c.window = clockSample{device, observed}
+	}
+
+	offset := c.window.offset
+	if c.fitted {
+		offset = c.offset + c.drift*float64(device)
+	}
+	// Nothing arrives before it was sent, an early frame means the fit is behind
+	offset = min(offset, observed)
+	mapped = time.UnixMicro(int64((float64(device) + offset) * 1000))
+	if mapped.Before(c.lastHost) {
+		mapped = c.lastHost
+	}
+	c.lastHost = mapped
+	return mapped, restarted
+}
+
+// restart forgets the mapping and starts the next epoch.
+func (c *deviceClock) restart() {
+	*c = deviceClock{epoch: c.epoch + 1}
+}
+
+// fit puts a least squares line through the samples.
+func (c *deviceClock) fit() {
+	if len(c.samples) < 2 {
+		return
+	}
+	var meanDevice, meanOffset float64
+	for _, s := range c.samples {
+		meanDevice += float64(s.device)
+		meanOffset += s.offset
+	}
+	meanDevice /= float64(len(c.samples))
+	meanOffset /= float64(len(c.samples))
+	var covariance, variance float64
+	for _, s := range c.samples {
+		dx := float64(s.device) - meanDevice
+		covariance += dx * (s.offset - meanOffset)
+		variance += dx * dx
+	}
+	if variance == 0 {
+		return
+	}
+	c.drift = covariance / variance
+	c.offset = meanOffset - c.drift*meanDevice
+	c.fitted = true
+}
+
+// record returns a sync point for the first frame of each epoch, so where the epochs start is always recorded, and
+// then every clockRecordEvery of device time once the drift is known.
+func (c *deviceClock) record() (ClockSync, bool) {
+	device := c.wraps<<32 | int64(c.lastMillis)
+	if c.started && !c.recordedStart {
+		c.recordedStart = true
+		return ClockSync{Epoch: c.epoch, DeviceMillis: device, Host: c.lastHost}, true
+	}
+	if !c.fitted || device-c.lastRecord < clockRecordEvery {
+		return ClockSync{}, false
+	}
+	c.lastRecord = device
+	// The host's clock runs 1+drift ms per device ms, so the device runs fast when drift is negative
+	return ClockSync{Epoch: c.epoch, DeviceMillis: device, Host: c.lastHost, DriftPPM: -c.drift * 1e6}, true
+}
+
+// replayClock paces a replay and stamps its points with when they're due at the replay's speed, rather than whenever
+// the sleep woke up, so the wait doesn't add up over a long log.
+type replayClock struct {
+	speed   float64
+	started bool
+	start   time.Time
+	// first is the log time start is at, last the previous frame's.
+	first, last time.Duration
+}
+
+// wait sleeps until the frame logged at t is due and returns when that was, or ctx's error if it's cancelled first.
+// Logs that go back in time, e.g. the Arduino reset mid ride, carry on from the previous frame. Replays as fast as
+// possible are stamped with the time.
+func (c *replayClock) wait(ctx context.Context, t time.Duration) (time.Time, error) {
+	if c.speed <= 0 {
+		return time.Now(), ctx.Err()
+	}
+	if !c.started || t < c.last {
+		start := time.Now()
+		if c.started {
+			start = c.due(c.last)
+		}
+		c.start, c.first, c.started = start, t, true
+	}
+	c.last = t
+	due := c.due(t)
+	timer := time.NewTimer(time.Until(due))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return due, ctx.Err()
+	case <-timer.C:
+		return due, nil
+	}
+}
+
+func (c *replayClock) due(t time.Duration) time.Time {
+	return c.start.Add(time.Duration(float64(t-c.first) / c.speed))
+}
@@ -0,0 +1,173 @@
+package drivers
+
+import (
+	"bytes"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// clockArrivals feeds c frames sent every 10 device ms for duration, from startMillis on a device whose crystal runs
+// ppm fast. Each frame takes latency plus up to 20ms of jitter to arrive. check gets every frame's mapped time and when
+// it was really sent.
+func clockArrivals(c *deviceClock, rng *rand.Rand, start time.Time, startMillis uint32, ppm float64, duration time.Duration, check func(millis uint32, mapped, sent time.Time, restarted bool)) {
+	const latency = 3 * time.Millisecond
+	for elapsed := int64(0); elapsed < duration.Milliseconds(); elapsed += 10 {
+		// The device counts 1+ppm ms for every host ms
+		sent := start.Add(time.Duration(float64(elapsed) / (1 + ppm/1e6) * float64(time.Millisecond)))
+		arrived := sent.Add(latency + time.Duration(rng.Int64N(int64(20*time.Millisecond))))
+		millis := startMillis + uint32(elapsed)
+		mapped, restarted := c.at(millis, arrived)
+		check(millis, mapped, sent.Add(latency), restarted)
+	}
+}
+
+func TestDeviceClockDrift(t *testing.T) {
+	for _, ppm := range []float64{-150, 0, 80, 400} {
+		var c deviceClock
+		rng := rand.New(rand.NewPCG(1, uint64(ppm+1000)))
+		var syncs []ClockSync
+		var worst time.Duration
+		clockArrivals(&c, rng, time.Unix(1_700_000_000, 0), 1000, ppm, 3*time.Minute, func(millis uint32, mapped, sent time.Time, restarted bool) {
+			if restarted {
+				t.Fatalf("%v ppm: restarted at %d", ppm, millis)
+			}
+			if sync, ok := c.record(); ok {
+				syncs = append(syncs, sync)
+			}
+			// Give the fit its first minute
+			if millis > 61_000 {
+				worst = max(worst, mapped.Sub(sent).Abs())
+			}
+		})
+
+		if len(syncs) < 4 {
+			t.Fatalf("%v ppm: %d sync points in 3 minutes", ppm, len(syncs))
+		}
+		last := syncs[len(syncs)-1]
+		if math.Abs(last.DriftPPM-ppm) > 10 {
+			t.Errorf("%v ppm: fitted %.1f ppm", ppm, last.DriftPPM)
+		}
+		if worst > 2*time.Millisecond {
+			t.Errorf("%v ppm: mapped up to %v from when frames were sent", ppm, worst)
+		}
+	}
+}
+
+func TestDeviceClockWrap(t *testing.T) {
+	var c deviceClock
+	rng := rand.New(rand.NewPCG(2, 2))
+	var previous time.Time
+	var wrapped bool
+	clockArrivals(&c, rng, time.Unix(1_700_000_000, 0), math.MaxUint32-90_000, 50, 3*time.Minute, func(millis uint32, mapped, sent time.Time, restarted bool) {
+		if restarted {
+			t.Fatalf("restarted at %d", millis)
+		}
+		if mapped.Before(previous) {
+			t.Fatalf("mapped time went backwards at %d", millis)
+		}
+		previous = mapped
+		if millis < 1000 {
+			wrapped = true
+		}
+		if wrapped {
+			if d := mapped.Sub(sent).Abs(); d > 2*time.Millisecond {
+				t.Fatalf("mapped %v from when it was sent after the wrap at %d", d, millis)
+			}
+		}
+	})
+	if !wrapped {
+		t.Fatal("millis never wrapped")
+	}
+	if device := c.wraps<<32 | int64(c.lastMillis); device <= math.MaxUint32 {
+		t.Fatalf("device millis %d weren't unwrapped", device)
+	}
+}
+
+func TestDeviceClockReset(t *testing.T) {
+	var c deviceClock
+	rng := rand.New(rand.NewPCG(3, 3))
+	start := time.Unix(1_700_000_000, 0)
+	var syncs []ClockSync
+	record := func() {
+		if sync, ok := c.record(); ok {
+			syncs = append(syncs, sync)
+		}
+	}
+	clockArrivals(&c, rng, start, 500_000, 100, 2*time.Minute, func(uint32, time.Time, time.Time, bool) { record() })
+	if !c.fitted {
+		t.Fatal("no fit after 2 minutes")
+	}
+
+	// The board resets and counts from boot again
+	restart := start.Add(2*time.Minute + 5*time.Second)
+	restarts := 0
+	clockArrivals(&c, rng, restart, 200, 100, time.Minute, func(millis uint32, mapped, sent time.Time, restarted bool) {
+		if restarted {
+			restarts++
+		}
+		if d := mapped.Sub(sent); d < -time.Millisecond || d > 20*time.Millisecond {
+			t.Fatalf("mapped %v from when it was sent after the reset at %d", d, millis)
+		}
+		record()
+	})
+	if restarts != 1 {
+		t.Fatalf("restarted %d times, expected once", restarts)
+	}
+
+	// Each epoch starts with a point at its first frame, then one every clockRecordEvery once fitted
+	var starts []ClockSync
+	for i, sync := range syncs {
+		if i == 0 || sync.Epoch != syncs[i-1].Epoch {
+			starts = append(starts, sync)
+		}
+	}
+	if len(starts) != 2 || starts[0].Epoch != 0 || starts[0].DeviceMillis != 500_000 || starts[1].Epoch != 1 || starts[1].DeviceMillis != 200 {
+		t.Fatalf("epochs start with %+v, expected epoch 0 at 500000 and epoch 1 at 200", starts)
+	}
+	if len(syncs) < 5 {
+		t.Fatalf("recorded %d sync points over 3 minutes", len(syncs))
+	}
+}
+
+func TestRecordLogClock(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "RAWLOG_1.bin")
+	if err := writeMetadata(logPath, &LogMetadata{ECUs: []*ECUMetadata{{ECU: "k701"}}}); err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(metadataPath(logPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syncs := []ClockSync{
+		{DeviceMillis: 30_000, Host: time.UnixMilli(1_700_000_030_000).UTC(), DriftPPM: 12.5},
+		{DeviceMillis: 60_000, Host: time.UnixMilli(1_700_000_060_000).UTC(), DriftPPM: 12.25},
+		{Epoch: 1, DeviceMillis: 150, Host: time.UnixMilli(1_700_000_075_000).UTC()},
+	}
+	for _, sync := range syncs {
+		if err = recordLogClock(logPath, sync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after, err := os.ReadFile(metadataPath(logPath)); err != nil || !bytes.Equal(after, written) {
+		t.Fatalf("metadata rewritten recording the clock: %v", err)
+	}
+
+	metadata, err := ReadLogMetadata(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata.Clock) != len(syncs) {
+		t.Fatalf("read back %d sync points, recorded %d", len(metadata.Clock), len(syncs))
+	}
+	for i, sync := range syncs {
+		got := metadata.Clock[i]
+		if got.Epoch != sync.Epoch || got.DeviceMillis != sync.DeviceMillis || !got.Host.Equal(sync.Host) || got.DriftPPM != sync.DriftPPM {
+			t.Errorf("sync point %d read back as %+v, recorded %+v", i, got, sync)
+		}
+	}
+}
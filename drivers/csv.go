@@ -0,0 +1,175 @@
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"huskki/config"
+	"huskki/ecus"
+	"huskki/events"
+	"huskki/utils"
+)
+
+const (
+	// CSV_EXT is the SD card logger's DIDLOG extension, DIDLOG08.CSV and friends.
+	CSV_EXT = ".csv"
+	// CSV_HEADER heads the CSVs FrameLog writes. The old DIDLOGs have the decoded value after the data, so the fourth
+	// column is only read as the ECU under this header.
+	CSV_HEADER = "millis,did,data,ecu"
+)
+
+// detectLimit is how much of the stream detectSerialProtocol looks at before giving up, it's the bufio.Reader default.
+const detectLimit = 4096
+
+var (
+	badCSVErr   = errors.New("error csv row")
+	longLineErr = errors.New("error line too long")
+)
+
+// processCSV consumes the monitor sketch's text output, see parseCSVFrame for the layout. Rows are published like
+// binary frames so the RAWLOG stays binary and replays like any other log. A row that doesn't parse only loses that
+// row, the next newline resyncs the stream.
+func processCSV(reader io.Reader, profiles ecus.Set, hub *events.Hub, link serialLink) error {
+	rows := &csvReader{reader: bufio.NewReader(reader), link: link}
+	return processFrames(rows.read, profiles, hub, link)
+}
+
+// csvReader reads CSV rows, remembering whether the header said they have an ECU column.
+type csvReader struct {
+	reader *bufio.Reader
+	// link gets the reply lines, they're skipped if it's nil.
+	link      serialLink
+	ecuColumn bool
+}
+
+// read reads the next row, skipping blank lines, comments and the header. Rows are from the first ECU unless the header
+// is CSV_HEADER. Reply lines, starting with "!", go to link if it's set and are skipped otherwise. Rows aren't
+// numbered.
+func (r *csvReader) read() (ecu uint8, did uint32, value []byte, timestamp uint32, err error) {
+	for {
+		line, err := readLine(r.reader)
+		if err != nil {
+			return 0, 0, nil, 0, err
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(strings.ToLower(line), "millis,") {
+			r.ecuColumn = strings.EqualFold(line, CSV_HEADER)
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "!") {
+			if r.link == nil {
+				continue
+			}
+			reply, err := parseReplyLine(line)
+			if err != nil {
+				return 0, 0, nil, 0, err
+			}
+			r.link.onReply(reply)
+			continue
+		}
+		return parseCSVFrame(line, r.ecuColumn)
+	}
+}
+
+// readLine reads up to the next newline. Lines that don't fit the reader's buffer are dropped whole, a serial port
+// that spews garbage without newlines would otherwise grow the line forever.
+func readLine(bufferReader *bufio.Reader) (string, error) {
+	line, err := bufferReader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		for errors.Is(err, bufio.ErrBufferFull) {
+			_, err = bufferReader.ReadSlice('\n')
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", longLineErr
+	}
+	// An unterminated last line is still a row, EOF comes on the next read
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	return string(line), err
+}
+
+// parseCSVFrame parses a row, millis,DID,data_hex e.g. "508,0x0100,12 C0", with the ECU's index after the data if
+// ecuColumn is set, e.g. "508,0x0100,12 C0,1". The DID is hex with or without 0x, the data is hex with or without
+// spaces between the bytes. Anything else after the data, like the decoded value the old DIDLOG files have, is
+// ignored.
+func parseCSVFrame(line string, ecuColumn bool) (ecu uint8, did uint32, value []byte, timestamp uint32, err error) {
+	fields := strings.Split(line, ",")
+	if len(fields) < 3 {
+		return 0, 0, nil, 0, fmt.Errorf("%q: want millis,DID,data_hex: %w", line, badCSVErr)
+	}
+	millis, err := strconv.ParseUint(strings.TrimSpace(fields[0]), 10, 32)
+	if err != nil {
+		return 0, 0, nil, 0, fmt.Errorf("%q: bad millis: %w", line, badCSVErr)
+	}
+	parsedDID, err := utils.ParseHexUint32(fields[1])
+	if err != nil {
+		return 0, 0, nil, 0, fmt.Errorf("%q: bad DID: %w", line, badCSVErr)
+	}
+	value, err = hex.DecodeString(strings.Join(strings.Fields(fields[2]), ""))
+	if err != nil {
+		return 0, 0, nil, 0, fmt.Errorf("%q: bad data: %w", line, badCSVErr)
+	}
+	if len(value) > 64 {
+		return 0, 0, nil, 0, fmt.Errorf("%q: data length %d: %w", line, len(value), badCSVErr)
+	}
+	if ecuColumn && len(fields) > 3 {
+		parsedECU, err := strconv.ParseUint(strings.TrimSpace(fields[3]), 10, 8)
+		if err != nil {
+			return 0, 0, nil, 0, fmt.Errorf("%q: bad ECU: %w", line, badCSVErr)
+		}
+		ecu = uint8(parsedECU)
+	}
+	return ecu, uint32(parsedDID), value, uint32(millis), nil
+}
+
+// writeCSVFrame writes a frame as a row parseCSVFrame can read back, with its ECU's index after the data.
+func writeCSVFrame(writer io.Writer, frame events.Frame) error {
+	_, err := fmt.Fprintf(writer, "%d,0x%04X,% X,%d\n", frame.Millis, frame.DID, frame.Data, frame.ECU)
+	return err
+}
+
+// detectSerialProtocol peeks at the stream until it sees binary magic bytes or a whole row or reply that parses as CSV,
+// without consuming anything. Text never has 0xAA in it so the magic bytes settle it straight away. The first line is
+// skipped as the port may have been opened halfway through it. Streams that are neither by detectLimit bytes are read
+// as binary, which resyncs on its own.
+func detectSerialProtocol(bufferReader *bufio.Reader) (config.SerialProtocol, error) {
+	for bufferReader.Buffered() < detectLimit {
+		// Wait for at least one more byte, then look at everything so far
+		_, err := bufferReader.Peek(bufferReader.Buffered() + 1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		buffered, _ := bufferReader.Peek(bufferReader.Buffered())
+		if bytes.Contains(buffered, magicBytes) || bytes.Contains(buffered, magicBytesV2) || bytes.Contains(buffered, magicBytesV3) ||
+			bytes.Contains(buffered, magicBytesReply) {
+			return config.SerialBinary, nil
+		}
+		lines := bytes.Split(buffered, []byte("\n"))
+		// The last line is still being written
+		for i := 1; i < len(lines)-1; i++ {
+			line := strings.TrimSpace(string(lines[i]))
+			if _, _, _, _, err := parseCSVFrame(line, false); err == nil {
+				return config.SerialCSV, nil
+			}
+			if _, err := parseReplyLine(line); err == nil && strings.HasPrefix(line, "!") {
+				return config.SerialCSV, nil
+			}
+		}
+	}
+	return config.SerialBinary, nil
+}
@@ -0,0 +1,56 @@
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"huskki/events"
+)
+
+func TestCSVRoundTrip(t *testing.T) {
+	frames := []events.Frame{
+		{ECU: 0, DID: 0x0100, Data: []byte{0x12, 0xC0}, Millis: 508},
+		{ECU: 1, DID: 0xF40D, Data: []byte{0x2A}, Millis: 512},
+		{ECU: 0, DID: 0xE5002, Data: []byte{0x01}, Millis: 515},
+		{ECU: 2, DID: 0x0009, Data: []byte{}, Millis: 0xFFFFFFFF},
+	}
+	var b bytes.Buffer
+	b.WriteString(CSV_HEADER + "\n")
+	for _, frame := range frames {
+		if err := writeCSVFrame(&b, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows := &csvReader{reader: bufio.NewReader(&b)}
+	for _, want := range frames {
+		ecu, did, data, millis, err := rows.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ecu != want.ECU || did != want.DID || !bytes.Equal(data, want.Data) || millis != want.Millis {
+			t.Errorf("read back ECU %d DID 0x%04X % X at %d, wrote ECU %d DID 0x%04X % X at %d", ecu, did, data, millis, want.ECU, want.DID, want.Data, want.Millis)
+		}
+	}
+	if _, _, _, _, err := rows.read(); !errors.Is(err, io.EOF) {
+		t.Fatalf("got %v after the last row, expected EOF", err)
+	}
+}
+
+func TestCSVDecodedValueIsNotAnECU(t *testing.T) {
+	// The old DIDLOGs have the decoded value where the ECU goes
+	rows := &csvReader{reader: bufio.NewReader(strings.NewReader("millis,did,data\n508,0x0,00 77,119\n710,0x100,00 00,0,RPM,0\n"))}
+	for range 2 {
+		ecu, _, _, _, err := rows.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ecu != 0 {
+			t.Fatalf("read a DIDLOG row as ECU %d", ecu)
+		}
+	}
+}
@@ -1,11 +1,11 @@
 package drivers
 
 import (
+	"context"
 	"time"
 
 	"huskki/ecus"
-	"huskki/models"
-	"huskki/store"
+	"huskki/events"
 )
 
 const (
@@ -15,28 +15,24 @@ const (
 	WRITE_EVERY_N_FRAMES = 100
 )
 
+// Driver reads an ECU, or a log of one, and publishes its frames to the session's events.Hub. Init starts it up, Run
+// reads until its context is cancelled, which is how a driver is stopped, and Close puts the ECU back the way it was
+// found and closes the driver's logs once Run has returned.
 type Driver interface {
 	Init() error
-	Run() error
+	// Run returns nil when ctx is cancelled.
+	Run(ctx context.Context) error
+	Close() error
 }
 
-func addDidDataToStream(didData []*ecus.DIDData) {
-	for _, didDatum := range didData {
-		if didDatum.StreamKey != "" {
-			if stream, ok := store.DashboardStreams[didDatum.StreamKey]; ok {
-				addPointToStream(stream, didDatum)
-			}
-		}
-	}
-}
-
-func addPointToStream(stream *models.Stream, didDatum *ecus.DIDData) {
-	if stream.Discrete() {
-		// Add point with same timestamp and the last point's value if this is discrete data so we get that nice
-		// stepped look
-		// Set time back 1 ms so we don't have multiple points on the same timestamp
-		stream.Add(int(time.Now().UnixMilli())-1, stream.Latest().Value())
-	}
-
-	stream.Add(int(time.Now().UnixMilli()), didDatum.DidValue)
+// publish decodes a frame with its ECU's profile, if the session has one for it, and publishes it with the raw frame.
+func publish(hub *events.Hub, profiles ecus.Set, ecu uint8, did uint32, data []byte, millis uint32, at time.Time) {
+	hub.Publish(events.Frame{
+		ECU:    ecu,
+		DID:    did,
+		Data:   data,
+		Millis: millis,
+		At:     at,
+		Values: profiles.ParseECUDIDBytes(ecu, did, data),
+	})
 }
@@ -0,0 +1,98 @@
+package drivers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"huskki/events"
+)
+
+// frameLogBuffer is how many frames a log can fall behind by before the driver waits for it, a second or so of a busy
+// bus.
+const frameLogBuffer = 4096
+
+// FrameLog writes the frames published on a hub to a file, as RAWLOG frames or CSV rows, from its own goroutine so a
+// slow write doesn't hold the driver up. It flushes every WRITE_EVERY_N_FRAMES frames and every FlushInterval.
+type FrameLog struct {
+	sub    *events.Subscription
+	file   *os.File
+	writer *bufio.Writer
+	write  func(io.Writer, events.Frame) error
+	done   chan struct{}
+}
+
+// OpenRawLog appends the hub's frames to the RAWLOG at path.
+func OpenRawLog(hub *events.Hub, path string) (*FrameLog, error) {
+	return openFrameLog(hub, path, "rawlog", func(writer io.Writer, frame events.Frame) error {
+		return writeBinaryFrame(writer, frame.ECU, frame.DID, frame.Data, frame.Millis)
+	})
+}
+
+// OpenCSVLog writes the hub's frames to a CSV at path that replays like a DIDLOG, see writeCSVFrame.
+func OpenCSVLog(hub *events.Hub, path string) (*FrameLog, error) {
+	l, err := openFrameLog(hub, path, "csv log", writeCSVFrame)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = l.writer.WriteString(CSV_HEADER + "\n"); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func openFrameLog(hub *events.Hub, path, name string, write func(io.Writer, events.Frame) error) (*FrameLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", name, err)
+	}
+	l := &FrameLog{
+		sub:    hub.Subscribe(frameLogBuffer),
+		file:   file,
+		writer: bufio.NewWriterSize(file, 1<<20),
+		write:  write,
+		done:   make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *FrameLog) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+	frames := 0
+	for {
+		select {
+		case frame, ok := <-l.sub.Frames():
+			if !ok {
+				return
+			}
+			if err := l.write(l.writer, frame); err != nil {
+				log.Printf("write %s: %v", l.file.Name(), err)
+				continue
+			}
+			frames++
+			if frames%WRITE_EVERY_N_FRAMES == 0 {
+				_ = l.writer.Flush()
+			}
+		case <-ticker.C:
+			_ = l.writer.Flush()
+		}
+	}
+}
+
+// Close writes the frames published before it and closes the file.
+func (l *FrameLog) Close() error {
+	l.sub.Close()
+	<-l.done
+	if err := l.writer.Flush(); err != nil {
+		_ = l.file.Close()
+		return fmt.Errorf("flush %s: %w", l.file.Name(), err)
+	}
+	return l.file.Close()
+}
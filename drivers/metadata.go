@@ -0,0 +1,149 @@
+package drivers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"huskki/config"
+	"huskki/ecus"
+	"huskki/store"
+	"huskki/uds"
+)
+
+const (
+	METADATA_EXT = ".json"
+	// CLOCK_EXT is the log's clock sync points, one JSON ClockSync per line.
+	CLOCK_EXT             = ".clock"
+	IdentificationTimeout = 5 * time.Second
+)
+
+// LogMetadata is written next to every log, RAWLOG_3.bin gets RAWLOG_3.json, so a log can be traced back to the bike
+// and software it came from.
+type LogMetadata struct {
+	Driver  config.DriverType `json:"driver"`
+	Started time.Time         `json:"started"`
+	// ECUs are in the order frames are tagged with in the log.
+	ECUs []*ECUMetadata `json:"ecus"`
+	// Clock maps the Arduino's millis in the log to the host's clock, see deviceClock. Other drivers log host time. The
+	// sync points are appended to their own file as they're found, RAWLOG_3.clock, and ReadLogMetadata reads them back
+	// in here.
+	Clock []ClockSync `json:"clock,omitempty"`
+}
+
+type ECUMetadata struct {
+	ECU            string              `json:"ecu"`
+	Profile        string              `json:"profile"`
+	Identification ecus.Identification `json:"identification,omitempty"`
+}
+
+// metadataPath is where the metadata of the RAWLOG or candump log at logPath is, both share it.
+func metadataPath(logPath string) string {
+	return strings.TrimSuffix(logPath, filepath.Ext(logPath)) + METADATA_EXT
+}
+
+// writeLogMetadata stamps the log at logPath with what's known about the ECU.
+func writeLogMetadata(logPath string, driver config.DriverType) error {
+	metadata := &LogMetadata{
+		Driver:  driver,
+		Started: time.Now(),
+	}
+	for _, ecu := range store.ECUs {
+		metadata.ECUs = append(metadata.ECUs, &ECUMetadata{ecu.ECU, ecu.Profile, ecu.Identification})
+	}
+	return writeMetadata(logPath, metadata)
+}
+
+func writeMetadata(logPath string, metadata *LogMetadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metadataPath(logPath), data, 0o644)
+}
+
+func clockPath(logPath string) string {
+	return strings.TrimSuffix(logPath, filepath.Ext(logPath)) + CLOCK_EXT
+}
+
+// recordLogClock appends a clock sync point to the log at logPath's, without rewriting the rest of its metadata.
+func recordLogClock(logPath string, sync ClockSync) error {
+	data, err := json.Marshal(sync)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(clockPath(logPath), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readLogClock reads back the clock sync points recorded for the log at logPath, none if there aren't any. A line cut
+// short by the logger stopping mid write ends them.
+func readLogClock(logPath string) ([]ClockSync, error) {
+	file, err := os.Open(clockPath(logPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var syncs []ClockSync
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var sync ClockSync
+		if err = json.Unmarshal(scanner.Bytes(), &sync); err != nil {
+			break
+		}
+		syncs = append(syncs, sync)
+	}
+	return syncs, scanner.Err()
+}
+
+// ReadLogMetadata reads the metadata written next to the log at logPath, logs from before metadata existed don't have
+// any and return an error wrapping os.ErrNotExist.
+func ReadLogMetadata(logPath string) (*LogMetadata, error) {
+	data, err := os.ReadFile(metadataPath(logPath))
+	if err != nil {
+		return nil, err
+	}
+	metadata := &LogMetadata{}
+	if err = json.Unmarshal(data, metadata); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", metadataPath(logPath), err)
+	}
+	if len(metadata.ECUs) == 0 {
+		return nil, fmt.Errorf("%s doesn't list any ECUs", metadataPath(logPath))
+	}
+	clock, err := readLogClock(logPath)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", clockPath(logPath), err)
+	}
+	metadata.Clock = append(metadata.Clock, clock...)
+	return metadata, nil
+}
+
+// IdentifySocketCAN reads the ECU's identification DIDs over an ISO-TP socket, before the driver connects so the
+// profile can be picked from them.
+func IdentifySocketCAN(flags *config.SocketCANFlags, ids ecus.CANIDs) (ecus.Identification, error) {
+	socket, err := uds.DialIsotp(flags.SocketCanAddr, uint32(ids.Request), uint32(ids.Response))
+	if err != nil {
+		return nil, fmt.Errorf("open isotp: %w", err)
+	}
+	defer socket.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), IdentificationTimeout)
+	defer cancel()
+	return ecus.ReadIdentification(ctx, uds.NewClient(socket))
+}
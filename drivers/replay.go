@@ -2,35 +2,45 @@ package drivers
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"huskki/config"
 	"huskki/ecus"
+	"huskki/events"
 )
 
 type Replayer struct {
 	*config.ReplayFlags
-	ecuProcessor ecus.ECUProcessor
+	profiles ecus.Set
+	hub      *events.Hub
 }
 
-func NewReplayer(replayFlags *config.ReplayFlags, processor ecus.ECUProcessor) *Replayer {
+func NewReplayer(replayFlags *config.ReplayFlags, profiles ecus.Set, hub *events.Hub) *Replayer {
 	replayer := &Replayer{
 		replayFlags,
-		processor,
+		profiles,
+		hub,
 	}
 	return replayer
 }
 
-func (r *Replayer) Run() error {
+// Run plays the log, over and over with -replay-loop, until ctx is cancelled.
+func (r *Replayer) Run(ctx context.Context) error {
 	for {
-		if err := r.playOnce(); err != nil {
+		if err := r.playOnce(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			return err
 		}
-		if !r.Loop {
+		if !r.Loop || ctx.Err() != nil {
 			break
 		}
 	}
@@ -41,7 +51,12 @@ func (r *Replayer) Init() error {
 	return nil
 }
 
-func (r *Replayer) playOnce() error {
+// Close has nothing to do, the log is closed when each play through ends.
+func (r *Replayer) Close() error {
+	return nil
+}
+
+func (r *Replayer) playOnce(ctx context.Context) error {
 	file, err := os.Open(r.Path)
 	if err != nil {
 		return err
@@ -54,17 +69,46 @@ func (r *Replayer) playOnce() error {
 	}(file)
 
 	bufferReader := bufio.NewReaderSize(file, 1<<20)
+	if IsCandumpLog(r.Path) {
+		return r.playCandump(ctx, bufferReader)
+	}
+	csv, err := isCSVLog(r.Path, bufferReader)
+	if err != nil {
+		return err
+	}
+	if csv {
+		rows := &csvReader{reader: bufferReader}
+		return r.playFrames(ctx, rows.read)
+	}
+	return r.playFrames(ctx, func() (uint8, uint32, []byte, uint32, error) {
+		return readBinaryFrame(bufferReader, nil)
+	})
+}
 
-	var (
-		first  = true
-		prevMS int64
-	)
+// isCSVLog reports whether a log is the SD card logger's DIDLOG CSV rather than a RAWLOG, by its .csv extension or
+// else by sniffing its first rows the way the arduino driver does.
+func isCSVLog(path string, bufferReader *bufio.Reader) (bool, error) {
+	if strings.EqualFold(filepath.Ext(path), CSV_EXT) {
+		return true, nil
+	}
+	protocol, err := detectSerialProtocol(bufferReader)
+	return protocol == config.SerialCSV, err
+}
 
+// playFrames replays RAWLOG frames or CSV rows with the log's own timing.
+func (r *Replayer) playFrames(ctx context.Context, readFrame frameReader) error {
+	clock := &replayClock{speed: r.Speed}
 	frameIndex := 0
+	// Rows that don't parse are counted rather than logged, the early DIDLOGs have hundreds of them
+	skipped := 0
+	var lastSkip error
 	for {
-		did, value, timestamp, err := readBinaryFrame(bufferReader)
+		ecu, did, value, timestamp, err := readFrame()
 		if err != nil {
 			if err == io.EOF {
+				if skipped > 0 {
+					log.Printf("skipped %d rows that didn't parse, the last: %v", skipped, lastSkip)
+				}
 				log.Println("end of replay")
 				return nil
 			}
@@ -73,6 +117,11 @@ func (r *Replayer) playOnce() error {
 				// Not skipping atm cause crc was broken in early logs.
 				continue
 			}
+			if errors.Is(err, badCSVErr) || errors.Is(err, longLineErr) {
+				skipped++
+				lastSkip = err
+				continue
+			}
 			return err
 		}
 
@@ -81,21 +130,12 @@ func (r *Replayer) playOnce() error {
 			continue
 		}
 
-		if first {
-			first = false
-			prevMS = int64(timestamp)
-		}
-
-		if r.Speed > 0 {
-			delta := time.Duration(int64(timestamp) - prevMS)
-			if delta > 0 {
-				time.Sleep(time.Duration(float64(delta) * float64(time.Millisecond) / r.Speed))
-			}
-			prevMS = int64(timestamp)
+		at, err := clock.wait(ctx, time.Duration(timestamp)*time.Millisecond)
+		if err != nil {
+			return err
 		}
 
-		didData := r.ecuProcessor.ParseDIDBytes(did, value)
-		addDidDataToStream(didData)
+		publish(r.hub, r.profiles, ecu, did, value, timestamp, at)
 
 		frameIndex++
 	}
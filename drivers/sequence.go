@@ -0,0 +1,37 @@
+package drivers
+
+// sequenceWindow is how far back a sequence number can go and still be a repeated or late frame rather than the
+// Arduino numbering from 0 again, and how far past 0xFFFF it can wrap and still count the frames in between as dropped.
+const sequenceWindow = 64
+
+// sequenceTracker counts the frames missing between v3 frames' sequence numbers.
+type sequenceTracker struct {
+	last uint16
+	seen bool
+}
+
+// next takes the next sequence number to arrive and returns how many frames went missing before it. Numbers wrap from
+// 0xFFFF to 0. Repeated and late frames are ignored, and the Arduino numbering from 0 again when it resets looks like
+// a restart rather than 65k dropped frames, even when the first frames after the reset were lost.
+func (s *sequenceTracker) next(seq uint16) (dropped uint16, restarted bool) {
+	if !s.seen {
+		s.last, s.seen = seq, true
+		return 0, false
+	}
+	gap := seq - s.last
+	switch {
+	case gap == 0:
+		return 0, false
+	case seq == 0 && s.last != 0xFFFF:
+		restarted = true
+	case seq < s.last && s.last-seq <= sequenceWindow:
+		// Late, keep counting from the newest
+		return 0, false
+	case seq < s.last && gap > sequenceWindow:
+		restarted = true
+	default:
+		dropped = gap - 1
+	}
+	s.last = seq
+	return dropped, restarted
+}
@@ -0,0 +1,37 @@
+package drivers
+
+import "testing"
+
+func TestSequenceTracker(t *testing.T) {
+	type step struct {
+		seq       uint16
+		dropped   uint16
+		restarted bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"in order", []step{{5, 0, false}, {6, 0, false}, {7, 0, false}}},
+		{"dropped", []step{{5, 0, false}, {9, 3, false}, {10, 0, false}}},
+		{"wrap", []step{{0xFFFE, 0, false}, {0xFFFF, 0, false}, {0, 0, false}, {1, 0, false}}},
+		{"dropped over the wrap", []step{{0xFFFD, 0, false}, {2, 4, false}}},
+		{"duplicate", []step{{5, 0, false}, {6, 0, false}, {6, 0, false}, {7, 0, false}}},
+		{"late", []step{{5, 0, false}, {8, 2, false}, {7, 0, false}, {9, 0, false}}},
+		{"restart at 0", []step{{5000, 0, false}, {0, 0, true}, {1, 0, false}}},
+		{"restart at 0 early on", []step{{10, 0, false}, {0, 0, true}, {1, 0, false}}},
+		{"restart at a nonzero seq", []step{{5000, 0, false}, {3, 0, true}, {4, 0, false}}},
+		{"restart after a wrap", []step{{0xFFFF, 0, false}, {0, 0, false}, {1000, 999, false}, {40, 0, true}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var s sequenceTracker
+			for i, step := range test.steps {
+				dropped, restarted := s.next(step.seq)
+				if dropped != step.dropped || restarted != step.restarted {
+					t.Fatalf("step %d seq %d: got %d dropped restarted %v, expected %d dropped restarted %v", i, step.seq, dropped, restarted, step.dropped, step.restarted)
+				}
+			}
+		})
+	}
+}
@@ -1,12 +1,11 @@
 package drivers
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"sync"
 	"time"
 
@@ -14,19 +13,20 @@ import (
 	"go.einride.tech/can/pkg/socketcan"
 	"huskki/config"
 	"huskki/ecus"
+	"huskki/events"
 	"huskki/utils"
 )
 
 const (
 	CanNetwork = "can"
 
-	CanIdReq = 0x7E0
-	CanIdRsp = 0x7E8
+	SidDiagnosticSessionControl = 0x10
+	SidTesterPresent            = 0x3E
+	SidSecurityAccess           = 0x27
+	SidReadDataByIdentifier     = 0x22
+	PosOffset                   = 0x40
 
-	SidTesterPresent        = 0x3E
-	SidSecurityAccess       = 0x27
-	SidReadDataByIdentifier = 0x22
-	PosOffset               = 0x40
+	SessionDefault = 0x01
 
 	SaL2RequestSeed = 0x03
 	SaL2SendKey     = 0x04
@@ -43,13 +43,15 @@ const (
 
 type SocketCAN struct {
 	*config.SocketCANFlags
-	ecuProcessor ecus.ECUProcessor
+	ecus     []*ecuPoller
+	profiles ecus.Set
+	hub      *events.Hub
 
 	conn    io.ReadWriteCloser
 	recv    *socketcan.Receiver
 	tx      *socketcan.Transmitter
-	writer  io.Writer
-	logFile *os.File
+	rawLog  *FrameLog
+	capture *canCapture
 
 	startTime time.Time
 
@@ -57,18 +59,45 @@ type SocketCAN struct {
 	waiters map[uint32][]chan can.Frame
 	ctx     context.Context
 	cancel  context.CancelFunc
+}
+
+// ecuPoller polls one ECU on the bus. Every ECU gets its own so each keeps its own IDs, security and DIDs, and a slow
+// one doesn't hold the others up.
+type ecuPoller struct {
+	bus     *SocketCAN
+	index   uint8
+	profile *ecus.Profile
+	dids    []uint32
 
 	lastChk  []byte
 	lastLen  []byte
 	lastRead []time.Time
+	// lastBroadcast is the last data of every broadcast frame, for broadcast profiles.
+	lastBroadcast map[uint32][]byte
 }
 
-func NewSocketCAN(flags *config.SocketCANFlags, ecuProcessor ecus.ECUProcessor) *SocketCAN {
-	return &SocketCAN{
+func NewSocketCAN(flags *config.SocketCANFlags, profiles ecus.Set, hub *events.Hub) *SocketCAN {
+	p := &SocketCAN{
 		SocketCANFlags: flags,
-		ecuProcessor:   ecuProcessor,
+		profiles:       profiles,
+		hub:            hub,
 		waiters:        make(map[uint32][]chan can.Frame),
 	}
+	for i, profile := range profiles {
+		dids := profile.PolledDIDs()
+		p.ecus = append(p.ecus, &ecuPoller{
+			bus:      p,
+			index:    uint8(i),
+			profile:  profile,
+			dids:     dids,
+			lastChk:  make([]byte, len(dids)),
+			lastLen:  make([]byte, len(dids)),
+			lastRead: make([]time.Time, len(dids)),
+
+			lastBroadcast: make(map[uint32][]byte),
+		})
+	}
+	return p
 }
 
 func (p *SocketCAN) Init() error {
@@ -83,44 +112,62 @@ func (p *SocketCAN) Init() error {
 
 	// log file
 	filePath := utils.NextAvailableFilename(LOG_DIR, LOG_NAME, LOG_EXT)
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
-	if err != nil {
-		return fmt.Errorf("open rawlog: %w", err)
+	if p.rawLog, err = OpenRawLog(p.hub, filePath); err != nil {
+		return err
+	}
+	if err = writeLogMetadata(filePath, config.SocketCAN); err != nil {
+		log.Printf("couldn't write log metadata: %v", err)
+	}
+	// Started before anything is sent so the trace has the whole session, a ride is still worth logging without it
+	if p.Capture {
+		if p.capture, err = openCANCapture(p.SocketCanAddr, filePath); err != nil {
+			log.Printf("couldn't capture raw CAN frames: %v", err)
+		} else {
+			go p.capture.run()
+		}
 	}
-	p.logFile = file
-	p.writer = bufio.NewWriterSize(file, 1<<20)
-
-	// per-DID state
-	n := len(ecus.DIDsK701)
-	p.lastChk = make([]byte, n)
-	p.lastLen = make([]byte, n)
-	p.lastRead = make([]time.Time, n)
 
 	p.ctx, p.cancel = context.WithCancel(context.Background())
 	p.startTime = time.Now()
 
 	// start async reader first
 	go p.receiveLoop()
-	// start tester-present ticker (non-blocking, no response expected)
-	go p.testerPresentLoop()
+	for _, e := range p.ecus {
+		// start tester-present ticker (non-blocking, no response expected), only UDS has sessions to keep alive
+		if e.profile.UDS() {
+			go e.testerPresentLoop()
+		}
 
-	// raw-frame security handshake (single-frame)
-	if err := p.DoSecurityHandshake(3); err != nil {
-		return fmt.Errorf("security handshake failed: %w", err)
+		// raw-frame security handshake (single-frame)
+		if e.profile.Secured() {
+			if err := e.securityHandshake(e.profile.Security.Level); err != nil {
+				return fmt.Errorf("%s security handshake failed: %w", e.profile.Name, err)
+			}
+		}
+		if e.profile.Service == ecus.SERVICE_OBD {
+			if err := e.discoverPIDs(); err != nil {
+				return fmt.Errorf("%s PID discovery failed: %w", e.profile.Name, err)
+			}
+		}
 	}
 
 	return nil
 }
 
+// Close puts the ECUs back in their default session, then closes the logs and the bus. Run has to have returned.
 func (p *SocketCAN) Close() error {
 	if p.cancel != nil {
+		p.defaultSessions()
 		p.cancel()
 	}
-	if bw, ok := p.writer.(*bufio.Writer); ok {
-		_ = bw.Flush()
+	p.flush()
+	if p.rawLog != nil {
+		if err := p.rawLog.Close(); err != nil {
+			log.Printf("couldn't close rawlog: %v", err)
+		}
 	}
-	if p.logFile != nil {
-		_ = p.logFile.Close()
+	if p.capture != nil {
+		_ = p.capture.Close()
 	}
 	if p.conn != nil {
 		return p.conn.Close()
@@ -128,16 +175,99 @@ func (p *SocketCAN) Close() error {
 	return nil
 }
 
-func (p *SocketCAN) Run() error {
+// defaultSessions puts every UDS ECU back in its default session, which also locks its security access again.
+func (p *SocketCAN) defaultSessions() {
+	for _, e := range p.ecus {
+		if !e.profile.UDS() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(p.ctx, 300*time.Millisecond)
+		rsp, err := p.SendAndWait(ctx, e.requestID(), e.responseID(), []byte{SidDiagnosticSessionControl, SessionDefault})
+		cancel()
+		switch {
+		case err != nil:
+			log.Printf("%s default session: %v", e.profile.Name, err)
+		case len(rsp) >= 2 && rsp[0] == SidDiagnosticSessionControl+PosOffset && rsp[1] == SessionDefault:
+			log.Printf("%s back in its default session", e.profile.Name)
+		default:
+			log.Printf("%s default session: unexpected response % X", e.profile.Name, rsp)
+		}
+	}
+}
+
+// Run polls every ECU at once until one of them fails or ctx is cancelled. Broadcast profiles are decoded by the
+// receive loop as their frames arrive, until Close.
+func (p *SocketCAN) Run(ctx context.Context) error {
+	polling, listening := 0, 0
+	for _, e := range p.ecus {
+		if len(e.dids) > 0 {
+			polling++
+		}
+		if e.profile.Service == ecus.SERVICE_BROADCAST {
+			listening++
+		}
+	}
+	if polling == 0 && listening == 0 {
+		return fmt.Errorf("profile %q doesn't poll any DIDs", p.ecus[0].profile.Name)
+	}
+
+	go p.flushLoop()
+	if polling == 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	pollCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	errs := make(chan error, polling)
+	for _, e := range p.ecus {
+		if len(e.dids) == 0 {
+			continue
+		}
+		go func() {
+			errs <- e.run(pollCtx)
+		}()
+	}
+	// The first ECU to stop stops the rest, they're all done polling before Close talks to them
+	err := <-errs
+	stop()
+	for range polling - 1 {
+		<-errs
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (p *SocketCAN) flushLoop() {
 	flushTicker := time.NewTicker(FlushInterval)
 	defer flushTicker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-flushTicker.C:
+			p.flush()
+		}
+	}
+}
+
+// flush writes out the candump capture, the rawlog flushes itself.
+func (p *SocketCAN) flush() {
+	if p.capture != nil {
+		p.capture.flush()
+	}
+}
 
-	n := len(ecus.DIDsK701)
+func (e *ecuPoller) run(ctx context.Context) error {
+	p := e.bus
+	n := len(e.dids)
 	startIdx := 0
 	for {
 		select {
-		case <-p.ctx.Done():
-			return p.ctx.Err()
+		case <-ctx.Done():
+			return ctx.Err()
 		default:
 		}
 
@@ -147,13 +277,13 @@ func (p *SocketCAN) Run() error {
 
 		for i := 0; i < n; i++ {
 			idx := (startIdx + i) % n
-			did := ecus.DIDsK701[idx]
+			did := e.dids[idx]
 
-			if p.lastRead[idx].IsZero() {
+			if e.lastRead[idx].IsZero() {
 				readyIdx = idx
 				break
 			}
-			next := p.lastRead[idx].Add(ecus.DIDsToPollIntervalK701[did])
+			next := e.lastRead[idx].Add(e.profile.PollInterval(did))
 			wait := time.Until(next)
 			if wait <= 0 {
 				readyIdx = idx
@@ -167,74 +297,95 @@ func (p *SocketCAN) Run() error {
 		if readyIdx == -1 {
 			timer := time.NewTimer(minWait)
 			select {
-			case <-p.ctx.Done():
+			case <-ctx.Done():
 				timer.Stop()
-				return p.ctx.Err()
+				return ctx.Err()
 			case <-timer.C:
 			}
 			continue
 		}
 
-		did := ecus.DIDsK701[readyIdx]
+		did := e.dids[readyIdx]
 		now := time.Now()
 
-		req := []byte{SidReadDataByIdentifier, byte(did >> 8), byte(did)} // raw single-frame RDBI
+		req := e.profile.Request(did) // raw single-frame RDBI or OBD-II PID request
 
-		ctx, cancel := context.WithTimeout(p.ctx, DefaultRespTimeout)
-		rsp, err := p.SendAndWait(ctx, CanIdReq, CanIdRsp, req)
+		reqCtx, cancel := context.WithTimeout(ctx, DefaultRespTimeout)
+		rsp, err := p.SendAndWait(reqCtx, e.requestID(), e.responseID(), req)
 		cancel()
-		p.lastRead[readyIdx] = now
+		e.lastRead[readyIdx] = now
 
-		if err != nil {
-			log.Printf("DID 0x%04X read error: %v", did, err)
-		} else if len(rsp) >= 3 && rsp[0] == 0x62 && rsp[1] == byte(did>>8) && rsp[2] == byte(did) {
-			data := rsp[3:]
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
+			log.Printf("%s DID 0x%04X read error: %v", e.profile.Name, did, err)
+		} else if data, ok := e.profile.Response(did, rsp); ok {
 			var chk byte
 			for _, b := range data {
 				chk ^= b
 			}
-			changed := (chk != p.lastChk[readyIdx]) || (byte(len(data)) != p.lastLen[readyIdx])
+			changed := (chk != e.lastChk[readyIdx]) || (byte(len(data)) != e.lastLen[readyIdx])
 			if changed {
-				didData := p.ecuProcessor.ParseDIDBytes(did, data)
-				addDidDataToStream(didData)
-				err = p.writeFrameToBinary(did, data)
-				if err != nil {
-					log.Printf("writeFrameToBinary failed: %s", err)
-				}
-				p.lastChk[readyIdx] = chk
-				p.lastLen[readyIdx] = byte(len(data))
+				publish(p.hub, p.profiles, e.index, did, data, p.millis(), time.Now())
+				e.lastChk[readyIdx] = chk
+				e.lastLen[readyIdx] = byte(len(data))
 			}
 		}
 
 		startIdx = (readyIdx + 1) % n
+	}
+}
 
-		select {
-		case <-flushTicker.C:
-			if bw, ok := p.writer.(*bufio.Writer); ok {
-				_ = bw.Flush()
-			}
-		default:
+// discoverPIDs drops the PIDs the ECU doesn't support from the poll list, OBD-II ECUs only implement some of them.
+func (e *ecuPoller) discoverPIDs() error {
+	supported, err := ecus.SupportedPIDs(func(pid uint32) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(e.bus.ctx, 300*time.Millisecond)
+		defer cancel()
+		rsp, err := e.bus.SendAndWait(ctx, e.requestID(), e.responseID(), e.profile.Request(pid))
+		if err != nil {
+			return nil, err
+		}
+		data, ok := e.profile.Response(pid, rsp)
+		if !ok {
+			return nil, fmt.Errorf("unexpected response % X", rsp)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return err
+	}
+	var dids []uint32
+	for _, did := range e.dids {
+		if supported[did] {
+			dids = append(dids, did)
+		} else {
+			log.Printf("%s doesn't support PID 0x%02X, not polling it", e.profile.Name, did)
 		}
 	}
+	e.dids = dids
+	e.lastChk = make([]byte, len(dids))
+	e.lastLen = make([]byte, len(dids))
+	e.lastRead = make([]time.Time, len(dids))
+	return nil
 }
 
-func (p *SocketCAN) testerPresentLoop() {
+func (e *ecuPoller) testerPresentLoop() {
 	t := time.NewTicker(TesterPresentPeriod)
 	defer t.Stop()
 	for {
 		select {
-		case <-p.ctx.Done():
+		case <-e.bus.ctx.Done():
 			return
 		case <-t.C:
 			// 0x3E 0x80 : suppress positive response, so we don't wait for anything
-			ctx, cancel := context.WithTimeout(p.ctx, 100*time.Millisecond)
-			_ = p.sendRaw(ctx, CanIdReq, []byte{SidTesterPresent, 0x80})
+			ctx, cancel := context.WithTimeout(e.bus.ctx, 100*time.Millisecond)
+			_ = e.bus.sendRaw(ctx, e.requestID(), []byte{SidTesterPresent, 0x80})
 			cancel()
 		}
 	}
 }
 
-func (p *SocketCAN) DoSecurityHandshake(level ecus.SecurityLevel) error {
+func (e *ecuPoller) securityHandshake(level ecus.SecurityLevel) error {
 	var reqSub, keySub byte
 	switch level {
 	case 3:
@@ -243,17 +394,17 @@ func (p *SocketCAN) DoSecurityHandshake(level ecus.SecurityLevel) error {
 		reqSub, keySub = SaL2RequestSeed, SaL2SendKey
 	}
 
-	seedHi, seedLo, err := p.rawRequestSeed(reqSub)
+	seedHi, seedLo, err := e.rawRequestSeed(reqSub)
 	if err != nil {
 		return err
 	}
-	keyHi, keyLo, err := ecus.GenerateK701Key(level, seedHi, seedLo)
+	keyHi, keyLo, err := e.profile.GenerateKey(level, seedHi, seedLo)
 	if err != nil {
 		return err
 	}
 
 	for attempt := 0; attempt < 3; attempt++ {
-		ok, err := p.rawSendKey(keySub, keyHi, keyLo)
+		ok, err := e.rawSendKey(keySub, keyHi, keyLo)
 		if err == nil && ok {
 			return nil
 		}
@@ -262,10 +413,10 @@ func (p *SocketCAN) DoSecurityHandshake(level ecus.SecurityLevel) error {
 	return fmt.Errorf("securityAccess: key rejected")
 }
 
-func (p *SocketCAN) rawRequestSeed(reqSub byte) (byte, byte, error) {
-	ctx, cancel := context.WithTimeout(p.ctx, 300*time.Millisecond)
+func (e *ecuPoller) rawRequestSeed(reqSub byte) (byte, byte, error) {
+	ctx, cancel := context.WithTimeout(e.bus.ctx, 300*time.Millisecond)
 	defer cancel()
-	rsp, err := p.SendAndWait(ctx, CanIdReq, CanIdRsp, []byte{SidSecurityAccess, reqSub})
+	rsp, err := e.bus.SendAndWait(ctx, e.requestID(), e.responseID(), []byte{SidSecurityAccess, reqSub})
 	if err != nil {
 		return 0, 0, err
 	}
@@ -278,10 +429,10 @@ func (p *SocketCAN) rawRequestSeed(reqSub byte) (byte, byte, error) {
 	return 0, 0, fmt.Errorf("unexpected seed response % X", rsp)
 }
 
-func (p *SocketCAN) rawSendKey(keySub, kHi, kLo byte) (bool, error) {
-	ctx, cancel := context.WithTimeout(p.ctx, 300*time.Millisecond)
+func (e *ecuPoller) rawSendKey(keySub, kHi, kLo byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(e.bus.ctx, 300*time.Millisecond)
 	defer cancel()
-	rsp, err := p.SendAndWait(ctx, CanIdReq, CanIdRsp, []byte{SidSecurityAccess, keySub, kHi, kLo})
+	rsp, err := e.bus.SendAndWait(ctx, e.requestID(), e.responseID(), []byte{SidSecurityAccess, keySub, kHi, kLo})
 	if err != nil {
 		return false, err
 	}
@@ -319,7 +470,25 @@ func (p *SocketCAN) receiveLoop() {
 			continue
 		}
 		errCount = 0
-		p.dispatch(p.recv.Frame())
+		frame := p.recv.Frame()
+		p.broadcast(frame)
+		p.dispatch(frame)
+	}
+}
+
+// broadcast decodes a frame for every broadcast profile that knows it, frames that haven't changed since last time
+// are skipped like unchanged DIDs are.
+func (p *SocketCAN) broadcast(f can.Frame) {
+	for _, e := range p.ecus {
+		if !e.profile.Broadcasts(f.ID) {
+			continue
+		}
+		data := f.Data[:f.Length]
+		if last, ok := e.lastBroadcast[f.ID]; ok && bytes.Equal(last, data) {
+			continue
+		}
+		e.lastBroadcast[f.ID] = bytes.Clone(data)
+		publish(p.hub, p.profiles, e.index, f.ID, data, p.millis(), time.Now())
 	}
 }
 
@@ -414,6 +583,14 @@ func (p *SocketCAN) sendRaw(ctx context.Context, id uint32, payload []byte) erro
 	return p.tx.TransmitFrame(ctx, frame)
 }
 
+func (e *ecuPoller) requestID() uint32 {
+	return uint32(e.profile.CAN.Request)
+}
+
+func (e *ecuPoller) responseID() uint32 {
+	return uint32(e.profile.CAN.Response)
+}
+
 func (p *SocketCAN) millis() uint32 {
 	return uint32(time.Since(p.startTime) / time.Millisecond)
 }
@@ -0,0 +1,148 @@
+package ecus
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"huskki/models"
+)
+
+// CylinderStreamKey is the key of one cylinder of a per-cylinder stream, e.g. "Fuel-Trim-Cyl-2". Single cylinder
+// profiles keep the plain key so they look the same as before per-cylinder streams existed.
+func (p *Profile) CylinderStreamKey(key string, cylinder int) string {
+	if p.cylinders() <= 1 {
+		return key
+	}
+	return fmt.Sprintf("%s-Cyl-%d", key, cylinder)
+}
+
+// BalanceStreamKey is the key of a per-cylinder stream's balance, cylinder 1 minus the mean of the others.
+func BalanceStreamKey(key string) string {
+	return key + "-Balance"
+}
+
+func (p *Profile) cylinders() int {
+	return max(p.Cylinders, 1)
+}
+
+// cylinderStreams expands a stream definition into one stream per cylinder. Every cylinder after the first has its
+// colours rotated round the colour wheel so they can be told apart when they're overlaid, and only the first keeps
+// Active so charts still start on one stream.
+func (p *Profile) cylinderStreams(s *StreamDefinition) []*models.Stream {
+	n := p.cylinders()
+	if !s.PerCylinder || n == 1 {
+		return []*models.Stream{models.NewStream(p.keyPrefix+s.Key, s.Description, s.Unit, s.Discrete, s.Colours, s.Min, s.Max, s.Window, s.Active)}
+	}
+	var streams []*models.Stream
+	for cylinder := 1; cylinder <= n; cylinder++ {
+		colours := make([]models.ColourStop, len(s.Colours))
+		for i, c := range s.Colours {
+			colours[i] = models.ColourStop{Offset: c.Offset, Color: rotateHue(c.Color, float64(cylinder-1)*360/float64(n))}
+		}
+		description := fmt.Sprintf("%s, cylinder %d", s.Description, cylinder)
+		streams = append(streams, models.NewStream(p.keyPrefix+p.CylinderStreamKey(s.Key, cylinder), description, s.Unit, s.Discrete, colours, s.Min, s.Max, s.Window, s.Active && cylinder == 1))
+	}
+	return streams
+}
+
+// balanceStream shows how far cylinder 1 is from the rest, centred on 0 with the same span as the cylinders.
+func (p *Profile) balanceStream(s *StreamDefinition) *models.Stream {
+	span := (s.Max - s.Min) / 2
+	description := fmt.Sprintf("%s balance, cylinder 1 minus the others", s.Description)
+	return models.NewStream(p.keyPrefix+BalanceStreamKey(s.Key), description, s.Unit, false, s.Colours, -span, span, s.Window, false)
+}
+
+// cylinderValues keeps the latest value of every cylinder of the balanced streams, so a balance can be sent whenever
+// one of them changes.
+type cylinderValues struct {
+	mu     sync.Mutex
+	latest map[string][]float64
+	seen   map[string][]bool
+}
+
+// update records a cylinder's value and returns the stream's balance once every cylinder has been seen.
+func (c *cylinderValues) update(key string, cylinders, cylinder int, value float64) (float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.latest == nil {
+		c.latest = map[string][]float64{}
+		c.seen = map[string][]bool{}
+	}
+	if c.latest[key] == nil {
+		c.latest[key] = make([]float64, cylinders)
+		c.seen[key] = make([]bool, cylinders)
+	}
+	c.latest[key][cylinder-1] = value
+	c.seen[key][cylinder-1] = true
+
+	var others float64
+	for i, seen := range c.seen[key] {
+		if !seen {
+			return 0, false
+		}
+		if i > 0 {
+			others += c.latest[key][i]
+		}
+	}
+	return c.latest[key][0] - others/float64(cylinders-1), true
+}
+
+// rotateHue turns a "#RRGGBB" colour round the colour wheel, anything else is returned as is.
+func rotateHue(colour string, degrees float64) string {
+	if degrees == 0 || len(colour) != 7 || colour[0] != '#' {
+		return colour
+	}
+	rgb, err := strconv.ParseUint(colour[1:], 16, 32)
+	if err != nil {
+		return colour
+	}
+	r := float64(rgb>>16&0xFF) / 255
+	g := float64(rgb>>8&0xFF) / 255
+	b := float64(rgb&0xFF) / 255
+
+	// RGB -> HSL
+	hi, lo := max(r, g, b), min(r, g, b)
+	l := (hi + lo) / 2
+	var h, s float64
+	if d := hi - lo; d > 0 {
+		if l > 0.5 {
+			s = d / (2 - hi - lo)
+		} else {
+			s = d / (hi + lo)
+		}
+		switch hi {
+		case r:
+			h = math.Mod((g-b)/d, 6)
+		case g:
+			h = (b-r)/d + 2
+		default:
+			h = (r-g)/d + 4
+		}
+		h *= 60
+	}
+	h = math.Mod(h+degrees+360, 360)
+
+	// HSL -> RGB
+	chroma := (1 - math.Abs(2*l-1)) * s
+	x := chroma * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - chroma/2
+	var r1, g1, b1 float64
+	switch {
+	case h < 60:
+		r1, g1 = chroma, x
+	case h < 120:
+		r1, g1 = x, chroma
+	case h < 180:
+		g1, b1 = chroma, x
+	case h < 240:
+		g1, b1 = x, chroma
+	case h < 300:
+		r1, b1 = x, chroma
+	default:
+		r1, b1 = chroma, x
+	}
+	toByte := func(v float64) int { return int(math.Round((v + m) * 255)) }
+	return fmt.Sprintf("#%02X%02X%02X", toByte(r1), toByte(g1), toByte(b1))
+}
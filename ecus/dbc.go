@@ -0,0 +1,215 @@
+package ecus
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.einride.tech/can"
+	"go.einride.tech/can/pkg/dbc"
+	"go.einride.tech/can/pkg/descriptor"
+	"huskki/models"
+)
+
+// DBC_PREFIX loads a DBC file as a broadcast profile, e.g. -ecu auto,dbc:bike.dbc.
+const DBC_PREFIX = "dbc:"
+
+// dbcChartPriority puts DBC charts after the ECU's own.
+const dbcChartPriority = 64
+
+var dbcColours = []models.ColourStop{{Offset: "0%", Color: "#FFD200"}, {Offset: "100%", Color: "#F7971E"}}
+
+// dbcDecoder decodes broadcast frames with the signals in a DBC file.
+type dbcDecoder struct {
+	messages map[uint32]*dbcMessage
+}
+
+type dbcMessage struct {
+	size        int
+	multiplexer *descriptor.Signal
+	signals     []*dbcSignal
+}
+
+type dbcSignal struct {
+	*descriptor.Signal
+	streamKey string
+}
+
+// LoadDBC turns a DBC file into a broadcast profile: nothing is polled, every frame with a message in the file is
+// decoded as it goes past. Every signal gets a stream and every message a chart.
+func LoadDBC(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read DBC %s: %w", path, err)
+	}
+	parser := dbc.NewParser(path, data)
+	if err = parser.Parse(); err != nil {
+		return nil, fmt.Errorf("parse DBC: %w", err)
+	}
+
+	var messageDefs []*dbc.MessageDef
+	floats := map[string]dbc.SignalValueType{}
+	described := map[string]bool{}
+	for _, def := range parser.Defs() {
+		switch def := def.(type) {
+		case *dbc.MessageDef:
+			// Signals that aren't in any message are collected in a pseudo message that's never sent
+			if dbc.IsIndependentSignalsMessage(def) || len(def.Signals) == 0 {
+				continue
+			}
+			messageDefs = append(messageDefs, def)
+		case *dbc.SignalValueTypeDef:
+			floats[signalID(def.MessageID, def.SignalName)] = def.SignalValueType
+		case *dbc.ValueDescriptionsDef:
+			if def.ObjectType == dbc.ObjectTypeSignal {
+				described[signalID(def.MessageID, def.SignalName)] = true
+			}
+		}
+	}
+
+	// Signal names only have to be unique within their message, the ones that aren't get the message's name too
+	names := map[string]int{}
+	for _, m := range messageDefs {
+		for _, s := range m.Signals {
+			names[string(s.Name)]++
+		}
+	}
+
+	decoder := &dbcDecoder{messages: map[uint32]*dbcMessage{}}
+	profile := &Profile{
+		Name:         "DBC " + filepath.Base(path),
+		Description:  "Broadcast frames decoded with " + path,
+		Service:      SERVICE_BROADCAST,
+		Registration: DBC_PREFIX + path,
+		decoder:      decoder,
+	}
+	for i, m := range messageDefs {
+		message := &dbcMessage{size: int(m.Size)}
+		chart := &ChartDefinition{Key: string(m.Name), Priority: uint8(min(dbcChartPriority+i, math.MaxUint8))}
+		for _, s := range m.Signals {
+			key := string(s.Name)
+			if names[key] > 1 {
+				key = string(m.Name) + "-" + key
+			}
+			valueType := floats[signalID(m.MessageID, s.Name)]
+			signal := &dbcSignal{
+				Signal: &descriptor.Signal{
+					Name:             string(s.Name),
+					Start:            uint8(s.StartBit),
+					Length:           uint8(s.Size),
+					IsBigEndian:      s.IsBigEndian,
+					IsSigned:         s.IsSigned,
+					IsFloat:          valueType == dbc.SignalValueTypeFloat32,
+					IsMultiplexer:    s.IsMultiplexerSwitch,
+					IsMultiplexed:    s.IsMultiplexed,
+					MultiplexerValue: uint(s.MultiplexerSwitch),
+					Offset:           s.Offset,
+					Scale:            s.Factor,
+					Min:              s.Minimum,
+					Max:              s.Maximum,
+					Unit:             s.Unit,
+				},
+				streamKey: key,
+			}
+			if valueType == dbc.SignalValueTypeFloat64 {
+				return nil, fmt.Errorf("%s.%s: 64 bit floats don't fit in a classic CAN frame", m.Name, s.Name)
+			}
+			if s.IsMultiplexerSwitch {
+				message.multiplexer = signal.Signal
+			}
+			message.signals = append(message.signals, signal)
+
+			low, high := signal.displayRange()
+			profile.Streams = append(profile.Streams, &StreamDefinition{
+				Key:         key,
+				Description: fmt.Sprintf("%s %s", m.Name, s.Name),
+				Unit:        s.Unit,
+				Discrete:    s.Size == 1 || described[signalID(m.MessageID, s.Name)],
+				Colours:     dbcColours,
+				Min:         low,
+				Max:         high,
+				Window:      10000,
+				Active:      len(chart.Streams) == 0,
+			})
+			chart.Streams = append(chart.Streams, key)
+		}
+		decoder.messages[m.MessageID.ToCAN()] = message
+		profile.Charts = append(profile.Charts, chart)
+	}
+	if len(decoder.messages) == 0 {
+		return nil, fmt.Errorf("DBC %s has no messages with signals", path)
+	}
+	if err = profile.validate(); err != nil {
+		return nil, fmt.Errorf("DBC %s: %w", path, err)
+	}
+	return profile, nil
+}
+
+func signalID(message dbc.MessageID, signal dbc.Identifier) string {
+	return fmt.Sprintf("%d.%s", message, signal)
+}
+
+// displayRange is the signal's min and max if the DBC has them, otherwise the range its raw value can cover.
+func (s *dbcSignal) displayRange() (float64, float64) {
+	if s.Min != s.Max {
+		return s.Min, s.Max
+	}
+	var low, high float64
+	switch {
+	case s.IsFloat:
+		return -1, 1
+	case s.IsSigned:
+		low, high = -math.Exp2(float64(s.Length-1)), math.Exp2(float64(s.Length-1))-1
+	default:
+		low, high = 0, math.Exp2(float64(s.Length))-1
+	}
+	low, high = low*s.Scale+s.Offset, high*s.Scale+s.Offset
+	return min(low, high), max(low, high)
+}
+
+func (s *dbcSignal) decode(data *can.Data) float64 {
+	if s.IsFloat {
+		return s.ToPhysical(s.UnmarshalFloat(*data))
+	}
+	return s.UnmarshalPhysical(*data)
+}
+
+func (d *dbcDecoder) ParseDIDBytes(did uint32, dataBytes []byte) []*DIDData {
+	message, ok := d.messages[did]
+	// A short frame would decode the signals past its end as zeros
+	if !ok || len(dataBytes) < message.size {
+		return []*DIDData{}
+	}
+	var data can.Data
+	copy(data[:], dataBytes)
+	var mux uint64
+	if message.multiplexer != nil {
+		mux = message.multiplexer.UnmarshalUnsigned(data)
+	}
+	var didData []*DIDData
+	for _, s := range message.signals {
+		if s.IsMultiplexed && uint64(s.MultiplexerValue) != mux {
+			continue
+		}
+		didData = append(didData, &DIDData{s.streamKey, s.decode(&data)})
+	}
+	return didData
+}
+
+// Broadcasts reports whether the profile decodes broadcast frames with this CAN ID.
+func (p *Profile) Broadcasts(id uint32) bool {
+	d, ok := p.decoder.(*dbcDecoder)
+	return ok && d.messages[id] != nil
+}
+
+// loadDBCProfile is Load for names with DBC_PREFIX.
+func loadDBCProfile(ecu string) (*Profile, bool, error) {
+	path, ok := strings.CutPrefix(ecu, DBC_PREFIX)
+	if !ok {
+		return nil, false, nil
+	}
+	profile, err := LoadDBC(path)
+	return profile, true, err
+}
@@ -0,0 +1,156 @@
+package ecus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+
+	"huskki/uds"
+)
+
+// IdentificationDID is one of the standard UDS identification DIDs every ECU should answer.
+type IdentificationDID struct {
+	DID uint16
+	// Key is how the value is written in log metadata and profile matches.
+	Key  string
+	Name string
+}
+
+// IdentificationDIDs are read in this order after connecting.
+var IdentificationDIDs = []IdentificationDID{
+	{0xF187, "partNumber", "Part number"},
+	{0xF188, "softwareNumber", "Software number"},
+	{0xF189, "softwareVersion", "Software version"},
+	{0xF18A, "supplier", "Supplier"},
+	{0xF18B, "manufactureDate", "Manufacture date"},
+	{0xF18C, "serialNumber", "Serial number"},
+	{0xF190, "vin", "VIN"},
+	{0xF191, "hardwareNumber", "Hardware number"},
+	{0xF193, "hardwareVersion", "Hardware version"},
+	{0xF195, "supplierSoftwareVersion", "Supplier software version"},
+	{0xF197, "systemName", "System name"},
+}
+
+// Identification holds the identification values an ECU answered, keyed by IdentificationDID.Key. ECUs don't have to
+// support all of them, the ones they reject are left out.
+type Identification map[string]string
+
+// ReadIdentification reads every identification DID the ECU supports. It only fails if the ECU doesn't answer any of
+// them, a DID the ECU rejects is skipped.
+func ReadIdentification(ctx context.Context, client *uds.Client) (Identification, error) {
+	identification := Identification{}
+	var lastErr error
+	for _, d := range IdentificationDIDs {
+		data, err := client.ReadDataByIdentifier(ctx, d.DID)
+		if err != nil {
+			var nrc *uds.NegativeResponseError
+			if !errors.As(err, &nrc) {
+				// Timeouts and bus errors won't get better for the next DID
+				return nil, fmt.Errorf("read %s: %w", d.Name, err)
+			}
+			lastErr = err
+			continue
+		}
+		if value := identificationString(data); value != "" {
+			identification[d.Key] = value
+		}
+	}
+	if len(identification) == 0 && lastErr != nil {
+		return nil, fmt.Errorf("no identification DIDs supported: %w", lastErr)
+	}
+	return identification, nil
+}
+
+// identificationString turns an identification DID's data into text. Most are ASCII padded with spaces or nulls,
+// anything else is shown as hex.
+func identificationString(data []byte) string {
+	text := strings.TrimSpace(strings.Trim(string(data), "\x00\xFF"))
+	for _, r := range text {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return fmt.Sprintf("% X", data)
+		}
+	}
+	return text
+}
+
+// Named returns [name, value] pairs for display, in IdentificationDIDs order.
+func (i Identification) Named() [][2]string {
+	var named [][2]string
+	for _, d := range IdentificationDIDs {
+		if value, ok := i[d.Key]; ok {
+			named = append(named, [2]string{d.Name, value})
+		}
+	}
+	return named
+}
+
+// String lists the identification values on one line, in IdentificationDIDs order.
+func (i Identification) String() string {
+	var parts []string
+	for _, pair := range i.Named() {
+		parts = append(parts, fmt.Sprintf("%s %q", pair[0], pair[1]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matches reports how many of the profile's match keys the identification satisfies, or false if any of them fail.
+// A match key is satisfied when the value starts with one of its prefixes.
+func (p *Profile) matches(identification Identification) (int, bool) {
+	if len(p.Match) == 0 {
+		return 0, false
+	}
+	for key, prefixes := range p.Match {
+		value, ok := identification[key]
+		if !ok {
+			return 0, false
+		}
+		matched := false
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(value, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return 0, false
+		}
+	}
+	return len(p.Match), true
+}
+
+// IdentifyProfile loads the registered profile matching the identification, or the default profile if none do.
+func IdentifyProfile(identification Identification) (*Profile, error) {
+	name, ok := Identify(identification)
+	if !ok {
+		log.Printf("no ECU profile matches %s, using %s", identification, DEFAULT_ECU)
+		name = DEFAULT_ECU
+	}
+	return Load(name, "")
+}
+
+// Identify picks the registered profile whose match best fits the identification, the one satisfying the most match
+// keys wins. It returns false if none of them match.
+func Identify(identification Identification) (string, bool) {
+	best, bestScore := "", 0
+	for _, name := range Registered() {
+		profile, err := Lookup(name)
+		if err != nil {
+			log.Printf("identify: %v", err)
+			continue
+		}
+		score, ok := profile.matches(identification)
+		if !ok {
+			continue
+		}
+		if score == bestScore {
+			log.Printf("identify: %s and %s both match, keeping %s", best, name, best)
+		}
+		if score > bestScore {
+			best, bestScore = name, score
+		}
+	}
+	return best, bestScore > 0
+}
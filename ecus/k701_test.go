@@ -0,0 +1,212 @@
+package ecus
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"huskki/utils"
+)
+
+// baselineK701 is the hand written K701 decoder the k701 profile replaced, kept to check the profile against.
+func baselineK701(did uint32, dataBytes []byte) []*DIDData {
+	u16 := func() float64 { return float64(int(dataBytes[0])<<8 | int(dataBytes[1])) }
+	last := func() float64 { return float64(dataBytes[len(dataBytes)-1]) }
+	switch did {
+	case 0x0100:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"RPM", u16() / 4.0}}
+		}
+	case 0x0001:
+		if len(dataBytes) >= 1 {
+			return []*DIDData{{"Computed-Throttle", utils.RoundToXDp(last()/255.0*100.0, 1)}}
+		}
+	case 0x0070:
+		if len(dataBytes) >= 1 {
+			return []*DIDData{{"Input-Throttle", utils.RoundToXDp(last()/255.0*100.0, 1)}}
+		}
+	case 0x0076:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"TPS", utils.RoundToXDp(u16()/1023.0*100.0, 1)}}
+		}
+	case 0x0009:
+		temp := -40.0
+		if len(dataBytes) >= 2 {
+			temp += u16()
+		} else if len(dataBytes) == 1 {
+			temp += float64(dataBytes[0])
+		}
+		return []*DIDData{{"Coolant", temp}}
+	case 0x0031:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"Gear", float64(dataBytes[1])}}
+		}
+	case 0x0110:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"Injection-Time", utils.RoundToXDp(u16()/1000.0, 2)}}
+		}
+	case 0x0042:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"Side-Stand", utils.BoolToFloat(dataBytes[1] == 0xFF)}}
+		}
+	case 0x0041:
+		var pulled byte
+		if len(dataBytes) >= 1 {
+			pulled = dataBytes[0]
+		}
+		if len(dataBytes) >= 2 {
+			pulled = dataBytes[1]
+		}
+		return []*DIDData{{"Clutch", float64(pulled)}}
+	case 0x0064:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"SAS-Valve", utils.BoolToFloat(dataBytes[1] == 0xFF)}}
+		}
+	case 0x0012:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"O2-Voltage", utils.RoundToXDp(u16()/1023.0*5, 2)}}
+		}
+	case 0x0102:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"Fuel-Trim", utils.RoundToXDp((u16()/32768.0-1.0)*100.0, 1)}}
+		}
+	case 0x0002:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"IAP-Voltage", u16()}}
+		}
+	case 0x0003:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"IAP", utils.RoundToXDp(u16()/1013.25, 2)}}
+		}
+	case 0x0120:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"Coil-1-Current", utils.RoundToXDp(u16()/100.0, 2)}}
+		}
+	case 0x0122:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"Coil-2-Current", utils.RoundToXDp(u16()/100.0, 2)}}
+		}
+	case 0x0130:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"Coil-1-Dwell", utils.RoundToXDp(u16()/1000.0, 2)}}
+		}
+	case 0x0132:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"Coil-2-Dwell", utils.RoundToXDp(u16()/1000.0, 2)}}
+		}
+	case 0x0007:
+		if len(dataBytes) >= 1 {
+			return []*DIDData{{"Engine-Load", utils.RoundToXDp(last()/255.0*100.0, 1)}}
+		}
+	case 0x0005:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"Barometer-Volt", utils.RoundToXDp(u16()/10000.0, 3)}}
+		}
+	case 0x0004:
+		if len(dataBytes) >= 2 {
+			return []*DIDData{{"Estimated-Altitude", utils.RoundToXDp(u16()*1.33322/1013.25, 2)}}
+		}
+	}
+	return []*DIDData{}
+}
+
+func checkK701Parity(t *testing.T, profile *Profile, did uint32, data []byte) {
+	t.Helper()
+	got := profile.ParseDIDBytes(did, data)
+	want := baselineK701(did, data)
+	if len(got) != len(want) {
+		t.Errorf("DID 0x%04X % X: got %d values, the old decoder %d", did, data, len(got), len(want))
+		return
+	}
+	for i := range want {
+		if *got[i] != *want[i] {
+			t.Errorf("DID 0x%04X % X: got %s %v, the old decoder %s %v", did, data, got[i].StreamKey, got[i].DidValue, want[i].StreamKey, want[i].DidValue)
+		}
+	}
+}
+
+func TestK701ProfileMatchesOldDecoder(t *testing.T) {
+	profile, err := DefaultProfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		did  uint32
+		data []byte
+	}{
+		{"rpm", 0x0100, []byte{0x1B, 0x58}},
+		{"throttle", 0x0001, []byte{0x00, 0x80}},
+		{"throttle one byte", 0x0001, []byte{0xFF}},
+		{"coolant", 0x0009, []byte{0x00, 0x87}},
+		{"coolant one byte", 0x0009, []byte{0x87}},
+		{"gear", 0x0031, []byte{0x00, 0x03}},
+		{"clutch", 0x0041, []byte{0x00, 0x01}},
+		{"clutch one byte", 0x0041, []byte{0x01}},
+		{"clutch three bytes", 0x0041, []byte{0x00, 0x01, 0x00}},
+		{"side stand down", 0x0042, []byte{0x00, 0xFF}},
+		{"side stand up", 0x0042, []byte{0x00, 0x00}},
+		{"side stand short", 0x0042, []byte{0xFF}},
+		{"sas valve open", 0x0064, []byte{0x00, 0xFF}},
+		{"fuel trim", 0x0102, []byte{0x83, 0x12}},
+		{"altitude", 0x0004, []byte{0x02, 0xF8}},
+		{"rpm short", 0x0100, []byte{0x1B}},
+		{"unknown", 0x0108, []byte{0x12, 0x34}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkK701Parity(t, profile, test.did, test.data)
+		})
+	}
+}
+
+// TestK701ProfileMatchesOldDecoderOnLogs replays the DIDLOG CSVs the old decoder was written against.
+func TestK701ProfileMatchesOldDecoderOnLogs(t *testing.T) {
+	profile, err := DefaultProfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := filepath.Glob("../logs/DIDLOG*.CSV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Skip("no DIDLOG CSVs")
+	}
+	frames := 0
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			// millis,did,data with the data as space separated hex, skipping the lines the logger mangled
+			fields := strings.Split(scanner.Text(), ",")
+			if len(fields) < 3 {
+				continue
+			}
+			did, err := strconv.ParseUint(fields[1], 0, 32)
+			if err != nil {
+				continue
+			}
+			data, err := hex.DecodeString(strings.ReplaceAll(fields[2], " ", ""))
+			if err != nil || len(data) == 0 {
+				continue
+			}
+			checkK701Parity(t, profile, uint32(did), data)
+			frames++
+		}
+		file.Close()
+		if err = scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if frames == 0 {
+		t.Fatal("no frames in the DIDLOG CSVs")
+	}
+}
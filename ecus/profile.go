@@ -0,0 +1,566 @@
+package ecus
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"huskki/expr"
+	"huskki/models"
+	"huskki/uds"
+	"huskki/utils"
+)
+
+//go:embed profiles/*.json
+var builtinProfiles embed.FS
+
+// Profile describes everything bike specific: how to talk to the ECU, which DIDs to poll and how to decode them, and
+// the streams and charts the dashboard shows. Profiles are JSON so adding a DID doesn't need a recompile.
+type Profile struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Experimental profiles haven't been checked against a real bike.
+	Experimental bool `json:"experimental,omitempty"`
+	// Extends names a registered profile this one is based on. DIDs, streams, charts and lookups are merged by key,
+	// CAN IDs, security and decoder replace the base's if set.
+	Extends string `json:"extends,omitempty"`
+	// Decoder names a registered Go ECUProcessor that decodes DIDs the profile doesn't define.
+	Decoder string `json:"decoder,omitempty"`
+	// Service is how DIDs are read, SERVICE_UDS (the default) or SERVICE_OBD.
+	Service string `json:"service,omitempty"`
+	// Cylinders splits every per-cylinder stream into one stream per cylinder, defaults to 1.
+	Cylinders int                 `json:"cylinders,omitempty"`
+	CAN       CANIDs              `json:"can"`
+	Security  Security            `json:"security"`
+	DIDs      []*DID              `json:"dids"`
+	Streams   []*StreamDefinition `json:"streams"`
+	Charts    []*ChartDefinition  `json:"charts"`
+	// Lookups are named [x, y] breakpoint tables DID expressions can call like functions, e.g. "gear(u16be(0))".
+	Lookups map[string][][2]float64 `json:"lookups,omitempty"`
+	// Match picks this profile with -ecu auto. Keys are Identification keys like "partNumber", the ECU has to answer
+	// every key with a value starting with one of the listed prefixes. It isn't inherited through extends.
+	Match map[string][]string `json:"match,omitempty"`
+
+	// Registration is the name the profile was registered under, empty for profiles loaded from a file.
+	Registration string `json:"-"`
+
+	dids     map[uint32]*DID
+	lookups  map[string]expr.Func
+	decoder  ECUProcessor
+	balanced map[string]bool
+	values   *cylinderValues
+	// keyPrefix goes in front of every stream and chart key, NewSet sets it on every ECU but the first so ECUs with
+	// the same streams can share a dashboard.
+	keyPrefix string
+}
+
+type CANIDs struct {
+	Request  utils.HexUint32 `json:"request"`
+	Response utils.HexUint32 `json:"response"`
+}
+
+type Security struct {
+	// Algorithm names a registered seed/key algorithm, e.g. "k701". ECUs that answer without unlocking leave it empty.
+	Algorithm string `json:"algorithm"`
+	// Level is the security level unlocked before polling.
+	Level SecurityLevel `json:"level"`
+	// UnlockLevels are walked through in order to read or write memory, defaults to just Level.
+	UnlockLevels []SecurityLevel `json:"unlockLevels,omitempty"`
+}
+
+type DID struct {
+	DID         utils.HexUint32 `json:"did"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	// Poll is how often to read the DID, DIDs without one aren't polled but are still decoded if they turn up, e.g.
+	// in old logs.
+	Poll   utils.Duration `json:"poll,omitempty"`
+	Values []*DIDValue    `json:"values"`
+}
+
+// DIDValue is one value decoded out of a DID's data and sent to a stream.
+//
+// Expr works out the value, either straight from the data with byte helpers like "(u16be(0)/q15 - 1) * 100", or by
+// scaling raw, the number read with Offset and Bits, like "raw/1023*5". Besides the byte helpers, expressions have the
+// profile's lookups, len (the data length) and everything in the expr package.
+type DIDValue struct {
+	Stream string `json:"stream"`
+	// Offset of raw in the DID's data, negative offsets count back from the end.
+	Offset int `json:"offset,omitempty"`
+	// Bits of raw, 8, 16 or 32, or 0 to read everything from Offset to the end as one big endian number.
+	Bits         int  `json:"bits,omitempty"`
+	Signed       bool `json:"signed,omitempty"`
+	LittleEndian bool `json:"littleEndian,omitempty"`
+	// Expr works the value out, empty means raw as is.
+	Expr string `json:"expr,omitempty"`
+	// Decimals to round to, no rounding if unset.
+	Decimals *uint8 `json:"decimals,omitempty"`
+	// Cylinder the value belongs to if Stream is per-cylinder, 0 means cylinder 1.
+	Cylinder int `json:"cylinder,omitempty"`
+
+	expression *expr.Expression
+	usesRaw    bool
+	// streamKey is Stream with the cylinder suffix, if it has one.
+	streamKey string
+}
+
+// didVars are the variables DID expressions can use, x is an alias of raw.
+var didVars = map[string]bool{"raw": true, "x": true, "len": true}
+
+type StreamDefinition struct {
+	Key         string              `json:"key"`
+	Description string              `json:"description"`
+	Unit        string              `json:"unit"`
+	Discrete    bool                `json:"discrete,omitempty"`
+	Colours     []models.ColourStop `json:"colours"`
+	Min         float64             `json:"min"`
+	Max         float64             `json:"max"`
+	// Window is how many milliseconds of data to show.
+	Window int  `json:"window"`
+	Active bool `json:"active,omitempty"`
+	// PerCylinder streams are split into one stream per cylinder on multi-cylinder profiles, see
+	// Profile.CylinderStreamKey.
+	PerCylinder bool `json:"perCylinder,omitempty"`
+}
+
+type ChartDefinition struct {
+	Key      string   `json:"key"`
+	Streams  []string `json:"streams"`
+	Priority uint8    `json:"priority"`
+	// Balance adds a balance stream for every per-cylinder stream in the chart, cylinder 1 minus the others, so
+	// imbalances between cylinders stand out. It does nothing on single cylinder profiles.
+	Balance bool `json:"balance,omitempty"`
+}
+
+// DefaultProfile loads the built-in K701 profile.
+func DefaultProfile() (*Profile, error) {
+	return Lookup(DEFAULT_ECU)
+}
+
+// Load loads the profile from a file if path is set, otherwise the registered profile called ecu. AUTO_ECU loads the
+// default profile here, callers that can talk to the ECU identify it with IdentifyProfile instead.
+func Load(ecu, path string) (*Profile, error) {
+	var profile *Profile
+	var err error
+	if path != "" {
+		profile, err = LoadProfile(path)
+	} else if dbcProfile, ok, dbcErr := loadDBCProfile(ecu); ok {
+		profile, err = dbcProfile, dbcErr
+	} else {
+		if ecu == "" || ecu == AUTO_ECU {
+			ecu = DEFAULT_ECU
+		}
+		profile, err = Lookup(ecu)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if profile.Experimental {
+		log.Printf("ECU profile %s is experimental and hasn't been checked against a real ECU: %s", profile.Name, profile.Description)
+	}
+	return profile, nil
+}
+
+func LoadProfile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read profile %s: %w", path, err)
+	}
+	profile, err := ParseProfile(data)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %w", path, err)
+	}
+	return profile, nil
+}
+
+func ParseProfile(data []byte) (*Profile, error) {
+	profile := &Profile{}
+	if err := json.Unmarshal(data, profile); err != nil {
+		return nil, fmt.Errorf("parse profile: %w", err)
+	}
+	if profile.Extends != "" {
+		base, err := Lookup(profile.Extends)
+		if err != nil {
+			return nil, fmt.Errorf("extends: %w", err)
+		}
+		profile = base.extend(profile)
+	}
+	if err := profile.validate(); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// extend returns this profile with child merged over it.
+func (p *Profile) extend(child *Profile) *Profile {
+	merged := *p
+	merged.Name = child.Name
+	merged.Description = child.Description
+	merged.Experimental = child.Experimental
+	merged.Extends = child.Extends
+	merged.Match = child.Match
+	merged.Registration = ""
+	if child.Decoder != "" {
+		merged.Decoder = child.Decoder
+	}
+	if child.Cylinders != 0 {
+		merged.Cylinders = child.Cylinders
+	}
+	if child.Service != "" {
+		merged.Service = child.Service
+	}
+	if child.CAN.Request != 0 || child.CAN.Response != 0 {
+		merged.CAN = child.CAN
+	}
+	if child.Security.Algorithm != "" {
+		merged.Security = child.Security
+	}
+
+	merged.DIDs = slices.Clone(p.DIDs)
+	for _, d := range child.DIDs {
+		if i := slices.IndexFunc(merged.DIDs, func(b *DID) bool { return b.DID == d.DID }); i >= 0 {
+			merged.DIDs[i] = d
+		} else {
+			merged.DIDs = append(merged.DIDs, d)
+		}
+	}
+	merged.Streams = slices.Clone(p.Streams)
+	for _, s := range child.Streams {
+		if i := slices.IndexFunc(merged.Streams, func(b *StreamDefinition) bool { return b.Key == s.Key }); i >= 0 {
+			merged.Streams[i] = s
+		} else {
+			merged.Streams = append(merged.Streams, s)
+		}
+	}
+	merged.Charts = slices.Clone(p.Charts)
+	for _, c := range child.Charts {
+		if i := slices.IndexFunc(merged.Charts, func(b *ChartDefinition) bool { return b.Key == c.Key }); i >= 0 {
+			merged.Charts[i] = c
+		} else {
+			merged.Charts = append(merged.Charts, c)
+		}
+	}
+	merged.Lookups = maps.Clone(p.Lookups)
+	if merged.Lookups == nil {
+		merged.Lookups = map[string][][2]float64{}
+	}
+	maps.Copy(merged.Lookups, child.Lookups)
+	return &merged
+}
+
+func (p *Profile) validate() error {
+	if _, ok := keyAlgorithm(p.Security.Algorithm); !ok && p.Secured() {
+		return fmt.Errorf("unknown security algorithm %q", p.Security.Algorithm)
+	}
+	if p.Decoder != "" {
+		d, ok := decoder(p.Decoder)
+		if !ok {
+			return fmt.Errorf("unknown decoder %q", p.Decoder)
+		}
+		p.decoder = d
+	}
+
+	for key := range p.Match {
+		if !slices.ContainsFunc(IdentificationDIDs, func(d IdentificationDID) bool { return d.Key == key }) {
+			return fmt.Errorf("match: unknown identification %q", key)
+		}
+	}
+
+	if err := p.validateService(); err != nil {
+		return err
+	}
+	if p.Cylinders < 0 {
+		return fmt.Errorf("%d cylinders", p.Cylinders)
+	}
+	streams := map[string]*StreamDefinition{}
+	for _, s := range p.Streams {
+		if streams[s.Key] != nil {
+			return fmt.Errorf("stream %q defined twice", s.Key)
+		}
+		streams[s.Key] = s
+	}
+	p.balanced = map[string]bool{}
+	p.values = &cylinderValues{}
+	for _, c := range p.Charts {
+		for _, key := range c.Streams {
+			if streams[key] == nil {
+				return fmt.Errorf("chart %q: unknown stream %q", c.Key, key)
+			}
+			if c.Balance && streams[key].PerCylinder && p.cylinders() > 1 {
+				p.balanced[key] = true
+			}
+		}
+	}
+
+	byteFuncs := expr.ByteFuncs(nil)
+	p.lookups = map[string]expr.Func{}
+	for name, points := range p.Lookups {
+		// Expressions are case-insensitive
+		name = strings.ToLower(name)
+		if _, ok := byteFuncs[name]; ok {
+			return fmt.Errorf("lookup %q has the same name as a byte helper", name)
+		}
+		if _, err := expr.Interpolate(points, 0); err != nil {
+			return fmt.Errorf("lookup %q: %w", name, err)
+		}
+		p.lookups[name] = func(args ...float64) (float64, error) {
+			if len(args) != 1 {
+				return 0, fmt.Errorf("expected 1 argument, got %d", len(args))
+			}
+			return expr.Interpolate(points, args[0])
+		}
+	}
+
+	p.dids = map[uint32]*DID{}
+	for _, d := range p.DIDs {
+		if _, ok := p.dids[uint32(d.DID)]; ok {
+			return fmt.Errorf("DID %s defined twice", d.DID)
+		}
+		p.dids[uint32(d.DID)] = d
+		for _, v := range d.Values {
+			stream := streams[v.Stream]
+			if stream == nil {
+				return fmt.Errorf("DID %s: unknown stream %q", d.DID, v.Stream)
+			}
+			v.streamKey = v.Stream
+			if stream.PerCylinder {
+				if v.Cylinder < 0 || v.Cylinder > p.cylinders() {
+					return fmt.Errorf("DID %s: cylinder %d of %d", d.DID, v.Cylinder, p.cylinders())
+				}
+				v.streamKey = p.CylinderStreamKey(v.Stream, max(v.Cylinder, 1))
+			} else if v.Cylinder != 0 {
+				return fmt.Errorf("DID %s: stream %q isn't per-cylinder", d.DID, v.Stream)
+			}
+			switch v.Bits {
+			case 0, 8, 16, 32:
+			default:
+				return fmt.Errorf("DID %s: unsupported value size %d bits", d.DID, v.Bits)
+			}
+			v.usesRaw = true
+			if v.Expr == "" {
+				continue
+			}
+			expression, err := expr.Parse(v.Expr)
+			if err != nil {
+				return fmt.Errorf("DID %s: %w", d.DID, err)
+			}
+			// Catch typos now rather than silently dropping every value at runtime
+			v.usesRaw = false
+			for _, name := range expression.Vars() {
+				if !didVars[name] {
+					return fmt.Errorf("DID %s: unknown variable %q in %q", d.DID, name, v.Expr)
+				}
+				v.usesRaw = v.usesRaw || name != "len"
+			}
+			for _, name := range expression.Funcs() {
+				_, isByteFunc := byteFuncs[name]
+				_, isLookup := p.lookups[name]
+				if !isByteFunc && !isLookup {
+					return fmt.Errorf("DID %s: unknown function %q in %q", d.DID, name, v.Expr)
+				}
+			}
+			v.expression = expression
+		}
+	}
+	return nil
+}
+
+// PolledDIDs returns the DIDs with a poll interval, in the order they're defined.
+func (p *Profile) PolledDIDs() []uint32 {
+	var dids []uint32
+	for _, d := range p.DIDs {
+		if d.Poll > 0 {
+			dids = append(dids, uint32(d.DID))
+		}
+	}
+	return dids
+}
+
+func (p *Profile) PollInterval(did uint32) time.Duration {
+	if d, ok := p.dids[did]; ok {
+		return time.Duration(d.Poll)
+	}
+	return 0
+}
+
+// DIDName names a DID from the profile or the standard identification DIDs, or returns "" if neither knows it.
+func (p *Profile) DIDName(did uint32) string {
+	if d, ok := p.dids[did]; ok {
+		return d.Name
+	}
+	for _, d := range IdentificationDIDs {
+		if uint32(d.DID) == did {
+			return d.Name
+		}
+	}
+	return ""
+}
+
+// Secured reports whether the ECU has to be unlocked before it's polled.
+func (p *Profile) Secured() bool {
+	return p.Security.Algorithm != ""
+}
+
+// GenerateKey answers a security access seed with the profile's algorithm.
+func (p *Profile) GenerateKey(level SecurityLevel, seedHi, seedLo byte) (keyHi, keyLo byte, err error) {
+	algorithm, ok := keyAlgorithm(p.Security.Algorithm)
+	if !ok {
+		return 0, 0, fmt.Errorf("profile %s has no security algorithm", p.Name)
+	}
+	return algorithm(level, seedHi, seedLo)
+}
+
+// Unlock walks the ECU up through the profile's unlock levels, which is what reading and writing memory needs.
+func (p *Profile) Unlock(ctx context.Context, client *uds.Client) error {
+	if !p.Secured() {
+		return nil
+	}
+	levels := p.Security.UnlockLevels
+	if len(levels) == 0 {
+		levels = []SecurityLevel{p.Security.Level}
+	}
+	for _, level := range levels {
+		subFunction := SeedSubFunction(level)
+		err := client.SecurityAccess(ctx, subFunction, func(seed []byte) ([]byte, error) {
+			if len(seed) != 2 {
+				return nil, fmt.Errorf("expected a 2 byte seed, got % X", seed)
+			}
+			keyHi, keyLo, err := p.GenerateKey(level, seed[0], seed[1])
+			return []byte{keyHi, keyLo}, err
+		})
+		if err != nil {
+			return fmt.Errorf("security access level %d: %w", subFunction, err)
+		}
+		log.Printf("Security access level %d granted", subFunction)
+	}
+	return nil
+}
+
+// Dashboard builds the profile's streams and charts.
+func (p *Profile) Dashboard() (map[string]*models.Stream, map[string]*models.Chart) {
+	streams := map[string]*models.Stream{}
+	// Charts list stream definitions, which are every cylinder's stream for per-cylinder ones
+	expanded := map[string][]*models.Stream{}
+	for _, s := range p.Streams {
+		for _, stream := range p.cylinderStreams(s) {
+			streams[stream.Key()] = stream
+			expanded[s.Key] = append(expanded[s.Key], stream)
+		}
+		if p.balanced[s.Key] {
+			stream := p.balanceStream(s)
+			streams[stream.Key()] = stream
+		}
+	}
+	charts := map[string]*models.Chart{}
+	for _, c := range p.Charts {
+		var chartStreams []*models.Stream
+		for _, key := range c.Streams {
+			chartStreams = append(chartStreams, expanded[key]...)
+		}
+		if c.Balance {
+			for _, key := range c.Streams {
+				if stream, ok := streams[BalanceStreamKey(key)]; ok && p.balanced[key] {
+					chartStreams = append(chartStreams, stream)
+				}
+			}
+		}
+		charts[p.keyPrefix+c.Key] = models.NewChart(p.keyPrefix+c.Key, chartStreams, c.Priority)
+	}
+	return streams, charts
+}
+
+func (p *Profile) ParseDIDBytes(did uint32, dataBytes []byte) []*DIDData {
+	d, ok := p.dids[did]
+	if !ok {
+		if p.decoder == nil {
+			return []*DIDData{}
+		}
+		didData := p.decoder.ParseDIDBytes(did, dataBytes)
+		if p.keyPrefix != "" {
+			for _, datum := range didData {
+				datum.StreamKey = p.keyPrefix + datum.StreamKey
+			}
+		}
+		return didData
+	}
+	var didData []*DIDData
+	for _, v := range d.Values {
+		value, ok := v.decode(dataBytes, p.lookups)
+		if !ok {
+			continue
+		}
+		didData = append(didData, &DIDData{p.keyPrefix + v.streamKey, value})
+		if p.balanced[v.Stream] {
+			if balance, ok := p.values.update(v.Stream, p.cylinders(), max(v.Cylinder, 1), value); ok {
+				if v.Decimals != nil {
+					balance = utils.RoundToXDp(balance, *v.Decimals)
+				}
+				didData = append(didData, &DIDData{p.keyPrefix + BalanceStreamKey(v.Stream), balance})
+			}
+		}
+	}
+	return didData
+}
+
+// decode works the value out of data, ok is false if data is too short or the expression fails.
+func (v *DIDValue) decode(data []byte, lookups map[string]expr.Func) (value float64, ok bool) {
+	var raw float64
+	if v.usesRaw {
+		if raw, ok = v.raw(data); !ok {
+			return 0, false
+		}
+	}
+	value = raw
+	if v.expression != nil {
+		funcs := expr.ByteFuncs(data)
+		maps.Copy(funcs, lookups)
+		env := &expr.Env{
+			Vars:  map[string]float64{"raw": raw, "x": raw, "len": float64(len(data))},
+			Funcs: funcs,
+		}
+		var err error
+		if value, err = v.expression.Eval(env); err != nil {
+			return 0, false
+		}
+	}
+	if v.Decimals != nil {
+		value = utils.RoundToXDp(value, *v.Decimals)
+	}
+	return value, true
+}
+
+// raw reads the number at Offset and Bits.
+func (v *DIDValue) raw(data []byte) (value float64, ok bool) {
+	offset := v.Offset
+	if offset < 0 {
+		offset += len(data)
+	}
+	size := v.Bits / 8
+	if size == 0 {
+		size = len(data) - offset
+	}
+	if offset < 0 || size <= 0 || offset+size > len(data) {
+		return 0, false
+	}
+	b := slices.Clone(data[offset : offset+size])
+	if v.LittleEndian {
+		slices.Reverse(b)
+	}
+	var raw uint64
+	for _, x := range b {
+		raw = raw<<8 | uint64(x)
+	}
+	if v.Signed && size < 8 {
+		// sign extend from the top bit of the value
+		shift := 64 - 8*size
+		return float64(int64(raw<<shift) >> shift), true
+	}
+	return float64(raw), true
+}
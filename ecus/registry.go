@@ -0,0 +1,134 @@
+package ecus
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// DEFAULT_ECU is the registered profile used when no ECU is picked, or when AUTO_ECU can't identify the ECU.
+const DEFAULT_ECU = "k701"
+
+// AUTO_ECU picks the profile from the ECU's identification DIDs, see IdentifyProfile.
+const AUTO_ECU = "auto"
+
+// KeyAlgorithm answers a 2 byte security access seed for a level.
+type KeyAlgorithm func(level SecurityLevel, seedHi, seedLo byte) (keyHi, keyLo byte, err error)
+
+// Registration is a named ECU profile that can be picked with -ecu.
+type Registration struct {
+	Name string
+	load func() (*Profile, error)
+}
+
+var (
+	registryMu    sync.Mutex
+	registrations = map[string]*Registration{}
+	keyAlgorithms = map[string]KeyAlgorithm{}
+	decoders      = map[string]ECUProcessor{}
+)
+
+func init() {
+	RegisterKeyAlgorithm("k701", GenerateK701Key)
+
+	// Every built-in profile is registered under its file name
+	files, err := fs.Glob(builtinProfiles, "profiles/*.json")
+	if err != nil {
+		panic(err)
+	}
+	for _, file := range files {
+		Register(strings.TrimSuffix(path.Base(file), ".json"), func() (*Profile, error) {
+			data, err := builtinProfiles.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			return ParseProfile(data)
+		})
+	}
+}
+
+// Register adds a profile that can be picked by name, load is called every time it's picked so each caller gets
+// their own copy.
+func Register(name string, load func() (*Profile, error)) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registrations[strings.ToLower(name)] = &Registration{name, load}
+}
+
+// RegisterKeyAlgorithm adds a seed/key algorithm profiles can name in security.algorithm.
+func RegisterKeyAlgorithm(name string, algorithm KeyAlgorithm) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	keyAlgorithms[strings.ToLower(name)] = algorithm
+}
+
+// RegisterDecoder adds a Go ECUProcessor profiles can name in decoder, for DIDs too awkward to describe with
+// expressions. It's handed any DID the profile doesn't define itself.
+func RegisterDecoder(name string, decoder ECUProcessor) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	decoders[strings.ToLower(name)] = decoder
+}
+
+// Registered returns the names of every registered profile, sorted.
+func Registered() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	var names []string
+	for _, r := range registrations {
+		names = append(names, r.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Describe lists every registered profile with its description, one per line.
+func Describe() string {
+	var b strings.Builder
+	for _, name := range Registered() {
+		profile, err := Lookup(name)
+		if err != nil {
+			fmt.Fprintf(&b, "%-10s %v\n", name, err)
+			continue
+		}
+		experimental := ""
+		if profile.Experimental {
+			experimental = " (experimental)"
+		}
+		fmt.Fprintf(&b, "%-10s %s%s: %s\n", name, profile.Name, experimental, profile.Description)
+	}
+	return b.String()
+}
+
+// Lookup loads a registered profile by name.
+func Lookup(name string) (*Profile, error) {
+	registryMu.Lock()
+	r, ok := registrations[strings.ToLower(name)]
+	registryMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown ECU %q, expected one of %s", name, strings.Join(Registered(), ", "))
+	}
+	profile, err := r.load()
+	if err != nil {
+		return nil, fmt.Errorf("ECU %s: %w", r.Name, err)
+	}
+	profile.Registration = r.Name
+	return profile, nil
+}
+
+func keyAlgorithm(name string) (KeyAlgorithm, bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	algorithm, ok := keyAlgorithms[strings.ToLower(name)]
+	return algorithm, ok
+}
+
+func decoder(name string) (ECUProcessor, bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	d, ok := decoders[strings.ToLower(name)]
+	return d, ok
+}
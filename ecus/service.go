@@ -0,0 +1,134 @@
+package ecus
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Services a profile can poll its DIDs with.
+const (
+	// SERVICE_UDS reads DIDs with UDS ReadDataByIdentifier, it's the default.
+	SERVICE_UDS = "uds"
+	// SERVICE_OBD reads OBD-II (SAE J1979) service 01 PIDs, the profile's DIDs are PIDs.
+	SERVICE_OBD = "obd"
+	// SERVICE_BROADCAST doesn't poll anything, it decodes frames other modules broadcast and the DIDs are CAN IDs.
+	// See LoadDBC.
+	SERVICE_BROADCAST = "broadcast"
+)
+
+const (
+	sidReadDataByIdentifier = 0x22
+	sidOBDCurrentData       = 0x01
+	positiveResponseOffset  = 0x40
+	// obdPIDsPerBitmap is how many PIDs each of the support PIDs 0x00, 0x20, 0x40... covers.
+	obdPIDsPerBitmap = 0x20
+)
+
+func (p *Profile) service() string {
+	if p.Service == "" {
+		return SERVICE_UDS
+	}
+	return p.Service
+}
+
+// UDS reports whether the ECU is talked to with UDS, which has identification DIDs and sessions to keep alive.
+func (p *Profile) UDS() bool {
+	return p.service() == SERVICE_UDS
+}
+
+// Request builds the single frame request that reads did.
+func (p *Profile) Request(did uint32) []byte {
+	if p.service() == SERVICE_OBD {
+		return []byte{sidOBDCurrentData, byte(did)}
+	}
+	return []byte{sidReadDataByIdentifier, byte(did >> 8), byte(did)}
+}
+
+// Response returns the data in a positive response to Request(did), ok is false for anything else.
+func (p *Profile) Response(did uint32, response []byte) (data []byte, ok bool) {
+	if p.service() == SERVICE_OBD {
+		if len(response) >= 2 && response[0] == sidOBDCurrentData+positiveResponseOffset && response[1] == byte(did) {
+			return response[2:], true
+		}
+		return nil, false
+	}
+	if len(response) >= 3 && response[0] == sidReadDataByIdentifier+positiveResponseOffset &&
+		response[1] == byte(did>>8) && response[2] == byte(did) {
+		return response[3:], true
+	}
+	return nil, false
+}
+
+// ResponseDID is Response for a response whose request wasn't seen, e.g. in a capture from another tool, the DID is
+// read from the response itself.
+func (p *Profile) ResponseDID(response []byte) (did uint32, data []byte, ok bool) {
+	switch {
+	case p.service() == SERVICE_OBD && len(response) >= 2:
+		did = uint32(response[1])
+	case p.service() == SERVICE_UDS && len(response) >= 3:
+		did = uint32(response[1])<<8 | uint32(response[2])
+	default:
+		return 0, nil, false
+	}
+	data, ok = p.Response(did, response)
+	return did, data, ok
+}
+
+// SupportedPIDs asks an OBD-II ECU which service 01 PIDs it supports. PID 0x00 is a bitmap of PIDs 0x01-0x20, and
+// when PID 0x20 is set in it PID 0x20 is the bitmap of 0x21-0x40, and so on. read sends Request(pid) and returns the
+// response's data.
+func SupportedPIDs(read func(pid uint32) ([]byte, error)) (map[uint32]bool, error) {
+	supported := map[uint32]bool{}
+	for base := uint32(0); base < 0x100; base += obdPIDsPerBitmap {
+		bitmap, err := read(base)
+		if err != nil {
+			if base == 0 {
+				return nil, fmt.Errorf("PID 0x00: %w", err)
+			}
+			// Support for the next bitmap was claimed but it didn't answer, keep what we have
+			return supported, nil
+		}
+		if len(bitmap) < 4 {
+			return nil, fmt.Errorf("PID 0x%02X: expected a 4 byte bitmap, got % X", base, bitmap)
+		}
+		for i := uint32(0); i < obdPIDsPerBitmap; i++ {
+			// The most significant bit of the first byte is PID base+1
+			if bitmap[i/8]&(0x80>>(i%8)) != 0 {
+				supported[base+i+1] = true
+			}
+		}
+		if !supported[base+obdPIDsPerBitmap] {
+			break
+		}
+	}
+	return supported, nil
+}
+
+// validateService checks the profile's DIDs fit the service it polls them with.
+func (p *Profile) validateService() error {
+	switch p.service() {
+	case SERVICE_UDS:
+	case SERVICE_OBD:
+		for _, d := range p.DIDs {
+			if d.DID > 0xFF {
+				return fmt.Errorf("DID %s: OBD-II PIDs are one byte", d.DID)
+			}
+			if d.DID%obdPIDsPerBitmap == 0 {
+				return fmt.Errorf("DID %s: PIDs 0x00, 0x20, 0x40... are support bitmaps", d.DID)
+			}
+		}
+		if p.Secured() {
+			return errors.New("OBD-II ECUs don't need security access")
+		}
+	case SERVICE_BROADCAST:
+		if p.Secured() {
+			return errors.New("broadcast frames don't need security access")
+		}
+		if _, ok := p.decoder.(*dbcDecoder); !ok {
+			return errors.New("broadcast profiles are loaded from DBC files")
+		}
+	default:
+		return fmt.Errorf("unknown service %q, expected %s, %s or %s", p.Service, SERVICE_UDS, SERVICE_OBD, SERVICE_BROADCAST)
+	}
+	return nil
+}
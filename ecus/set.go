@@ -0,0 +1,139 @@
+package ecus
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+
+	"huskki/models"
+)
+
+// MAX_ECUS is how many ECUs a set can hold, logs tag frames with the ECU's index in a byte.
+const MAX_ECUS = 256
+
+// Set is every ECU a session talks to, e.g. the engine ECU and the ABS unit sharing the bus. The first is the main
+// ECU, logs and drivers tag everything else with its index in the set.
+type Set []*Profile
+
+// NewSet checks the profiles can share a bus and a dashboard: every ECU needs its own CAN IDs. Their streams and charts
+// are all merged onto one dashboard, so every ECU after the first has its keys prefixed with its name, e.g.
+// "bosch-abs-Wheel-Speed", and the first keeps the plain keys the dashboard and tracer look for.
+func NewSet(profiles ...*Profile) (Set, error) {
+	if len(profiles) == 0 {
+		return nil, errors.New("no ECUs")
+	}
+	if len(profiles) > MAX_ECUS {
+		return nil, fmt.Errorf("%d ECUs, at most %d are supported", len(profiles), MAX_ECUS)
+	}
+	responseIDs := map[uint32]string{}
+	prefixes := map[string]bool{}
+	streams := map[string]string{}
+	charts := map[string]string{}
+	for i, p := range profiles {
+		if p.Service != SERVICE_BROADCAST {
+			if other, ok := responseIDs[uint32(p.CAN.Response)]; ok {
+				return nil, fmt.Errorf("%s and %s both answer on %s", other, p.Name, p.CAN.Response)
+			}
+			responseIDs[uint32(p.CAN.Response)] = p.Name
+		}
+
+		if i > 0 {
+			prefix := keyPrefix(p)
+			// The same profile can be listed twice for two ECUs on different CAN IDs
+			if prefixes[prefix] {
+				prefix = fmt.Sprintf("%s%d-", prefix, i)
+			}
+			prefixes[prefix] = true
+			p.keyPrefix = prefix
+		}
+
+		// A profile can't define a key twice, so a clash here is a prefix running into another ECU's key
+		profileStreams, profileCharts := p.Dashboard()
+		for key := range profileStreams {
+			if other, ok := streams[key]; ok {
+				return nil, fmt.Errorf("%s and %s both have a stream %q", other, p.Name, key)
+			}
+			streams[key] = p.Name
+		}
+		for key := range profileCharts {
+			if other, ok := charts[key]; ok {
+				return nil, fmt.Errorf("%s and %s both have a chart %q", other, p.Name, key)
+			}
+			charts[key] = p.Name
+		}
+	}
+	return profiles, nil
+}
+
+// keyPrefix turns the profile's registered name, or its name if it was loaded from a file, into something that can go
+// in a stream key. Keys end up in HTML IDs and CSS selectors so only letters, digits and dashes are kept.
+func keyPrefix(p *Profile) string {
+	name := p.Registration
+	if name == "" {
+		name = p.Name
+	}
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-") + "-"
+}
+
+// LoadSet loads a comma separated list of ECUs, e.g. "auto,bosch-abs,dbc:bike.dbc", the same way Load loads one. If
+// paths is set it's a comma separated list of profile files that replaces names.
+func LoadSet(names, paths string) (Set, error) {
+	var profiles []*Profile
+	if paths != "" {
+		for _, path := range strings.Split(paths, ",") {
+			profile, err := Load("", strings.TrimSpace(path))
+			if err != nil {
+				return nil, err
+			}
+			profiles = append(profiles, profile)
+		}
+	} else {
+		for _, ecu := range strings.Split(names, ",") {
+			profile, err := Load(strings.TrimSpace(ecu), "")
+			if err != nil {
+				return nil, err
+			}
+			profiles = append(profiles, profile)
+		}
+	}
+	return NewSet(profiles...)
+}
+
+// ParseECUDIDBytes decodes a DID from the ECU at index ecu, DIDs from ECUs that aren't in the set are dropped.
+func (s Set) ParseECUDIDBytes(ecu uint8, did uint32, dataBytes []byte) []*DIDData {
+	if int(ecu) >= len(s) {
+		return []*DIDData{}
+	}
+	return s[ecu].ParseDIDBytes(did, dataBytes)
+}
+
+// Dashboard merges every ECU's streams and charts, NewSet has already prefixed their keys so they don't clash.
+func (s Set) Dashboard() (map[string]*models.Stream, map[string]*models.Chart) {
+	streams := map[string]*models.Stream{}
+	charts := map[string]*models.Chart{}
+	for _, p := range s {
+		profileStreams, profileCharts := p.Dashboard()
+		maps.Copy(streams, profileStreams)
+		maps.Copy(charts, profileCharts)
+	}
+	return streams, charts
+}
+
+// Names lists the profile names, for logging.
+func (s Set) Names() string {
+	var names []string
+	for _, p := range s {
+		names = append(names, p.Name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,66 @@
+package ecus
+
+import (
+	"strings"
+	"testing"
+
+	"huskki/utils"
+)
+
+func TestSetPrefixesSharedStreams(t *testing.T) {
+	first, err := Lookup("k701")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Lookup("k701")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.CAN = CANIDs{Request: 0x7E1, Response: 0x7E9}
+	set, err := NewSet(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streams, charts := set.Dashboard()
+	for _, key := range []string{"RPM", "k701-RPM"} {
+		if streams[key] == nil {
+			t.Errorf("no stream %q", key)
+		}
+		if charts[key] == nil {
+			t.Errorf("no chart %q", key)
+		}
+	}
+	for ecu, want := range []string{"RPM", "k701-RPM"} {
+		values := set.ParseECUDIDBytes(uint8(ecu), 0x0100, []byte{0x1B, 0x58})
+		if len(values) != 1 || values[0].StreamKey != want {
+			t.Errorf("ECU %d decoded RPM to %v, expected stream %q", ecu, values, want)
+		}
+	}
+}
+
+func TestSetPrefixesRepeatedProfiles(t *testing.T) {
+	var profiles []*Profile
+	for i := 0; i < 3; i++ {
+		profile, err := Lookup("bosch-abs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		profile.CAN.Response += utils.HexUint32(i)
+		profiles = append(profiles, profile)
+	}
+	if _, err := NewSet(profiles...); err != nil {
+		t.Fatal(err)
+	}
+	if profiles[1].keyPrefix == profiles[2].keyPrefix {
+		t.Fatalf("two ECUs prefixed with %q", profiles[1].keyPrefix)
+	}
+}
+
+func TestProfileStreamDefinedTwice(t *testing.T) {
+	profile := `{"name": "twice", "streams": [{"key": "RPM"}, {"key": "RPM"}]}`
+	_, err := ParseProfile([]byte(profile))
+	if err == nil || !strings.Contains(err.Error(), "defined twice") {
+		t.Fatalf("got %v, expected the stream defined twice", err)
+	}
+}
@@ -0,0 +1,108 @@
+package events
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"huskki/ecus"
+)
+
+// Frame is a frame read from an ECU, raw for loggers and decoded for the dashboard.
+type Frame struct {
+	// ECU is the ECU's position in the session's ecus.Set.
+	ECU  uint8
+	DID  uint32
+	Data []byte
+	// Millis is the frame's timestamp in the RAWLOG, the Arduino's millis or the time since the session started.
+	Millis uint32
+	// At is when the frame was read on the host's clock.
+	At time.Time
+	// Values is the frame decoded with the ECU's profile, empty when the profile doesn't know the DID.
+	Values []*ecus.DIDData
+}
+
+// Hub hands every frame a driver publishes to each of its subscribers: the dashboard, the loggers and anything else
+// that wants them. Each subscriber reads from its own buffer, so one stalling for a moment doesn't hold up the others
+// or the driver, but none of them lose frames: publishing waits once a buffer is full. Consumers that can fall behind
+// for good, like a network exporter, should keep up by dropping frames themselves. Publishing doesn't hold the hub's
+// lock while it waits, so subscribing and closing never wait on a stalled subscriber.
+type Hub struct {
+	mu   sync.RWMutex
+	subs []*Subscription
+}
+
+// Subscription is one consumer's buffered feed of frames.
+type Subscription struct {
+	hub    *Hub
+	frames chan Frame
+	// done closes when the subscription does, releasing publishes waiting on a full buffer.
+	done   chan struct{}
+	closed bool
+	// publishing counts the publishes that may still send to frames, it's only added to under the hub's lock.
+	publishing sync.WaitGroup
+}
+
+func NewHub() *Hub {
+	return &Hub{}
+}
+
+// Subscribe starts a feed of every frame published from now on, buffer frames deep.
+func (h *Hub) Subscribe(buffer int) *Subscription {
+	sub := &Subscription{
+		hub:    h,
+		frames: make(chan Frame, buffer),
+		done:   make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.subs = append(h.subs, sub)
+	h.mu.Unlock()
+	return sub
+}
+
+// Publish hands frame to every subscriber, waiting for room in their buffers unless they close. Subscribers share the
+// frame, none of them may change it.
+func (h *Hub) Publish(frame Frame) {
+	h.mu.RLock()
+	subs := slices.Clone(h.subs)
+	for _, sub := range subs {
+		sub.publishing.Add(1)
+	}
+	h.mu.RUnlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.frames <- frame:
+		case <-sub.done:
+		}
+		sub.publishing.Done()
+	}
+}
+
+// Frames is closed once the subscription is, after the frames already buffered.
+func (s *Subscription) Frames() <-chan Frame {
+	return s.frames
+}
+
+// Close stops the feed, Frames still returns what was buffered before it closes. Frames being published as it closes
+// may or may not make it into the buffer.
+func (s *Subscription) Close() {
+	h := s.hub
+	h.mu.Lock()
+	if s.closed {
+		h.mu.Unlock()
+		return
+	}
+	s.closed = true
+	for i, sub := range h.subs {
+		if sub == s {
+			h.subs = append(h.subs[:i], h.subs[i+1:]...)
+			break
+		}
+	}
+	h.mu.Unlock()
+
+	close(s.done)
+	s.publishing.Wait()
+	close(s.frames)
+}
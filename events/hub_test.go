@@ -0,0 +1,72 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+// within fails the test if f doesn't return in a second.
+func within(t *testing.T, what string, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s didn't return", what)
+	}
+}
+
+func TestHubCloseStalledSubscriber(t *testing.T) {
+	const frames = 10
+	hub := NewHub()
+	stalled := hub.Subscribe(1)
+	live := hub.Subscribe(frames)
+
+	published := make(chan struct{})
+	go func() {
+		for i := range frames {
+			hub.Publish(Frame{DID: uint32(i)})
+		}
+		close(published)
+	}()
+
+	// The second frame waits on the stalled subscriber's full buffer
+	select {
+	case <-published:
+		t.Fatal("published past a full buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+	within(t, "subscribing while a publish waits", func() {
+		hub.Subscribe(1).Close()
+	})
+	within(t, "closing the stalled subscriber", stalled.Close)
+	within(t, "publishing after the stalled subscriber closed", func() {
+		<-published
+	})
+
+	for i := range frames {
+		frame := <-live.Frames()
+		if frame.DID != uint32(i) {
+			t.Fatalf("live subscriber got frame %d, expected %d", frame.DID, i)
+		}
+	}
+	if frame := <-stalled.Frames(); frame.DID != 0 {
+		t.Fatalf("stalled subscriber's buffer held frame %d, expected 0", frame.DID)
+	}
+	if _, ok := <-stalled.Frames(); ok {
+		t.Fatal("stalled subscriber's frames still open after closing")
+	}
+
+	live.Close()
+	live.Close()
+	if _, ok := <-live.Frames(); ok {
+		t.Fatal("live subscriber's frames still open after closing")
+	}
+	within(t, "publishing with no subscribers", func() {
+		hub.Publish(Frame{})
+	})
+}
@@ -0,0 +1,42 @@
+package expr
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ByteFuncs returns functions that read integers out of data, for decoding raw responses: u8(i), s8(i), u16be(i),
+// u16le(i), s16be(i), s16le(i), u32be(i), u32le(i), s32be(i) and s32le(i). Negative offsets count back from the end,
+// so u8(-1) is the last byte.
+func ByteFuncs(data []byte) map[string]Func {
+	read := func(size int, decode func(b []byte) float64) Func {
+		return func(args ...float64) (float64, error) {
+			if len(args) != 1 {
+				return 0, fmt.Errorf("expected an offset, got %d arguments", len(args))
+			}
+			offset, err := toInt(args[0])
+			if err != nil {
+				return 0, err
+			}
+			if offset < 0 {
+				offset += int64(len(data))
+			}
+			if offset < 0 || offset+int64(size) > int64(len(data)) {
+				return 0, fmt.Errorf("%d bytes at %v is outside %d bytes of data", size, args[0], len(data))
+			}
+			return decode(data[offset : offset+int64(size)]), nil
+		}
+	}
+	return map[string]Func{
+		"u8":    read(1, func(b []byte) float64 { return float64(b[0]) }),
+		"s8":    read(1, func(b []byte) float64 { return float64(int8(b[0])) }),
+		"u16be": read(2, func(b []byte) float64 { return float64(binary.BigEndian.Uint16(b)) }),
+		"u16le": read(2, func(b []byte) float64 { return float64(binary.LittleEndian.Uint16(b)) }),
+		"s16be": read(2, func(b []byte) float64 { return float64(int16(binary.BigEndian.Uint16(b))) }),
+		"s16le": read(2, func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) }),
+		"u32be": read(4, func(b []byte) float64 { return float64(binary.BigEndian.Uint32(b)) }),
+		"u32le": read(4, func(b []byte) float64 { return float64(binary.LittleEndian.Uint32(b)) }),
+		"s32be": read(4, func(b []byte) float64 { return float64(int32(binary.BigEndian.Uint32(b))) }),
+		"s32le": read(4, func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) }),
+	}
+}
@@ -0,0 +1,568 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Func is a function callable from an expression.
+type Func func(args ...float64) (float64, error)
+
+// Env holds the variables and functions an expression is evaluated against. Names are case-insensitive.
+type Env struct {
+	Vars  map[string]float64
+	Funcs map[string]Func
+}
+
+// Expression is a parsed expression that can be evaluated any number of times. Parsing happens once up front so
+// evaluation never has to deal with syntax errors, and there are no loops or assignments so evaluation always
+// terminates.
+type Expression struct {
+	source string
+	root   node
+}
+
+// Parse parses an expression such as "X*0.5-40", "max(X, 0) / 1023 * 5" or "(X >> 4) & 0x0F". Operator precedence
+// follows Go rather than C, so "X & 0x80 == 0x80" does what it looks like.
+func Parse(source string) (*Expression, error) {
+	p := &parser{lexer: newLexer(source)}
+	p.next()
+	root, err := p.parseExpression(0)
+	if err != nil {
+		return nil, fmt.Errorf("parse %q: %w", source, err)
+	}
+	if p.token.kind != tokenEOF {
+		return nil, fmt.Errorf("parse %q: unexpected %q at %d", source, p.token.text, p.token.pos)
+	}
+	return &Expression{source, root}, nil
+}
+
+// MustParse is like Parse but panics on error, it's intended for expressions known at compile time.
+func MustParse(source string) *Expression {
+	e, err := Parse(source)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Eval evaluates the expression against env.
+func (e *Expression) Eval(env *Env) (float64, error) {
+	return e.root.eval(env)
+}
+
+// Vars returns the names of all variables referenced by the expression (lower case, without duplicates).
+func (e *Expression) Vars() []string {
+	seen := map[string]bool{}
+	var names []string
+	walk(e.root, func(n node) {
+		if v, ok := n.(varNode); ok && !seen[v.name] && !isConstant(v.name) {
+			seen[v.name] = true
+			names = append(names, v.name)
+		}
+	})
+	return names
+}
+
+// Funcs returns the names of all functions called by the expression that aren't builtins (lower case, without
+// duplicates), i.e. the ones the Env has to provide.
+func (e *Expression) Funcs() []string {
+	seen := map[string]bool{}
+	var names []string
+	walk(e.root, func(n node) {
+		if c, ok := n.(callNode); ok && !seen[c.name] && builtins[c.name] == nil && c.name != "if" {
+			seen[c.name] = true
+			names = append(names, c.name)
+		}
+	})
+	return names
+}
+
+// constants are fixed point scales ECUs commonly use, e.g. "X/q15" turns a Q15 value into a ratio.
+var constants = map[string]float64{
+	"q7":  1 << 7,
+	"q8":  1 << 8,
+	"q15": 1 << 15,
+	"q16": 1 << 16,
+	"pi":  math.Pi,
+}
+
+func isConstant(name string) bool {
+	_, ok := constants[name]
+	return ok
+}
+
+var builtins = map[string]Func{
+	"abs":   unary(math.Abs),
+	"floor": unary(math.Floor),
+	"ceil":  unary(math.Ceil),
+	"sqrt":  unary(math.Sqrt),
+	"log":   unary(math.Log),
+	"exp":   unary(math.Exp),
+	"round": func(args ...float64) (float64, error) {
+		switch len(args) {
+		case 1:
+			return math.Round(args[0]), nil
+		case 2:
+			e := math.Pow(10, args[1])
+			return math.Round(args[0]*e) / e, nil
+		}
+		return 0, fmt.Errorf("round takes 1 or 2 arguments, got %d", len(args))
+	},
+	"pow": func(args ...float64) (float64, error) {
+		if len(args) != 2 {
+			return 0, fmt.Errorf("pow takes 2 arguments, got %d", len(args))
+		}
+		return math.Pow(args[0], args[1]), nil
+	},
+	"min": func(args ...float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, fmt.Errorf("min needs at least 1 argument")
+		}
+		m := args[0]
+		for _, a := range args[1:] {
+			m = math.Min(m, a)
+		}
+		return m, nil
+	},
+	"max": func(args ...float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, fmt.Errorf("max needs at least 1 argument")
+		}
+		m := args[0]
+		for _, a := range args[1:] {
+			m = math.Max(m, a)
+		}
+		return m, nil
+	},
+	// bit(x, n) is bit n of x, 0 or 1
+	"bit": func(args ...float64) (float64, error) {
+		if len(args) != 2 {
+			return 0, fmt.Errorf("bit takes 2 arguments, got %d", len(args))
+		}
+		x, err := toInt(args[0])
+		if err != nil {
+			return 0, err
+		}
+		n, err := toShift(args[1])
+		if err != nil {
+			return 0, err
+		}
+		return float64(x >> n & 1), nil
+	},
+	// lookup(i, v0, v1, ...) is the i'th value, e.g. "lookup(X, 0, 1, 2, 2, 3)" for sensors reporting states
+	"lookup": func(args ...float64) (float64, error) {
+		if len(args) < 2 {
+			return 0, fmt.Errorf("lookup needs an index and at least 1 value")
+		}
+		i, err := toInt(args[0])
+		if err != nil {
+			return 0, err
+		}
+		if i < 0 || int(i) >= len(args)-1 {
+			return 0, fmt.Errorf("lookup index %d out of range for %d values", i, len(args)-1)
+		}
+		return args[i+1], nil
+	},
+	// lut(x, x0, y0, x1, y1, ...) interpolates x between breakpoints, clamping at the ends
+	"lut": func(args ...float64) (float64, error) {
+		if len(args) < 3 || len(args)%2 != 1 {
+			return 0, fmt.Errorf("lut takes x followed by x,y pairs")
+		}
+		points := make([][2]float64, 0, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			points = append(points, [2]float64{args[i], args[i+1]})
+		}
+		return Interpolate(points, args[0])
+	},
+}
+
+// Interpolate linearly interpolates x between points sorted by x, clamping to the first and last y.
+func Interpolate(points [][2]float64, x float64) (float64, error) {
+	if len(points) == 0 {
+		return 0, fmt.Errorf("no points to interpolate")
+	}
+	if x <= points[0][0] {
+		return points[0][1], nil
+	}
+	for i := 1; i < len(points); i++ {
+		if points[i][0] < points[i-1][0] {
+			return 0, fmt.Errorf("breakpoints must be increasing")
+		}
+		if x <= points[i][0] {
+			x0, y0, x1, y1 := points[i-1][0], points[i-1][1], points[i][0], points[i][1]
+			if x1 == x0 {
+				return y1, nil
+			}
+			return y0 + (x-x0)/(x1-x0)*(y1-y0), nil
+		}
+	}
+	return points[len(points)-1][1], nil
+}
+
+// toInt converts an operand of a bitwise operator, which only makes sense on whole numbers.
+func toInt(v float64) (int64, error) {
+	if v != math.Trunc(v) || math.Abs(v) > 1<<62 {
+		return 0, fmt.Errorf("bitwise operations need whole numbers, got %v", v)
+	}
+	return int64(v), nil
+}
+
+func toShift(v float64) (int64, error) {
+	n, err := toInt(v)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > 63 {
+		return 0, fmt.Errorf("shift of %d out of range", n)
+	}
+	return n, nil
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func unary(f func(float64) float64) Func {
+	return func(args ...float64) (float64, error) {
+		if len(args) != 1 {
+			return 0, fmt.Errorf("expected 1 argument, got %d", len(args))
+		}
+		return f(args[0]), nil
+	}
+}
+
+type node interface {
+	eval(env *Env) (float64, error)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(*Env) (float64, error) {
+	return float64(n), nil
+}
+
+type varNode struct {
+	name string
+}
+
+func (n varNode) eval(env *Env) (float64, error) {
+	if env != nil {
+		if v, ok := env.Vars[n.name]; ok {
+			return v, nil
+		}
+	}
+	if v, ok := constants[n.name]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown variable %q", n.name)
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n unaryNode) eval(env *Env) (float64, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case "-":
+		return -v, nil
+	case "+":
+		return v, nil
+	case "!":
+		return boolToFloat(v == 0), nil
+	case "~":
+		i, err := toInt(v)
+		if err != nil {
+			return 0, err
+		}
+		return float64(^i), nil
+	}
+	return 0, fmt.Errorf("unknown unary operator %q", n.op)
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n binaryNode) eval(env *Env) (float64, error) {
+	l, err := n.left.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	// && and || only evaluate the right side when they need it, like if
+	if n.op == "&&" && l == 0 || n.op == "||" && l != 0 {
+		return boolToFloat(l != 0), nil
+	}
+	r, err := n.right.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	case "%":
+		if r == 0 {
+			return 0, fmt.Errorf("modulo by zero")
+		}
+		return math.Mod(l, r), nil
+	case "==":
+		return boolToFloat(l == r), nil
+	case "!=":
+		return boolToFloat(l != r), nil
+	case "<":
+		return boolToFloat(l < r), nil
+	case "<=":
+		return boolToFloat(l <= r), nil
+	case ">":
+		return boolToFloat(l > r), nil
+	case ">=":
+		return boolToFloat(l >= r), nil
+	case "&&", "||":
+		return boolToFloat(r != 0), nil
+	}
+
+	// Everything else is bitwise
+	li, err := toInt(l)
+	if err != nil {
+		return 0, err
+	}
+	if n.op == "<<" || n.op == ">>" {
+		shift, err := toShift(r)
+		if err != nil {
+			return 0, err
+		}
+		if n.op == "<<" {
+			return float64(li << shift), nil
+		}
+		return float64(li >> shift), nil
+	}
+	ri, err := toInt(r)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case "&":
+		return float64(li & ri), nil
+	case "|":
+		return float64(li | ri), nil
+	case "^":
+		return float64(li ^ ri), nil
+	}
+	return 0, fmt.Errorf("unknown operator %q", n.op)
+}
+
+type callNode struct {
+	name string
+	args []node
+}
+
+func (n callNode) eval(env *Env) (float64, error) {
+	// if(condition, then, else) only evaluates the branch it takes, so the other one can be something that would fail,
+	// like reading a byte that isn't there
+	if n.name == "if" {
+		if len(n.args) != 3 {
+			return 0, fmt.Errorf("if takes 3 arguments, got %d", len(n.args))
+		}
+		condition, err := n.args[0].eval(env)
+		if err != nil {
+			return 0, err
+		}
+		if condition != 0 {
+			return n.args[1].eval(env)
+		}
+		return n.args[2].eval(env)
+	}
+
+	f, ok := builtins[n.name]
+	if env != nil {
+		if envFunc, found := env.Funcs[n.name]; found {
+			f, ok = envFunc, true
+		}
+	}
+	if !ok {
+		return 0, fmt.Errorf("unknown function %q", n.name)
+	}
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+	v, err := f(args...)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", n.name, err)
+	}
+	return v, nil
+}
+
+func walk(n node, visit func(node)) {
+	visit(n)
+	switch t := n.(type) {
+	case unaryNode:
+		walk(t.operand, visit)
+	case binaryNode:
+		walk(t.left, visit)
+		walk(t.right, visit)
+	case callNode:
+		for _, arg := range t.args {
+			walk(arg, visit)
+		}
+	}
+}
+
+// binary operator precedence, higher binds tighter, the same as Go
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3,
+	"!=": 3,
+	"<":  3,
+	"<=": 3,
+	">":  3,
+	">=": 3,
+	"+":  4,
+	"-":  4,
+	"|":  4,
+	"^":  4,
+	"*":  5,
+	"/":  5,
+	"%":  5,
+	"<<": 5,
+	">>": 5,
+	"&":  5,
+}
+
+type parser struct {
+	lexer *lexer
+	token token
+}
+
+func (p *parser) next() {
+	p.token = p.lexer.next()
+}
+
+// parseExpression is a precedence climbing parser for binary operators
+func (p *parser) parseExpression(minPrecedence int) (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.token.kind == tokenOperator {
+		op := p.token.text
+		prec, ok := precedence[op]
+		if !ok || prec < minPrecedence {
+			break
+		}
+		p.next()
+		right, err := p.parseExpression(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.token.kind == tokenOperator && (p.token.text == "-" || p.token.text == "+" || p.token.text == "~" || p.token.text == "!") {
+		op := p.token.text
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{op, operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.token
+	switch tok.kind {
+	case tokenNumber:
+		p.next()
+		return parseNumber(tok)
+	case tokenIdent:
+		p.next()
+		name := strings.ToLower(tok.text)
+		if p.token.kind != tokenLParen {
+			return varNode{name}, nil
+		}
+		p.next()
+		var args []node
+		if p.token.kind != tokenRParen {
+			for {
+				arg, err := p.parseExpression(0)
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+				if p.token.kind != tokenComma {
+					break
+				}
+				p.next()
+			}
+		}
+		if p.token.kind != tokenRParen {
+			return nil, fmt.Errorf("expected ) at %d", p.token.pos)
+		}
+		p.next()
+		return callNode{name, args}, nil
+	case tokenLParen:
+		p.next()
+		inner, err := p.parseExpression(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.token.kind != tokenRParen {
+			return nil, fmt.Errorf("expected ) at %d", p.token.pos)
+		}
+		p.next()
+		return inner, nil
+	case tokenEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+}
+
+func parseNumber(tok token) (node, error) {
+	text := strings.ToLower(tok.text)
+	if strings.HasPrefix(text, "0x") {
+		v, err := strconv.ParseUint(text[2:], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad hex number %q at %d", tok.text, tok.pos)
+		}
+		return numberNode(v), nil
+	}
+	v, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad number %q at %d", tok.text, tok.pos)
+	}
+	return numberNode(v), nil
+}
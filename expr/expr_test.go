@@ -0,0 +1,132 @@
+package expr
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	data := []byte{0x12, 0x34, 0xFF, 0xFE, 0x80, 0x00, 0x00, 0x01}
+	tests := []struct {
+		source string
+		x      float64
+		want   float64
+		err    string
+	}{
+		{"X*0.5-40", 200, 60, ""},
+		{"x * 0.5 - 40", 200, 60, ""},
+		{"-X + +3", 5, -2, ""},
+		{"(X + 1) * 2", 3, 8, ""},
+		{"10 - 4 - 3", 0, 3, ""},
+		{"2 * 3 % 4", 0, 2, ""},
+		{"X/q8", 512, 2, ""},
+		{"round(pi, 2)", 0, 3.14, ""},
+		{"max(X, 0) / 1023 * 5", -7, 0, ""},
+		{"min(4, 2, 3) + abs(-1) + floor(1.9) + ceil(0.1)", 0, 5, ""},
+		{"pow(2, 10)", 0, 1024, ""},
+		{"0x1F + 0X01", 0, 32, ""},
+		{"1.5e2", 0, 150, ""},
+
+		// bitwise and comparisons, with Go precedence
+		{"(X >> 4) & 0x0F", 0xAB, 0x0A, ""},
+		{"X & 0x80 == 0x80", 0x81, 1, ""},
+		{"X | 1 << 4", 1, 17, ""},
+		{"X ^ 0xFF", 0x0F, 0xF0, ""},
+		{"~X & 0xFF", 0x0F, 0xF0, ""},
+		{"bit(X, 3)", 8, 1, ""},
+		{"X >= 10", 10, 1, ""},
+		{"X != 10", 10, 0, ""},
+		{"X & 1.5", 3, 0, "whole numbers"},
+		{"X > 1 && X < 5", 3, 1, ""},
+		{"X > 1 && X < 5 || X == 10", 10, 1, ""},
+		{"!X", 0, 1, ""},
+		{"!(X == 3)", 3, 0, ""},
+		// && and || don't evaluate the side they don't need
+		{"X > 0 && u8(100)", 0, 0, ""},
+		{"X == 0 || u8(100)", 0, 1, ""},
+		{"X << 64", 1, 0, "out of range"},
+
+		// lookups
+		{"lookup(X, 10, 20, 30)", 2, 30, ""},
+		{"lookup(X, 10, 20, 30)", 3, 0, "out of range"},
+		{"lut(X, 0, 0, 10, 100, 20, 100)", 5, 50, ""},
+		{"lut(X, 0, 0, 10, 100)", 50, 100, ""},
+		{"lut(X, 0, 0, 10)", 5, 0, "x,y pairs"},
+
+		// bytes
+		{"u16be(0)", 0, 0x1234, ""},
+		{"u16le(0)", 0, 0x3412, ""},
+		{"s16be(2)", 0, -2, ""},
+		{"s8(4)", 0, -128, ""},
+		{"u32be(4)", 0, 0x80000001, ""},
+		{"s32be(4)", 0, -0x7FFFFFFF, ""},
+		{"u8(-1)", 0, 1, ""},
+		{"u8(8)", 0, 0, "outside 8 bytes"},
+		{"u16be(-1)", 0, 0, "outside 8 bytes"},
+
+		// if only evaluates the branch it takes
+		{"if(X > 0, u8(0), u8(100))", 1, 0x12, ""},
+		{"if(X > 0, u8(100), u8(0))", 0, 0x12, ""},
+		{"if(X, 1)", 0, 0, "3 arguments"},
+
+		{"X / 0", 1, 0, "division by zero"},
+		{"Y", 0, 0, "unknown variable"},
+		{"nope(X)", 0, 0, "unknown function"},
+		{"sqrt(1, 2)", 0, 0, "expected 1 argument"},
+	}
+	for _, test := range tests {
+		t.Run(test.source, func(t *testing.T) {
+			e, err := Parse(test.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := e.Eval(&Env{Vars: map[string]float64{"x": test.x}, Funcs: ByteFuncs(data)})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, %v, expected an error containing %q", got, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Fatalf("got %v, expected %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{"", "unexpected end"},
+		{"X +", "unexpected end"},
+		{"(X + 1", "expected )"},
+		{"max(X, 1", "expected )"},
+		{"X 1", "unexpected \"1\""},
+		{"0xZZ", "bad hex number"},
+		{"X $ 1", "unexpected"},
+	}
+	for _, test := range tests {
+		t.Run(test.source, func(t *testing.T) {
+			_, err := Parse(test.source)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got %v, expected an error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestVarsAndFuncs(t *testing.T) {
+	e := MustParse("if(len >= 2, u16be(0), u8(0)) * X / q15 + X + max(raw, 1)")
+	if vars := e.Vars(); !slices.Equal(vars, []string{"len", "x", "raw"}) {
+		t.Errorf("got vars %v", vars)
+	}
+	if funcs := e.Funcs(); !slices.Equal(funcs, []string{"u16be", "u8"}) {
+		t.Errorf("got funcs %v", funcs)
+	}
+}
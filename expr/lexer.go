@@ -0,0 +1,108 @@
+package expr
+
+import (
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenIdent
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenInvalid
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// operators are matched longest first
+var operators = []string{"&&", "||", "<<", ">>", "<=", ">=", "==", "!=", "!", "+", "-", "*", "/", "%", "&", "|", "^", "~", "<", ">"}
+
+type lexer struct {
+	source []rune
+	pos    int
+}
+
+func newLexer(source string) *lexer {
+	return &lexer{source: []rune(source)}
+}
+
+func (l *lexer) next() token {
+	for l.pos < len(l.source) && unicode.IsSpace(l.source[l.pos]) {
+		l.pos++
+	}
+	if l.pos >= len(l.source) {
+		return token{tokenEOF, "", l.pos}
+	}
+
+	start := l.pos
+	r := l.source[l.pos]
+	switch {
+	case unicode.IsDigit(r) || (r == '.' && l.pos+1 < len(l.source) && unicode.IsDigit(l.source[l.pos+1])):
+		return l.number(start)
+	case unicode.IsLetter(r) || r == '_':
+		for l.pos < len(l.source) && (unicode.IsLetter(l.source[l.pos]) || unicode.IsDigit(l.source[l.pos]) || l.source[l.pos] == '_') {
+			l.pos++
+		}
+		return token{tokenIdent, string(l.source[start:l.pos]), start}
+	case r == '(':
+		l.pos++
+		return token{tokenLParen, "(", start}
+	case r == ')':
+		l.pos++
+		return token{tokenRParen, ")", start}
+	case r == ',':
+		l.pos++
+		return token{tokenComma, ",", start}
+	}
+
+	rest := string(l.source[l.pos:])
+	for _, op := range operators {
+		if strings.HasPrefix(rest, op) {
+			l.pos += len([]rune(op))
+			return token{tokenOperator, op, start}
+		}
+	}
+	l.pos++
+	return token{tokenInvalid, string(r), start}
+}
+
+func (l *lexer) number(start int) token {
+	if l.source[l.pos] == '0' && l.pos+1 < len(l.source) && (l.source[l.pos+1] == 'x' || l.source[l.pos+1] == 'X') {
+		l.pos += 2
+		for l.pos < len(l.source) && isHexDigit(l.source[l.pos]) {
+			l.pos++
+		}
+		return token{tokenNumber, string(l.source[start:l.pos]), start}
+	}
+	for l.pos < len(l.source) && (unicode.IsDigit(l.source[l.pos]) || l.source[l.pos] == '.') {
+		l.pos++
+	}
+	// exponent, e.g. 1e-3
+	if l.pos < len(l.source) && (l.source[l.pos] == 'e' || l.source[l.pos] == 'E') {
+		end := l.pos + 1
+		if end < len(l.source) && (l.source[end] == '-' || l.source[end] == '+') {
+			end++
+		}
+		if end < len(l.source) && unicode.IsDigit(l.source[end]) {
+			l.pos = end
+			for l.pos < len(l.source) && unicode.IsDigit(l.source[l.pos]) {
+				l.pos++
+			}
+		}
+	}
+	return token{tokenNumber, string(l.source[start:l.pos]), start}
+}
+
+func isHexDigit(r rune) bool {
+	return unicode.IsDigit(r) || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+}
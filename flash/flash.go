@@ -0,0 +1,228 @@
+package flash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"huskki/expr"
+	"huskki/rom"
+	"huskki/uds"
+)
+
+// DID_ECU_HARDWARE_NUMBER is the standard UDS hardware number identifier.
+const DID_ECU_HARDWARE_NUMBER = 0xF191
+
+const (
+	// verifyChunkLength is how much memory is read back at a time, the same as cmd/dumper reads.
+	verifyChunkLength = 0x80
+	// abortTimeout is how long to try putting the ECU back in the default session after a failed write.
+	abortTimeout = 2 * time.Second
+)
+
+// Options describe what to write and the checks that have to pass first.
+type Options struct {
+	// Start and End bound the part of the image that's written, the rest of the ECU is left alone.
+	Start, End uint32
+
+	HardwareIDDid uint16
+	// HardwareID is what the ECU has to report before anything is written to it.
+	HardwareID string
+
+	BatteryDid uint16
+	// BatteryExpr scales the battery DID, read as a big endian integer X, to volts.
+	BatteryExpr       string
+	MinBatteryVoltage float64
+
+	// Checksums the image has to pass, fix them with cmd/checksum first.
+	Checksums *rom.ChecksumSpec
+
+	// Unlock gets the ECU to the security level writing needs, e.g. an ECU profile's Unlock.
+	Unlock func(ctx context.Context, client *uds.Client) error
+	// Progress is called after every block with how much of the write is done, 0..1.
+	Progress func(done float64)
+}
+
+// Flasher writes images to an ECU with RequestDownload, TransferData and RequestTransferExit.
+type Flasher struct {
+	client  *uds.Client
+	options Options
+	battery *expr.Expression
+}
+
+func New(client *uds.Client, options Options) (*Flasher, error) {
+	if options.End <= options.Start {
+		return nil, fmt.Errorf("empty range 0x%06X-0x%06X", options.Start, options.End)
+	}
+	if options.Unlock == nil {
+		return nil, errors.New("no security unlock")
+	}
+	battery, err := expr.Parse(options.BatteryExpr)
+	if err != nil {
+		return nil, fmt.Errorf("battery expression: %w", err)
+	}
+	return &Flasher{client, options, battery}, nil
+}
+
+// Preflight checks the image and the ECU without changing anything on either: the image's checksums, the ECU's
+// hardware ID and the battery voltage, since losing power halfway through a write can brick the ECU.
+func (f *Flasher) Preflight(ctx context.Context, image *rom.Image) error {
+	if int(f.options.End) > image.Len() {
+		return fmt.Errorf("range 0x%06X-0x%06X runs past the end of the %d byte image", f.options.Start, f.options.End, image.Len())
+	}
+
+	if f.options.Checksums == nil {
+		return errors.New("no checksum spec, identify one with cmd/checksum")
+	}
+	for _, region := range f.options.Checksums.Regions {
+		ok, computed, stored, err := region.Verify(image)
+		if err != nil {
+			return fmt.Errorf("checksum %s: %w", region, err)
+		}
+		if !ok {
+			return fmt.Errorf("checksum %s: computed 0x%X stored 0x%X, fix it with cmd/checksum", region, computed, stored)
+		}
+	}
+	log.Printf("preflight: %d checksums ok", len(f.options.Checksums.Regions))
+
+	if f.options.HardwareID == "" {
+		return errors.New("no expected hardware ID")
+	}
+	data, err := f.client.ReadDataByIdentifier(ctx, f.options.HardwareIDDid)
+	if err != nil {
+		return fmt.Errorf("read hardware ID: %w", err)
+	}
+	hardwareID := strings.TrimSpace(strings.Trim(string(data), "\x00"))
+	if hardwareID != f.options.HardwareID {
+		return fmt.Errorf("ECU hardware ID is %q, expected %q", hardwareID, f.options.HardwareID)
+	}
+	log.Printf("preflight: hardware ID %q", hardwareID)
+
+	data, err = f.client.ReadDataByIdentifier(ctx, f.options.BatteryDid)
+	if err != nil {
+		return fmt.Errorf("read battery voltage: %w", err)
+	}
+	var raw float64
+	for _, b := range data {
+		raw = raw*256 + float64(b)
+	}
+	volts, err := f.battery.Eval(&expr.Env{Vars: map[string]float64{"x": raw}})
+	if err != nil {
+		return fmt.Errorf("battery expression: %w", err)
+	}
+	if volts < f.options.MinBatteryVoltage {
+		return fmt.Errorf("battery is at %.2fV, needs at least %.2fV", volts, f.options.MinBatteryVoltage)
+	}
+	log.Printf("preflight: battery %.2fV", volts)
+	return nil
+}
+
+// Flash runs the preflight checks then writes the image's range to the ECU, reads it back to check it went in and
+// resets the ECU. If anything fails once the ECU has left its default session it's put back there.
+func (f *Flasher) Flash(ctx context.Context, image *rom.Image) error {
+	if err := f.Preflight(ctx, image); err != nil {
+		return fmt.Errorf("preflight: %w", err)
+	}
+	if err := f.write(ctx, image); err != nil {
+		f.abort(ctx)
+		return err
+	}
+	return nil
+}
+
+// abort puts the ECU back in the default session, which abandons the download, rather than leave it waiting in the
+// programming session until its power is cycled. ctx may already be cancelled, that's often why the write failed.
+func (f *Flasher) abort(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+	defer cancel()
+	if err := f.client.DiagnosticSessionControl(ctx, uds.SessionDefault); err != nil {
+		log.Printf("couldn't put the ECU back in the default session: %v", err)
+		return
+	}
+	log.Printf("write failed, ECU back in the default session")
+}
+
+func (f *Flasher) write(ctx context.Context, image *rom.Image) error {
+	// Programming can only be entered from the extended session, and entering it locks the ECU again
+	if err := f.client.DiagnosticSessionControl(ctx, uds.SessionExtended); err != nil {
+		return fmt.Errorf("extended session: %w", err)
+	}
+	if err := f.client.DiagnosticSessionControl(ctx, uds.SessionProgramming); err != nil {
+		return fmt.Errorf("programming session: %w", err)
+	}
+	if err := f.options.Unlock(ctx, f.client); err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+
+	if err := f.download(ctx, image); err != nil {
+		return err
+	}
+	if err := f.Verify(ctx, image); err != nil {
+		return err
+	}
+	if err := f.client.EcuReset(ctx, uds.ResetHard); err != nil {
+		return fmt.Errorf("reset: %w", err)
+	}
+	return nil
+}
+
+func (f *Flasher) download(ctx context.Context, image *rom.Image) error {
+	size := f.options.End - f.options.Start
+	data, err := image.Slice(int(f.options.Start), int(size))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("requesting download of %d bytes at 0x%06X", size, f.options.Start)
+	maxBlockLength, err := f.client.RequestDownload(ctx, f.options.Start, size)
+	if err != nil {
+		return fmt.Errorf("request download: %w", err)
+	}
+	// The max block length counts the service ID and block sequence counter
+	blockLength := maxBlockLength - 2
+	if blockLength <= 0 {
+		return fmt.Errorf("ECU accepts blocks of %d bytes", maxBlockLength)
+	}
+
+	// The block sequence counter starts at 1 and wraps to 0
+	sequence := byte(1)
+	for offset := 0; offset < len(data); offset += blockLength {
+		block := data[offset:min(offset+blockLength, len(data))]
+		if err = f.client.TransferData(ctx, sequence, block); err != nil {
+			return fmt.Errorf("transfer block %d at 0x%06X: %w", sequence, int(f.options.Start)+offset, err)
+		}
+		sequence++
+		if f.options.Progress != nil {
+			f.options.Progress(float64(offset+len(block)) / float64(len(data)))
+		}
+	}
+
+	if err = f.client.RequestTransferExit(ctx); err != nil {
+		return fmt.Errorf("request transfer exit: %w", err)
+	}
+	return nil
+}
+
+// Verify reads the range back from the ECU and compares it to the image.
+func (f *Flasher) Verify(ctx context.Context, image *rom.Image) error {
+	for address := f.options.Start; address < f.options.End; address += verifyChunkLength {
+		length := min(verifyChunkLength, f.options.End-address)
+		want, err := image.Slice(int(address), int(length))
+		if err != nil {
+			return err
+		}
+		got, err := f.client.ReadMemoryByAddress(ctx, address, uint8(length))
+		if err != nil {
+			return fmt.Errorf("read back 0x%06X: %w", address, err)
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("verify failed at 0x%06X: ECU has % X, image has % X", address, got, want)
+		}
+	}
+	log.Printf("verified 0x%06X-0x%06X", f.options.Start, f.options.End)
+	return nil
+}
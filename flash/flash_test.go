@@ -0,0 +1,153 @@
+package flash
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"huskki/ecus"
+	"huskki/rom"
+	"huskki/sim"
+	"huskki/uds"
+)
+
+const (
+	testImageLen    = 0x1000
+	testHardwareID  = "TEST-ECU"
+	testHardwareDid = DID_ECU_HARDWARE_NUMBER
+	testBatteryDid  = 0x0201
+)
+
+// testImage returns an image with a checksum over all but its last two bytes, and the spec that checks it.
+func testImage(t *testing.T, seed byte) (*rom.Image, *rom.ChecksumSpec) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "spec.json")
+	spec := `{"name": "test", "regions": [{"start": "0x000000", "end": "0x000FFE", "store": "0x000FFE", "algorithm": "sum16-bytes"}]}`
+	if err := os.WriteFile(path, []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	checksums, err := rom.LoadChecksumSpec(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, testImageLen)
+	for i := range data {
+		data[i] = byte(i) ^ seed
+	}
+	image := rom.NewImage(data)
+	if err = checksums.Fix(image); err != nil {
+		t.Fatal(err)
+	}
+	return image, checksums
+}
+
+func testECU(memory []byte, millivolts int) *sim.ECU {
+	ecu := sim.NewECU(memory, map[uint16][]byte{
+		testHardwareDid: []byte(testHardwareID),
+		testBatteryDid:  {byte(millivolts >> 8), byte(millivolts)},
+	})
+	ecu.EraseDelay = 0
+	return ecu
+}
+
+func testFlasher(t *testing.T, transport uds.Transport, checksums *rom.ChecksumSpec) *Flasher {
+	t.Helper()
+	profile, err := ecus.Lookup("k701")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flasher, err := New(uds.NewClient(transport), Options{
+		Start:             0,
+		End:               testImageLen,
+		HardwareIDDid:     testHardwareDid,
+		HardwareID:        testHardwareID,
+		BatteryDid:        testBatteryDid,
+		BatteryExpr:       "x/1000",
+		MinBatteryVoltage: 12,
+		Checksums:         checksums,
+		Unlock:            profile.Unlock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flasher
+}
+
+func TestFlashPreflightFailsWithoutWriting(t *testing.T) {
+	original, _ := testImage(t, 0x00)
+	image, checksums := testImage(t, 0x5A)
+	ecu := testECU(original.Bytes(), 11500)
+
+	err := testFlasher(t, ecu, checksums).Flash(context.Background(), image)
+	if err == nil {
+		t.Fatal("flashed with the battery at 11.5V")
+	}
+	if !bytes.Equal(ecu.Memory(), original.Bytes()) {
+		t.Fatal("ECU memory changed by a flash that failed preflight")
+	}
+}
+
+func TestFlashWritesImage(t *testing.T) {
+	original, _ := testImage(t, 0x00)
+	image, checksums := testImage(t, 0x5A)
+	ecu := testECU(original.Bytes(), 13200)
+
+	var progress []float64
+	flasher := testFlasher(t, ecu, checksums)
+	flasher.options.Progress = func(done float64) {
+		progress = append(progress, done)
+	}
+	if err := flasher.Flash(context.Background(), image); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ecu.Memory(), image.Bytes()) {
+		t.Fatal("ECU doesn't hold the image after flashing")
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != 1 {
+		t.Fatalf("progress %v doesn't finish at 1", progress)
+	}
+}
+
+// failingTransfer is a sim.ECU that answers one TransferData block with a negative response.
+type failingTransfer struct {
+	*sim.ECU
+	sequence byte
+	failed   chan []byte
+}
+
+func (f *failingTransfer) Send(ctx context.Context, payload []byte) error {
+	if len(payload) > 1 && payload[0] == uds.SidTransferData && payload[1] == f.sequence {
+		f.failed <- []byte{uds.NegativeResponse, uds.SidTransferData, uds.NrcGeneralProgrammingFailure}
+		return nil
+	}
+	return f.ECU.Send(ctx, payload)
+}
+
+func (f *failingTransfer) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case response := <-f.failed:
+		return response, nil
+	default:
+		return f.ECU.Receive(ctx)
+	}
+}
+
+func TestFlashFailureReturnsToDefaultSession(t *testing.T) {
+	original, _ := testImage(t, 0x00)
+	image, checksums := testImage(t, 0x5A)
+	ecu := testECU(original.Bytes(), 13200)
+	transport := &failingTransfer{ECU: ecu, sequence: 3, failed: make(chan []byte, 1)}
+
+	err := testFlasher(t, transport, checksums).Flash(context.Background(), image)
+	if !uds.IsNRC(err, uds.NrcGeneralProgrammingFailure) {
+		t.Fatalf("got %v, expected general programming failure", err)
+	}
+
+	// Downloading is only supported in the programming session
+	_, err = uds.NewClient(ecu).RequestDownload(context.Background(), 0, testImageLen)
+	if !uds.IsNRC(err, uds.NrcServiceNotSupportedInSession) {
+		t.Fatalf("got %v requesting a download after the failure, expected the ECU in the default session", err)
+	}
+}
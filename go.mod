@@ -6,6 +6,7 @@ require (
 	github.com/starfederation/datastar-go v1.0.1
 	go.bug.st/serial v1.6.4
 	go.einride.tech/can v0.16.1
+	golang.org/x/sys v0.31.0
 )
 
 require (
@@ -19,5 +20,4 @@ require (
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	golang.org/x/net v0.38.0 // indirect
 	golang.org/x/sync v0.11.0 // indirect
-	golang.org/x/sys v0.31.0 // indirect
 )
@@ -0,0 +1,464 @@
+package rom
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"slices"
+
+	"huskki/utils"
+)
+
+// How the computed checksum is turned into the stored value.
+const (
+	ChecksumModePlain      = "plain"
+	ChecksumModeComplement = "complement" // ones' complement, ~sum
+	ChecksumModeNegate     = "negate"     // two's complement, so the region plus checksum sums to zero
+)
+
+var checksumModes = []string{ChecksumModePlain, ChecksumModeComplement, ChecksumModeNegate}
+
+const (
+	checksumSum = iota
+	checksumXor
+	checksumCRC16
+	checksumCRC32
+)
+
+// ChecksumAlgorithm is a checksum over a byte range, producing a Bits wide result.
+type ChecksumAlgorithm struct {
+	Name string
+	Bits int
+
+	kind int
+	// wordBytes and littleEndian describe the units summed or xored, e.g. 16 bit big endian words.
+	wordBytes    int
+	littleEndian bool
+}
+
+// ChecksumAlgorithms are the algorithms the identifier tries, and that can be named in a checksum spec.
+var ChecksumAlgorithms = []*ChecksumAlgorithm{
+	{Name: "sum8", Bits: 8, kind: checksumSum, wordBytes: 1},
+	{Name: "xor8", Bits: 8, kind: checksumXor, wordBytes: 1},
+	{Name: "sum16-bytes", Bits: 16, kind: checksumSum, wordBytes: 1},
+	{Name: "sum16-be", Bits: 16, kind: checksumSum, wordBytes: 2},
+	{Name: "sum16-le", Bits: 16, kind: checksumSum, wordBytes: 2, littleEndian: true},
+	{Name: "xor16-be", Bits: 16, kind: checksumXor, wordBytes: 2},
+	{Name: "xor16-le", Bits: 16, kind: checksumXor, wordBytes: 2, littleEndian: true},
+	{Name: "sum32-bytes", Bits: 32, kind: checksumSum, wordBytes: 1},
+	{Name: "sum32-be16", Bits: 32, kind: checksumSum, wordBytes: 2},
+	{Name: "sum32-le16", Bits: 32, kind: checksumSum, wordBytes: 2, littleEndian: true},
+	{Name: "sum32-be", Bits: 32, kind: checksumSum, wordBytes: 4},
+	{Name: "sum32-le", Bits: 32, kind: checksumSum, wordBytes: 4, littleEndian: true},
+	{Name: "crc16-ccitt", Bits: 16, kind: checksumCRC16},
+	{Name: "crc32", Bits: 32, kind: checksumCRC32},
+}
+
+// ChecksumAlgorithmByName returns the named algorithm, or nil.
+func ChecksumAlgorithmByName(name string) *ChecksumAlgorithm {
+	for _, a := range ChecksumAlgorithms {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+func (a *ChecksumAlgorithm) mask() uint32 {
+	if a.Bits == 32 {
+		return 0xFFFFFFFF
+	}
+	return 1<<a.Bits - 1
+}
+
+// Compute computes the raw checksum of data, before any mode is applied.
+func (a *ChecksumAlgorithm) Compute(data []byte) uint32 {
+	switch a.kind {
+	case checksumCRC16:
+		return uint32(crc16CCITT(0xFFFF, data))
+	case checksumCRC32:
+		return crc32.ChecksumIEEE(data)
+	}
+	var acc uint32
+	for i := 0; i+a.wordBytes <= len(data); i += a.wordBytes {
+		word := a.word(data[i:])
+		if a.kind == checksumXor {
+			acc ^= word
+		} else {
+			acc += word
+		}
+	}
+	return acc & a.mask()
+}
+
+func (a *ChecksumAlgorithm) word(b []byte) uint32 {
+	switch a.wordBytes {
+	case 2:
+		if a.littleEndian {
+			return uint32(binary.LittleEndian.Uint16(b))
+		}
+		return uint32(binary.BigEndian.Uint16(b))
+	case 4:
+		if a.littleEndian {
+			return binary.LittleEndian.Uint32(b)
+		}
+		return binary.BigEndian.Uint32(b)
+	}
+	return uint32(b[0])
+}
+
+// applyMode turns a computed checksum into the value that would be stored.
+func (a *ChecksumAlgorithm) applyMode(mode string, sum uint32) uint32 {
+	switch mode {
+	case ChecksumModeComplement:
+		return ^sum & a.mask()
+	case ChecksumModeNegate:
+		return -sum & a.mask()
+	}
+	return sum & a.mask()
+}
+
+var crc16CCITTTable = func() (table [256]uint16) {
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16CCITT is CRC-16/CCITT-FALSE (poly 0x1021), pass 0xFFFF to start.
+func crc16CCITT(crc uint16, data []byte) uint16 {
+	for _, b := range data {
+		crc = crc<<8 ^ crc16CCITTTable[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+// ChecksumRegion is a checksum over [Start, End) stored at Store.
+type ChecksumRegion struct {
+	Start     utils.HexUint32 `json:"start"`
+	End       utils.HexUint32 `json:"end"`
+	Store     utils.HexUint32 `json:"store"`
+	Algorithm string          `json:"algorithm"`
+	Mode      string          `json:"mode"`
+	// LittleEndian is the byte order of the stored value.
+	LittleEndian bool `json:"little_endian,omitempty"`
+
+	algorithm *ChecksumAlgorithm
+}
+
+// ChecksumSpec lists every checksum in an image.
+type ChecksumSpec struct {
+	Name    string            `json:"name"`
+	Regions []*ChecksumRegion `json:"regions"`
+}
+
+func LoadChecksumSpec(path string) (*ChecksumSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read checksum spec %s: %w", path, err)
+	}
+	spec := &ChecksumSpec{}
+	if err = json.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("parse checksum spec %s: %w", path, err)
+	}
+	for i, region := range spec.Regions {
+		if err = region.validate(); err != nil {
+			return nil, fmt.Errorf("checksum spec %s region %d: %w", path, i, err)
+		}
+	}
+	return spec, nil
+}
+
+// Fix recomputes every checksum in the spec. Checksums can cover each other's storage so regions are fixed
+// repeatedly until they all verify, which settles in one pass per level of nesting.
+func (s *ChecksumSpec) Fix(image *Image) error {
+	for pass := 0; pass <= len(s.Regions); pass++ {
+		allOk := true
+		for _, region := range s.Regions {
+			ok, _, _, err := region.Verify(image)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+			allOk = false
+			if err = region.Fix(image); err != nil {
+				return fmt.Errorf("fix %s: %w", region, err)
+			}
+		}
+		if allOk {
+			return nil
+		}
+	}
+	return fmt.Errorf("checksums never settled, two regions cover each other's checksum")
+}
+
+func WriteChecksumSpec(path string, spec *ChecksumSpec) error {
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+func (r *ChecksumRegion) validate() error {
+	r.algorithm = ChecksumAlgorithmByName(r.Algorithm)
+	if r.algorithm == nil {
+		return fmt.Errorf("unknown algorithm %q", r.Algorithm)
+	}
+	if r.Mode == "" {
+		r.Mode = ChecksumModePlain
+	}
+	if !slices.Contains(checksumModes, r.Mode) {
+		return fmt.Errorf("unknown mode %q", r.Mode)
+	}
+	if r.End <= r.Start {
+		return fmt.Errorf("empty range %s-%s", r.Start, r.End)
+	}
+	storeEnd := r.Store + utils.HexUint32(r.size())
+	if r.Store < r.End && r.Start < storeEnd {
+		return fmt.Errorf("checksum at %s is inside the range it covers", r.Store)
+	}
+	return nil
+}
+
+func (r *ChecksumRegion) size() int {
+	return r.algorithm.Bits / 8
+}
+
+func (r *ChecksumRegion) String() string {
+	return fmt.Sprintf("%s %s over 0x%06X-0x%06X stored at 0x%06X (%s)",
+		r.Algorithm, r.Mode, uint32(r.Start), uint32(r.End), uint32(r.Store), endianName(r.LittleEndian))
+}
+
+func endianName(littleEndian bool) string {
+	if littleEndian {
+		return "LE"
+	}
+	return "BE"
+}
+
+// Compute returns the value that should be stored for the region's current contents.
+func (r *ChecksumRegion) Compute(image *Image) (uint32, error) {
+	data, err := image.Slice(int(r.Start), int(r.End-r.Start))
+	if err != nil {
+		return 0, err
+	}
+	return r.algorithm.applyMode(r.Mode, r.algorithm.Compute(data)), nil
+}
+
+// Stored returns the checksum currently stored in the image.
+func (r *ChecksumRegion) Stored(image *Image) (uint32, error) {
+	b, err := image.Slice(int(r.Store), r.size())
+	if err != nil {
+		return 0, err
+	}
+	return readStored(b, r.LittleEndian), nil
+}
+
+// Verify checks the stored checksum matches the region's contents.
+func (r *ChecksumRegion) Verify(image *Image) (ok bool, computed, stored uint32, err error) {
+	if computed, err = r.Compute(image); err != nil {
+		return false, 0, 0, err
+	}
+	if stored, err = r.Stored(image); err != nil {
+		return false, 0, 0, err
+	}
+	return computed == stored, computed, stored, nil
+}
+
+// Fix recomputes the checksum and writes it into the image.
+func (r *ChecksumRegion) Fix(image *Image) error {
+	computed, err := r.Compute(image)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, r.size())
+	for i := range b {
+		shift := 8 * i
+		if !r.LittleEndian {
+			shift = 8 * (len(b) - 1 - i)
+		}
+		b[i] = byte(computed >> shift)
+	}
+	return image.Write(int(r.Store), b)
+}
+
+func readStored(b []byte, littleEndian bool) uint32 {
+	var v uint32
+	for i := range b {
+		if littleEndian {
+			v |= uint32(b[i]) << (8 * i)
+		} else {
+			v = v<<8 | uint32(b[i])
+		}
+	}
+	return v
+}
+
+// checksumSpan is a candidate range and where its checksum would be stored.
+type checksumSpan struct {
+	from, to, store int
+}
+
+// IdentifyChecksums looks for checksums stored at either the start or the end of alignment sized blocks, covering
+// everything from that block boundary up to (or from) any other block boundary. Only algorithms at least minBits wide
+// are tried, narrow checksums match by chance far too often to be identified this way. tests counts how many
+// comparisons were made at each width, tests[bits] / 2^bits is how many matches to expect by pure chance.
+func IdentifyChecksums(image *Image, alignment, minBits int) (regions []*ChecksumRegion, tests map[int]int) {
+	tests = map[int]int{}
+	data := image.Bytes()
+	var boundaries []int
+	for b := 0; b <= len(data); b += alignment {
+		boundaries = append(boundaries, b)
+	}
+	if boundaries[len(boundaries)-1] != len(data) {
+		boundaries = append(boundaries, len(data))
+	}
+
+	var found []*ChecksumRegion
+	for _, algorithm := range ChecksumAlgorithms {
+		if algorithm.Bits < minBits {
+			continue
+		}
+		size := algorithm.Bits / 8
+		var spans []checksumSpan
+		for si, start := range boundaries {
+			for _, end := range boundaries[si+1:] {
+				// checksum in the last bytes of the range, or in the first
+				for _, span := range []checksumSpan{{start, end - size, end - size}, {start + size, end, start}} {
+					if span.to-span.from < alignment/2 || (span.to-span.from)%algorithm.wordBytesOrOne() != 0 {
+						continue
+					}
+					spans = append(spans, span)
+				}
+			}
+		}
+
+		sums := algorithm.spanSums(data, spans)
+		for i, span := range spans {
+			if isBlank(data[span.from:span.to]) {
+				continue
+			}
+			for _, littleEndian := range []bool{false, true} {
+				stored := readStored(data[span.store:span.store+size], littleEndian)
+				if stored == 0 || stored == algorithm.mask() {
+					// erased or zeroed flash, not a checksum
+					continue
+				}
+				for _, mode := range checksumModes {
+					tests[algorithm.Bits]++
+					if algorithm.applyMode(mode, sums[i]) == stored {
+						found = append(found, &ChecksumRegion{
+							Start: utils.HexUint32(span.from), End: utils.HexUint32(span.to), Store: utils.HexUint32(span.store),
+							Algorithm: algorithm.Name, Mode: mode, LittleEndian: littleEndian, algorithm: algorithm,
+						})
+					}
+				}
+			}
+		}
+	}
+
+	// Wider checksums are far less likely to be coincidences, so they win when two claim overlapping storage
+	slices.SortStableFunc(found, func(a, b *ChecksumRegion) int { return b.algorithm.Bits - a.algorithm.Bits })
+	var kept []*ChecksumRegion
+	for _, r := range found {
+		overlaps := false
+		for _, k := range kept {
+			if r.Store < k.Store+utils.HexUint32(k.size()) && k.Store < r.Store+utils.HexUint32(r.size()) {
+				overlaps = true
+				break
+			}
+		}
+		// A checksum stored so the region sums to a constant makes a mirror image match covering the real one, each
+		// covers the other's storage. The first found wins since ranges ending in their checksum are tried first.
+		for _, k := range kept {
+			if r.covers(k.Store) && k.covers(r.Store) {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			kept = append(kept, r)
+		}
+	}
+	slices.SortFunc(kept, func(a, b *ChecksumRegion) int { return int(a.Start) - int(b.Start) })
+	return kept, tests
+}
+
+func (r *ChecksumRegion) covers(address utils.HexUint32) bool {
+	return address >= r.Start && address < r.End
+}
+
+func (a *ChecksumAlgorithm) wordBytesOrOne() int {
+	return max(a.wordBytes, 1)
+}
+
+// spanSums computes the raw checksum of every span without rescanning the image for each one. Sums and xors use
+// prefix arrays, CRCs are carried forward from each start to every end in order.
+func (a *ChecksumAlgorithm) spanSums(data []byte, spans []checksumSpan) []uint32 {
+	sums := make([]uint32, len(spans))
+	if a.kind == checksumSum || a.kind == checksumXor {
+		words := len(data) / a.wordBytes
+		prefix := make([]uint32, words+1)
+		for i := 0; i < words; i++ {
+			if a.kind == checksumXor {
+				prefix[i+1] = prefix[i] ^ a.word(data[i*a.wordBytes:])
+			} else {
+				prefix[i+1] = prefix[i] + a.word(data[i*a.wordBytes:])
+			}
+		}
+		for i, span := range spans {
+			from, to := span.from/a.wordBytes, span.to/a.wordBytes
+			if a.kind == checksumXor {
+				sums[i] = (prefix[to] ^ prefix[from]) & a.mask()
+			} else {
+				sums[i] = (prefix[to] - prefix[from]) & a.mask()
+			}
+		}
+		return sums
+	}
+
+	byFrom := map[int][]int{}
+	for i, span := range spans {
+		byFrom[span.from] = append(byFrom[span.from], i)
+	}
+	for from, indexes := range byFrom {
+		slices.SortFunc(indexes, func(x, y int) int { return spans[x].to - spans[y].to })
+		crc16 := uint16(0xFFFF)
+		var crc32Value uint32
+		position := from
+		for _, i := range indexes {
+			chunk := data[position:spans[i].to]
+			if a.kind == checksumCRC16 {
+				crc16 = crc16CCITT(crc16, chunk)
+				sums[i] = uint32(crc16)
+			} else {
+				crc32Value = crc32.Update(crc32Value, crc32.IEEETable, chunk)
+				sums[i] = crc32Value
+			}
+			position = spans[i].to
+		}
+	}
+	return sums
+}
+
+func isBlank(data []byte) bool {
+	for _, b := range data {
+		if b != data[0] {
+			return false
+		}
+	}
+	return true
+}
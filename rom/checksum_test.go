@@ -0,0 +1,106 @@
+package rom
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"huskki/utils"
+)
+
+func checksumImage(size int, seed int64) *Image {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return NewImage(data)
+}
+
+func checksumRegion(t *testing.T, start, end, store uint32, algorithm, mode string, littleEndian bool) *ChecksumRegion {
+	t.Helper()
+	r := &ChecksumRegion{Start: utils.HexUint32(start), End: utils.HexUint32(end), Store: utils.HexUint32(store),
+		Algorithm: algorithm, Mode: mode, LittleEndian: littleEndian}
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestIdentifyChecksums(t *testing.T) {
+	tests := []struct {
+		name              string
+		start, end, store uint32
+		algorithm, mode   string
+		littleEndian      bool
+	}{
+		{"sum32 at the end", 0x0000, 0x7FFC, 0x7FFC, "sum32-be", ChecksumModePlain, false},
+		{"sum32 complement", 0x4000, 0xFFFC, 0xFFFC, "sum32-le16", ChecksumModeComplement, true},
+		{"sum32 negate", 0x0000, 0xBFFC, 0xBFFC, "sum32-bytes", ChecksumModeNegate, false},
+		{"crc32 at the start", 0x4004, 0xC000, 0x4000, "crc32", ChecksumModePlain, true},
+		{"crc16", 0x0000, 0x3FFE, 0x3FFE, "crc16-ccitt", ChecksumModePlain, false},
+		{"sum16 of words", 0x8000, 0xFFFE, 0xFFFE, "sum16-be", ChecksumModePlain, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			image := checksumImage(0x10000, 1)
+			want := checksumRegion(t, test.start, test.end, test.store, test.algorithm, test.mode, test.littleEndian)
+			if err := want.Fix(image); err != nil {
+				t.Fatal(err)
+			}
+
+			regions, tests := IdentifyChecksums(image, 0x4000, want.algorithm.Bits)
+			if tests[want.algorithm.Bits] == 0 {
+				t.Fatalf("no %d bit comparisons made", want.algorithm.Bits)
+			}
+			for _, r := range regions {
+				if r.String() == want.String() {
+					return
+				}
+			}
+			t.Fatalf("%s not found in %v", want, regions)
+		})
+	}
+}
+
+func TestIdentifyChecksumsIgnoresBlankFlash(t *testing.T) {
+	image := NewImage([]byte(strings.Repeat("\xFF", 0x10000)))
+	if regions, _ := IdentifyChecksums(image, 0x4000, 16); len(regions) != 0 {
+		t.Fatalf("found %v in erased flash", regions)
+	}
+}
+
+func TestChecksumSpecFix(t *testing.T) {
+	tests := []struct {
+		name    string
+		regions [][3]uint32
+		err     string
+	}{
+		{"one region", [][3]uint32{{0x0000, 0x3FFC, 0x3FFC}}, ""},
+		// The first region covers the second's checksum, so it's only right once the second has been fixed
+		{"nested", [][3]uint32{{0x0000, 0xBFFC, 0xBFFC}, {0x4000, 0x7FFC, 0x7FFC}}, ""},
+		{"covering each other", [][3]uint32{{0x0000, 0x4000, 0x5000}, {0x4004, 0x8000, 0x1000}}, "never settled"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			image := checksumImage(0x10000, 2)
+			spec := &ChecksumSpec{Name: test.name}
+			for _, r := range test.regions {
+				spec.Regions = append(spec.Regions, checksumRegion(t, r[0], r[1], r[2], "crc32", ChecksumModePlain, false))
+			}
+
+			err := spec.Fix(image)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range spec.Regions {
+				if ok, computed, stored, err := r.Verify(image); err != nil || !ok {
+					t.Errorf("%s computed 0x%X stored 0x%X after fixing: %v", r, computed, stored, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,373 @@
+package rom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"huskki/expr"
+	"huskki/utils"
+)
+
+// Well known table categories, these are shown first and in this order. Anything else is shown after them.
+const (
+	CategoryFuel     = "fuel"
+	CategoryIgnition = "ignition"
+	CategoryLambda   = "lambda"
+	CategoryOther    = "other"
+)
+
+var CategoryOrder = []string{CategoryFuel, CategoryIgnition, CategoryLambda}
+
+// Definition describes where calibration tables live inside a ROM image and how to scale them. It's the JSON
+// equivalent of a TunerPro XDF, and XDFs are converted to it on load.
+type Definition struct {
+	Name string `json:"name"`
+	// BaseOffset is added to every address in the definition to get the offset into the image.
+	BaseOffset int      `json:"base_offset,omitempty"`
+	Tables     []*Table `json:"tables"`
+}
+
+// Table is a 2D (single axis) or 3D (two axis) calibration table.
+type Table struct {
+	// Key identifies the table, it defaults to a slug of the title.
+	Key         string `json:"key"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	// Category groups tables in the UI, see CategoryFuel etc.
+	Category string `json:"category,omitempty"`
+	Units    string `json:"units,omitempty"`
+	Rows     int    `json:"rows"`
+	Cols     int    `json:"cols"`
+	// Data is the encoding of the table cells.
+	Data Encoding `json:"data"`
+	// X is the column axis.
+	X *Axis `json:"x,omitempty"`
+	// Y is the row axis, only used for 3D tables.
+	Y *Axis `json:"y,omitempty"`
+}
+
+// Axis describes the breakpoints along one side of a table, either read from the image or as fixed labels.
+type Axis struct {
+	Title  string    `json:"title,omitempty"`
+	Units  string    `json:"units,omitempty"`
+	Count  int       `json:"count"`
+	Data   *Encoding `json:"data,omitempty"`
+	Labels []float64 `json:"labels,omitempty"`
+	// Stream is the key of the live stream this axis is indexed by (e.g. RPM), used to trace the cell the engine is
+	// currently in. The units of the stream and the scaled axis need to match.
+	Stream string `json:"stream,omitempty"`
+}
+
+// Encoding describes how values are stored in the image and how to scale them to real units.
+type Encoding struct {
+	Address      utils.HexUint32 `json:"address"`
+	Bits         int             `json:"bits"`
+	Signed       bool            `json:"signed,omitempty"`
+	LittleEndian bool            `json:"little_endian,omitempty"`
+	Float        bool            `json:"float,omitempty"`
+	// ColumnMajor means cells are stored column by column instead of row by row.
+	ColumnMajor bool `json:"column_major,omitempty"`
+	// Expr scales the raw value X to real units, e.g. "X*0.5-40". Empty means no scaling.
+	Expr     string `json:"expr,omitempty"`
+	Decimals int    `json:"decimals,omitempty"`
+
+	expression *expr.Expression
+}
+
+// TableData is a table read out of an image and scaled.
+type TableData struct {
+	*Table
+	// X holds the column breakpoints.
+	X []float64
+	// Y holds the row breakpoints, it has a single zero entry for 2D tables.
+	Y []float64
+	// Values is indexed [row][col].
+	Values   [][]float64
+	Min, Max float64
+}
+
+// Load loads a definition from either a TunerPro .xdf or a .json definition.
+func Load(path string) (*Definition, error) {
+	var (
+		definition *Definition
+		err        error
+	)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".xdf":
+		definition, err = LoadXDF(path)
+	case ".json":
+		definition, err = LoadJSON(path)
+	default:
+		return nil, fmt.Errorf("unsupported definition format %q, expected .xdf or .json", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = definition.Validate(); err != nil {
+		return nil, fmt.Errorf("definition %s: %w", path, err)
+	}
+	return definition, nil
+}
+
+// Validate fills in defaults and compiles scaling expressions, it must be called before reading tables.
+func (d *Definition) Validate() error {
+	keys := map[string]bool{}
+	for i, t := range d.Tables {
+		if t.Title == "" {
+			t.Title = fmt.Sprintf("Table %d", i+1)
+		}
+		if t.Key == "" {
+			t.Key = slug(t.Title)
+		}
+		for keys[t.Key] {
+			t.Key += "-" + fmt.Sprint(i)
+		}
+		keys[t.Key] = true
+		if t.Category == "" {
+			t.Category = CategoryOther
+		}
+		if t.Rows <= 0 {
+			t.Rows = 1
+		}
+		if t.Cols <= 0 {
+			t.Cols = 1
+		}
+		if err := t.Data.compile(); err != nil {
+			return fmt.Errorf("table %s: %w", t.Key, err)
+		}
+		if err := t.X.validate(t.Cols); err != nil {
+			return fmt.Errorf("table %s x axis: %w", t.Key, err)
+		}
+		if err := t.Y.validate(t.Rows); err != nil {
+			return fmt.Errorf("table %s y axis: %w", t.Key, err)
+		}
+	}
+	return nil
+}
+
+// Table returns the table with key, or nil.
+func (d *Definition) Table(key string) *Table {
+	for _, t := range d.Tables {
+		if t.Key == key {
+			return t
+		}
+	}
+	return nil
+}
+
+// Read reads and scales a table out of image.
+func (d *Definition) Read(image *Image, t *Table) (*TableData, error) {
+	data := &TableData{
+		Table:  t,
+		Values: make([][]float64, t.Rows),
+		Min:    math.Inf(1),
+		Max:    math.Inf(-1),
+	}
+	for row := 0; row < t.Rows; row++ {
+		data.Values[row] = make([]float64, t.Cols)
+		for col := 0; col < t.Cols; col++ {
+			index := row*t.Cols + col
+			if t.Data.ColumnMajor {
+				index = col*t.Rows + row
+			}
+			v, err := t.Data.value(image, d.BaseOffset, index)
+			if err != nil {
+				return nil, fmt.Errorf("table %s cell %d,%d: %w", t.Key, row, col, err)
+			}
+			data.Values[row][col] = v
+			data.Min = math.Min(data.Min, v)
+			data.Max = math.Max(data.Max, v)
+		}
+	}
+
+	var err error
+	if data.X, err = t.X.values(image, d.BaseOffset, t.Cols); err != nil {
+		return nil, fmt.Errorf("table %s x axis: %w", t.Key, err)
+	}
+	if data.Y, err = t.Y.values(image, d.BaseOffset, t.Rows); err != nil {
+		return nil, fmt.Errorf("table %s y axis: %w", t.Key, err)
+	}
+	return data, nil
+}
+
+// ReadAll reads every table in the definition.
+func (d *Definition) ReadAll(image *Image) ([]*TableData, error) {
+	tables := make([]*TableData, 0, len(d.Tables))
+	for _, t := range d.Tables {
+		data, err := d.Read(image, t)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, data)
+	}
+	return tables, nil
+}
+
+// Cell returns the row and column of the breakpoints nearest to x and y, y is ignored for 2D tables.
+func (d *TableData) Cell(x, y float64) (row, col int) {
+	col = nearestIndex(d.X, x)
+	if d.Is3D() {
+		row = nearestIndex(d.Y, y)
+	}
+	return row, col
+}
+
+func nearestIndex(breakpoints []float64, v float64) int {
+	nearest := 0
+	for i, bp := range breakpoints {
+		if math.Abs(bp-v) < math.Abs(breakpoints[nearest]-v) {
+			nearest = i
+		}
+	}
+	return nearest
+}
+
+// Is3D is true for tables with both a row and column axis.
+func (t *Table) Is3D() bool {
+	return t.Rows > 1
+}
+
+func (a *Axis) validate(count int) error {
+	if a == nil {
+		return nil
+	}
+	if a.Count <= 0 {
+		a.Count = count
+	}
+	if a.Count != count {
+		return fmt.Errorf("has %d breakpoints but table has %d", a.Count, count)
+	}
+	if a.Data != nil {
+		return a.Data.compile()
+	}
+	if len(a.Labels) != 0 && len(a.Labels) != count {
+		return fmt.Errorf("has %d labels but table has %d", len(a.Labels), count)
+	}
+	return nil
+}
+
+// values returns the axis breakpoints, an axis without data or labels is just numbered.
+func (a *Axis) values(image *Image, baseOffset, count int) ([]float64, error) {
+	out := make([]float64, count)
+	for i := range out {
+		switch {
+		case a == nil:
+			out[i] = float64(i)
+		case a.Data != nil:
+			v, err := a.Data.value(image, baseOffset, i)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		case len(a.Labels) > 0:
+			out[i] = a.Labels[i]
+		default:
+			out[i] = float64(i)
+		}
+	}
+	return out, nil
+}
+
+// Decimals is how many decimal places to display axis values with.
+func (a *Axis) Decimals() int {
+	if a == nil || a.Data == nil {
+		return 0
+	}
+	return a.Data.Decimals
+}
+
+func (e *Encoding) compile() error {
+	switch e.Bits {
+	case 0:
+		e.Bits = 8
+	case 8, 16, 32:
+	default:
+		return fmt.Errorf("unsupported element size %d bits", e.Bits)
+	}
+	if e.Float && e.Bits != 32 {
+		return fmt.Errorf("float values must be 32 bits")
+	}
+	if e.Expr == "" {
+		return nil
+	}
+	expression, err := expr.Parse(e.Expr)
+	if err != nil {
+		return err
+	}
+	e.expression = expression
+	return nil
+}
+
+// Raw reads the unscaled element at index.
+func (e *Encoding) Raw(image *Image, baseOffset, index int) (float64, error) {
+	size := e.Bits / 8
+	b, err := image.Slice(int(e.Address)+baseOffset+index*size, size)
+	if err != nil {
+		return 0, err
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if e.LittleEndian {
+		order = binary.LittleEndian
+	}
+	switch size {
+	case 1:
+		if e.Signed {
+			return float64(int8(b[0])), nil
+		}
+		return float64(b[0]), nil
+	case 2:
+		if e.Signed {
+			return float64(int16(order.Uint16(b))), nil
+		}
+		return float64(order.Uint16(b)), nil
+	default:
+		u := order.Uint32(b)
+		if e.Float {
+			return float64(math.Float32frombits(u)), nil
+		}
+		if e.Signed {
+			return float64(int32(u)), nil
+		}
+		return float64(u), nil
+	}
+}
+
+// Scale converts a raw value to real units.
+func (e *Encoding) Scale(raw float64) (float64, error) {
+	if e.expression == nil {
+		return raw, nil
+	}
+	return e.expression.Eval(&expr.Env{Vars: map[string]float64{"x": raw}})
+}
+
+func (e *Encoding) value(image *Image, baseOffset, index int) (float64, error) {
+	raw, err := e.Raw(image, baseOffset, index)
+	if err != nil {
+		return 0, err
+	}
+	return e.Scale(raw)
+}
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+func slug(s string) string {
+	return strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// CategoryFromName guesses a well known category from a free text category or table name.
+func CategoryFromName(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.Contains(lower, "lambda"), strings.Contains(lower, "o2"), strings.Contains(lower, "afr"):
+		return CategoryLambda
+	case strings.Contains(lower, "fuel"), strings.Contains(lower, "inject"), strings.Contains(lower, "ve "):
+		return CategoryFuel
+	case strings.Contains(lower, "ign"), strings.Contains(lower, "spark"), strings.Contains(lower, "timing"), strings.Contains(lower, "advance"):
+		return CategoryIgnition
+	}
+	return CategoryOther
+}
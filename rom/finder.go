@@ -0,0 +1,322 @@
+package rom
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"huskki/utils"
+)
+
+// FinderOptions tunes the table finder heuristic.
+type FinderOptions struct {
+	// MinAxisLength and MaxAxisLength bound how many breakpoints an axis can have.
+	MinAxisLength int
+	MaxAxisLength int
+	// MaxGap is how many bytes are allowed between an axis and whatever follows it, ECUs often pad or store a
+	// breakpoint count between them.
+	MaxGap int
+	// MinCells is the smallest table worth reporting, tiny tables are smooth by chance far too often.
+	MinCells int
+	// MaxRoughness is the largest average change in slope between neighbouring cells, relative to the table's range,
+	// that still counts as smooth. Random bytes come out around 0.5.
+	MaxRoughness float64
+}
+
+var DefaultFinderOptions = FinderOptions{
+	MinAxisLength: 4,
+	MaxAxisLength: 32,
+	MaxGap:        2,
+	MinCells:      8,
+	MaxRoughness:  0.1,
+}
+
+// Candidate is a table the finder thinks is probably calibration data.
+type Candidate struct {
+	Table *Table
+	// Score is 0..1, higher is more likely to be a real table.
+	Score float64
+	// Roughness of the table data, see FinderOptions.MaxRoughness.
+	Roughness float64
+
+	start, end int
+}
+
+// layout is an element width and byte order to scan an image with.
+type layout struct {
+	bits         int
+	littleEndian bool
+}
+
+var finderLayouts = []layout{
+	{8, false},
+	{16, false},
+	{16, true},
+}
+
+// axisRun is a strictly increasing run of elements starting at element index start.
+type axisRun struct {
+	start, length int
+}
+
+// FindTables scans an image for monotonic axis arrays followed by either a second axis and a smooth 2D block (a 3D
+// table), or a smooth 1D block of the same length (a 2D table). Overlapping candidates are resolved in favour of the
+// highest score.
+func FindTables(image *Image, options FinderOptions) []*Candidate {
+	var candidates []*Candidate
+	for _, axisLayout := range finderLayouts {
+		values := elements(image, axisLayout)
+		runLengths := increasingRunLengths(values)
+		size := axisLayout.bits / 8
+
+		runStart := 0
+		for i := range values {
+			if i == 0 || values[i-1] >= values[i] {
+				runStart = i
+			}
+			// The middle of a run too long to be an axis is a ramp, not the start of one. Trying every start in it
+			// is quadratic in the run's length for nothing.
+			if i > runStart && runLengths[runStart] > options.MaxAxisLength {
+				continue
+			}
+			// Axes are often followed by data or another axis that keeps increasing, so any prefix of a run could be
+			// the axis. Only the best table found at each start is kept, the rest would lose to it on overlap anyway.
+			var best *Candidate
+			keep := func(found []*Candidate) {
+				for _, c := range found {
+					if best == nil || betterCandidate(c, best) {
+						best = c
+					}
+				}
+			}
+			// A run longer than both axes together would carry on through the y axis into the data, which is a ramp
+			// rather than a 3D table and smooth enough to be evaluated at every possible size
+			ramp := runLengths[i] > 2*options.MaxAxisLength
+			for xLength := options.MinAxisLength; xLength <= min(runLengths[i], options.MaxAxisLength); xLength++ {
+				x := axisRun{i, xLength}
+				if !isAxis(values[x.start:x.start+x.length], options) {
+					continue
+				}
+				xEnd := (x.start + x.length) * size
+				for gap := 0; gap <= options.MaxGap; gap += size {
+					// 3D: x axis, y axis, then data
+					yStart := (xEnd + gap) / size
+					for yLength := options.MinAxisLength; !ramp && yStart < len(values) && yLength <= min(runLengths[yStart], options.MaxAxisLength); yLength++ {
+						y := axisRun{yStart, yLength}
+						if !isAxis(values[y.start:y.start+y.length], options) {
+							continue
+						}
+						yEnd := (y.start + y.length) * size
+						for dataGap := 0; dataGap <= options.MaxGap; dataGap++ {
+							keep(findBlocks(image, axisLayout, options, x, &y, yEnd+dataGap))
+						}
+					}
+					// 2D: x axis then data
+					keep(findBlocks(image, axisLayout, options, x, nil, xEnd+gap))
+				}
+			}
+			if best != nil {
+				candidates = append(candidates, best)
+			}
+		}
+	}
+
+	slices.SortStableFunc(candidates, func(a, b *Candidate) int {
+		switch {
+		case betterCandidate(a, b):
+			return -1
+		case betterCandidate(b, a):
+			return 1
+		}
+		return 0
+	})
+
+	// Greedily keep the best candidates that don't overlap better ones. kept is sorted by start and never overlaps
+	// itself, so only the neighbours either side of where a candidate would go can overlap it.
+	var kept []*Candidate
+	for _, c := range candidates {
+		i, _ := slices.BinarySearchFunc(kept, c.start, func(k *Candidate, start int) int { return k.start - start })
+		if i > 0 && kept[i-1].end > c.start {
+			continue
+		}
+		if i < len(kept) && kept[i].start < c.end {
+			continue
+		}
+		kept = slices.Insert(kept, i, c)
+	}
+	return kept
+}
+
+// betterCandidate is whether a beats b, on score then on size.
+func betterCandidate(a, b *Candidate) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return a.Table.Rows*a.Table.Cols > b.Table.Rows*b.Table.Cols
+}
+
+// CandidatesDefinition wraps candidates in a definition so they can be saved and opened in the calibration viewer.
+func CandidatesDefinition(name string, candidates []*Candidate) *Definition {
+	definition := &Definition{Name: name}
+	for _, c := range candidates {
+		definition.Tables = append(definition.Tables, c.Table)
+	}
+	return definition
+}
+
+// findBlocks tries both data widths for a block at offset following the axes.
+func findBlocks(image *Image, axisLayout layout, options FinderOptions, x axisRun, y *axisRun, offset int) []*Candidate {
+	var candidates []*Candidate
+	for _, dataBits := range []int{8, 16} {
+		dataLayout := layout{dataBits, axisLayout.littleEndian}
+		if c := evaluateBlock(image, axisLayout, dataLayout, options, x, y, offset); c != nil {
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates
+}
+
+// gapPenalty is taken off the score per byte of gap between axes and data, so tightly packed layouts win ties.
+const gapPenalty = 0.01
+
+func evaluateBlock(image *Image, axisLayout, dataLayout layout, options FinderOptions, x axisRun, y *axisRun, offset int) *Candidate {
+	size := dataLayout.bits / 8
+	if offset%size != 0 {
+		return nil
+	}
+	rows := 1
+	if y != nil {
+		rows = y.length
+	}
+	cols := x.length
+	if rows*cols < options.MinCells || offset+rows*cols*size > image.Len() {
+		return nil
+	}
+
+	data := Encoding{Address: utils.HexUint32(offset), Bits: dataLayout.bits, LittleEndian: dataLayout.littleEndian}
+	block := make([][]float64, rows)
+	for r := range block {
+		block[r] = make([]float64, cols)
+		for c := range block[r] {
+			v, err := data.Raw(image, 0, r*cols+c)
+			if err != nil {
+				return nil
+			}
+			block[r][c] = v
+		}
+	}
+	roughness, ok := blockRoughness(block)
+	if !ok || roughness > options.MaxRoughness {
+		return nil
+	}
+
+	axisSize := axisLayout.bits / 8
+	t := &Table{
+		Key:      fmt.Sprintf("candidate-%05x", offset),
+		Title:    fmt.Sprintf("Candidate 0x%05X (%dx%d)", offset, rows, cols),
+		Category: CategoryOther,
+		Rows:     rows,
+		Cols:     cols,
+		Data:     data,
+		X: &Axis{Title: "X", Count: cols, Data: &Encoding{
+			Address: utils.HexUint32(x.start * axisSize), Bits: axisLayout.bits, LittleEndian: axisLayout.littleEndian,
+		}},
+	}
+	start := x.start * axisSize
+	if y != nil {
+		t.Y = &Axis{Title: "Y", Count: rows, Data: &Encoding{
+			Address: utils.HexUint32(y.start * axisSize), Bits: axisLayout.bits, LittleEndian: axisLayout.littleEndian,
+		}}
+	}
+	axesEnd := (x.start + x.length) * axisSize
+	if y != nil {
+		axesEnd = (y.start + y.length) * axisSize
+	}
+	gaps := offset - axesEnd
+	if y != nil {
+		gaps += y.start*axisSize - (x.start+x.length)*axisSize
+	}
+	score := 1 - roughness/options.MaxRoughness - float64(gaps)*gapPenalty
+	t.Description = fmt.Sprintf("Found by tablefinder, score %.2f, roughness %.3f", score, roughness)
+
+	return &Candidate{
+		Table:     t,
+		Score:     score,
+		Roughness: roughness,
+		start:     start,
+		end:       offset + rows*cols*size,
+	}
+}
+
+// increasingRunLengths returns, for every element, how many elements from it onwards are strictly increasing.
+func increasingRunLengths(values []float64) []int {
+	lengths := make([]int, len(values))
+	for i := len(values) - 1; i >= 0; i-- {
+		lengths[i] = 1
+		if i+1 < len(values) && values[i+1] > values[i] {
+			lengths[i] = lengths[i+1] + 1
+		}
+	}
+	return lengths
+}
+
+func isAxis(values []float64, options FinderOptions) bool {
+	if len(values) < options.MinAxisLength || len(values) > options.MaxAxisLength {
+		return false
+	}
+	// 0,1,2,3... is far more likely to be an index table or code than an axis
+	counting := true
+	for i := 1; i < len(values); i++ {
+		if values[i]-values[i-1] != 1 {
+			counting = false
+			break
+		}
+	}
+	return !counting
+}
+
+// blockRoughness is the mean absolute second difference along rows and columns divided by the block's range, so
+// linear ramps are perfectly smooth regardless of how steep they are. ok is false for blocks that are constant, which
+// are usually erased flash or padding.
+func blockRoughness(block [][]float64) (roughness float64, ok bool) {
+	minimum, maximum := math.Inf(1), math.Inf(-1)
+	for _, row := range block {
+		for _, v := range row {
+			minimum = math.Min(minimum, v)
+			maximum = math.Max(maximum, v)
+		}
+	}
+	valueRange := maximum - minimum
+	if valueRange == 0 {
+		return 0, false
+	}
+
+	var total float64
+	var count int
+	for r, row := range block {
+		for c, v := range row {
+			if c+2 < len(row) {
+				total += math.Abs(row[c+2] - 2*row[c+1] + v)
+				count++
+			}
+			if r+2 < len(block) {
+				total += math.Abs(block[r+2][c] - 2*block[r+1][c] + v)
+				count++
+			}
+		}
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return total / float64(count) / valueRange, true
+}
+
+// elements decodes the whole image as a flat array of elements in the given layout.
+func elements(image *Image, l layout) []float64 {
+	encoding := Encoding{Bits: l.bits, LittleEndian: l.littleEndian}
+	values := make([]float64, image.Len()/(l.bits/8))
+	for i := range values {
+		values[i], _ = encoding.Raw(image, 0, i)
+	}
+	return values
+}
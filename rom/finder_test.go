@@ -0,0 +1,106 @@
+package rom
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"huskki/utils"
+)
+
+// finderImage is size bytes of noise with blocks written over it at the given addresses.
+func finderImage(size int, blocks map[int][]byte) *Image {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	for address, block := range blocks {
+		copy(data[address:], block)
+	}
+	return NewImage(data)
+}
+
+// table3D is a 0xFF marker, so the axis doesn't continue a run in the noise, then an x axis, a y axis and a smooth
+// block of 8-bit cells.
+func table3D(x, y []byte) []byte {
+	b := append([]byte{0xFF}, x...)
+	b = append(b, y...)
+	for r := range y {
+		for c := range x {
+			b = append(b, byte(20+r*10+c*7))
+		}
+	}
+	return append(b, 0xFF)
+}
+
+// table2D16 is a big endian 16-bit axis followed by a smooth block of big endian 16-bit cells.
+func table2D16(x []uint16) []byte {
+	b := []byte{0xFF, 0xFF}
+	for _, v := range x {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	for c := range x {
+		b = binary.BigEndian.AppendUint16(b, uint16(1000+c*c*40))
+	}
+	return append(b, 0xFF, 0xFF)
+}
+
+// ramp is a counter of bytes, the kind of thing a lookup table for a linear sensor or a test pattern leaves behind.
+func ramp(length int) []byte {
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func TestFindTables(t *testing.T) {
+	x := []byte{10, 20, 35, 50, 70, 95, 120, 150}
+	y := []byte{5, 15, 30, 50, 75, 100}
+	type found struct {
+		data       int
+		rows, cols int
+	}
+	tests := []struct {
+		name   string
+		image  *Image
+		tables []found
+	}{
+		{"3D table", finderImage(0x1000, map[int][]byte{0x400: table3D(x, y)}), []found{
+			{0x400 + 1 + len(x) + len(y), len(y), len(x)},
+		}},
+		{"16-bit 2D table", finderImage(0x1000, map[int][]byte{0x800: table2D16([]uint16{500, 800, 1200, 1800, 2500, 3300, 4200, 5200})}), []found{
+			{0x800 + 2 + 16, 1, 8},
+		}},
+		{"two tables", finderImage(0x1000, map[int][]byte{0x200: table3D(x, y), 0xA00: table3D(x[:6], y[:4])}), []found{
+			{0x200 + 1 + len(x) + len(y), len(y), len(x)},
+			{0xA00 + 1 + 6 + 4, 4, 6},
+		}},
+		{"table after a ramp in a full size image", finderImage(0x140000, map[int][]byte{0x10000: ramp(0x1000), 0x12000: table3D(x, y)}), []found{
+			{0x12000 + 1 + len(x) + len(y), len(y), len(x)},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			candidates := FindTables(test.image, DefaultFinderOptions)
+			for i := 1; i < len(candidates); i++ {
+				if candidates[i-1].end > candidates[i].start {
+					t.Fatalf("candidates at 0x%X and 0x%X overlap", candidates[i-1].start, candidates[i].start)
+				}
+			}
+			for _, want := range test.tables {
+				var match *Candidate
+				for _, c := range candidates {
+					if c.Table.Data.Address == utils.HexUint32(want.data) {
+						match = c
+					}
+				}
+				if match == nil {
+					t.Errorf("no candidate with data at 0x%X in %d candidates", want.data, len(candidates))
+					continue
+				}
+				if match.Table.Rows != want.rows || match.Table.Cols != want.cols {
+					t.Errorf("table at 0x%X found as %dx%d, expected %dx%d", want.data, match.Table.Rows, match.Table.Cols, want.rows, want.cols)
+				}
+			}
+		})
+	}
+}
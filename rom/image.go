@@ -0,0 +1,55 @@
+package rom
+
+import (
+	"fmt"
+	"os"
+)
+
+// DEFAULT_IMAGE_PATH is where cmd/dumper writes the ROM.
+const DEFAULT_IMAGE_PATH = "rom.bin"
+
+// Image is a raw ROM image as dumped from the ECU.
+type Image struct {
+	data []byte
+}
+
+func NewImage(data []byte) *Image {
+	return &Image{data}
+}
+
+func LoadImage(path string) (*Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read rom %s: %w", path, err)
+	}
+	return NewImage(data), nil
+}
+
+func (i *Image) Bytes() []byte {
+	return i.data
+}
+
+func (i *Image) Len() int {
+	return len(i.data)
+}
+
+// Slice returns length bytes at address, or an error if that runs off the end of the image.
+func (i *Image) Slice(address, length int) ([]byte, error) {
+	if address < 0 || length < 0 || address+length > len(i.data) {
+		return nil, fmt.Errorf("range 0x%X+%d outside image of %d bytes", address, length, len(i.data))
+	}
+	return i.data[address : address+length], nil
+}
+
+// Write overwrites bytes at address.
+func (i *Image) Write(address int, b []byte) error {
+	if address < 0 || address+len(b) > len(i.data) {
+		return fmt.Errorf("range 0x%X+%d outside image of %d bytes", address, len(b), len(i.data))
+	}
+	copy(i.data[address:], b)
+	return nil
+}
+
+func (i *Image) Save(path string) error {
+	return os.WriteFile(path, i.data, 0o644)
+}
@@ -0,0 +1,29 @@
+package rom
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// LoadJSON loads a JSON definition, the layout mirrors Definition.
+func LoadJSON(path string) (*Definition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read definition %s: %w", path, err)
+	}
+	definition := &Definition{}
+	if err = json.Unmarshal(data, definition); err != nil {
+		return nil, fmt.Errorf("parse definition %s: %w", path, err)
+	}
+	return definition, nil
+}
+
+// WriteJSON writes a definition as indented JSON.
+func WriteJSON(path string, definition *Definition) error {
+	data, err := json.MarshalIndent(definition, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,285 @@
+package rom
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"huskki/utils"
+)
+
+// XDF EMBEDDEDDATA mmedtypeflags
+const (
+	xdfFlagSigned      = 0x01
+	xdfFlagLSBFirst    = 0x02
+	xdfFlagColumnMajor = 0x04
+	xdfFlagFloat       = 0x10000
+)
+
+type xdfFormat struct {
+	XMLName xml.Name   `xml:"XDFFORMAT"`
+	Header  xdfHeader  `xml:"XDFHEADER"`
+	Tables  []xdfTable `xml:"XDFTABLE"`
+}
+
+type xdfHeader struct {
+	Title      string `xml:"deftitle"`
+	BaseOffset struct {
+		Offset   string `xml:"offset,attr"`
+		Subtract string `xml:"subtract,attr"`
+	} `xml:"BASEOFFSET"`
+	Categories []struct {
+		Index string `xml:"index,attr"`
+		Name  string `xml:"name,attr"`
+	} `xml:"CATEGORY"`
+}
+
+type xdfTable struct {
+	Title       string `xml:"title"`
+	Description string `xml:"description"`
+	Categories  []struct {
+		Category string `xml:"category,attr"`
+	} `xml:"CATEGORYMEM"`
+	Axes []xdfAxis `xml:"XDFAXIS"`
+}
+
+type xdfAxis struct {
+	ID       string `xml:"id,attr"`
+	Embedded *struct {
+		TypeFlags       string `xml:"mmedtypeflags,attr"`
+		Address         string `xml:"mmedaddress,attr"`
+		ElementSizeBits string `xml:"mmedelementsizebits,attr"`
+		RowCount        string `xml:"mmedrowcount,attr"`
+		ColCount        string `xml:"mmedcolcount,attr"`
+	} `xml:"EMBEDDEDDATA"`
+	Units      string `xml:"units"`
+	IndexCount string `xml:"indexcount"`
+	DecimalPl  string `xml:"decimalpl"`
+	Labels     []struct {
+		Index string `xml:"index,attr"`
+		Value string `xml:"value,attr"`
+	} `xml:"LABEL"`
+	Math struct {
+		Equation string `xml:"equation,attr"`
+	} `xml:"MATH"`
+}
+
+// LoadXDF loads the tables out of a TunerPro XDF. Constants, flags and patches are ignored, as are axes linked to
+// other tables.
+func LoadXDF(path string) (*Definition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read xdf %s: %w", path, err)
+	}
+	var xdf xdfFormat
+	if err = xml.Unmarshal(data, &xdf); err != nil {
+		return nil, fmt.Errorf("parse xdf %s: %w", path, err)
+	}
+
+	definition := &Definition{Name: strings.TrimSpace(xdf.Header.Title)}
+	baseOffset := xdfInt(xdf.Header.BaseOffset.Offset)
+	if xdfInt(xdf.Header.BaseOffset.Subtract) != 0 {
+		baseOffset = -baseOffset
+	}
+	definition.BaseOffset = baseOffset
+
+	// CATEGORYMEM refers to categories 1 indexed
+	categories := map[int]string{}
+	for _, c := range xdf.Header.Categories {
+		categories[xdfInt(c.Index)+1] = c.Name
+	}
+
+	for _, xt := range xdf.Tables {
+		t := &Table{
+			Title:       strings.TrimSpace(xt.Title),
+			Description: strings.TrimSpace(xt.Description),
+		}
+		t.Category = CategoryFromName(t.Title)
+		for _, member := range xt.Categories {
+			if category := CategoryFromName(categories[xdfInt(member.Category)]); category != CategoryOther {
+				t.Category = category
+				break
+			}
+		}
+
+		for _, axis := range xt.Axes {
+			switch strings.ToLower(axis.ID) {
+			case "z":
+				if axis.Embedded == nil {
+					return nil, fmt.Errorf("xdf table %q has no data", t.Title)
+				}
+				t.Units = strings.TrimSpace(axis.Units)
+				t.Rows = xdfInt(axis.Embedded.RowCount)
+				t.Cols = xdfInt(axis.Embedded.ColCount)
+				t.Data = xdfEncoding(axis)
+			case "x":
+				t.X = xdfTableAxis(axis)
+			case "y":
+				t.Y = xdfTableAxis(axis)
+			}
+		}
+		// XDF always has x and y axes, even on tables that are really just 2D, so drop the one that isn't used
+		if t.Rows <= 1 {
+			t.Y = nil
+		}
+		if t.Cols <= 1 && t.Rows > 1 {
+			t.X = nil
+		}
+		definition.Tables = append(definition.Tables, t)
+	}
+
+	return definition, nil
+}
+
+func xdfTableAxis(axis xdfAxis) *Axis {
+	a := &Axis{
+		Units: strings.TrimSpace(axis.Units),
+		Count: xdfInt(axis.IndexCount),
+	}
+	a.Title = a.Units
+	if axis.Embedded != nil && axis.Embedded.Address != "" {
+		encoding := xdfEncoding(axis)
+		a.Data = &encoding
+		return a
+	}
+	if len(axis.Labels) > 0 {
+		labels := make([]float64, len(axis.Labels))
+		for i, label := range axis.Labels {
+			v, err := strconv.ParseFloat(strings.TrimSpace(label.Value), 64)
+			if err != nil {
+				// non-numeric labels, fall back to numbering the axis
+				return a
+			}
+			labels[i] = v
+		}
+		a.Labels = labels
+	}
+	return a
+}
+
+func xdfEncoding(axis xdfAxis) Encoding {
+	flags := xdfInt(axis.Embedded.TypeFlags)
+	encoding := Encoding{
+		Address:      utils.HexUint32(xdfInt(axis.Embedded.Address)),
+		Bits:         xdfInt(axis.Embedded.ElementSizeBits),
+		Signed:       flags&xdfFlagSigned != 0,
+		LittleEndian: flags&xdfFlagLSBFirst != 0,
+		ColumnMajor:  flags&xdfFlagColumnMajor != 0,
+		Float:        flags&xdfFlagFloat != 0,
+		Decimals:     xdfInt(axis.DecimalPl),
+	}
+	// "X" on its own is the identity, no point evaluating it
+	if equation := strings.TrimSpace(axis.Math.Equation); equation != "" && !strings.EqualFold(equation, "x") {
+		encoding.Expr = equation
+	}
+	return encoding
+}
+
+// xdfInt parses XDF numbers which are a mix of decimal and 0x prefixed hex, anything unparseable is 0.
+func xdfInt(s string) int {
+	v, err := strconv.ParseInt(strings.TrimSpace(s), 0, 64)
+	if err != nil {
+		return 0
+	}
+	return int(v)
+}
+
+// WriteXDF writes a definition as a TunerPro XDF.
+func WriteXDF(path string, definition *Definition) error {
+	var b bytes.Buffer
+	b.WriteString("<!-- Written by huskki -->\n<XDFFORMAT version=\"1.60\">\n  <XDFHEADER>\n")
+	fmt.Fprintf(&b, "    <deftitle>%s</deftitle>\n", xmlEscape(definition.Name))
+	subtract := 0
+	baseOffset := definition.BaseOffset
+	if baseOffset < 0 {
+		subtract, baseOffset = 1, -baseOffset
+	}
+	fmt.Fprintf(&b, "    <BASEOFFSET offset=\"%d\" subtract=\"%d\" />\n", baseOffset, subtract)
+
+	// Categories are 0 indexed in the header and 1 indexed in tables
+	categoryIndex := map[string]int{}
+	for _, t := range definition.Tables {
+		if _, ok := categoryIndex[t.Category]; !ok {
+			categoryIndex[t.Category] = len(categoryIndex)
+			fmt.Fprintf(&b, "    <CATEGORY index=\"0x%X\" name=\"%s\" />\n", categoryIndex[t.Category], xmlEscape(t.Category))
+		}
+	}
+	b.WriteString("  </XDFHEADER>\n")
+
+	for i, t := range definition.Tables {
+		fmt.Fprintf(&b, "  <XDFTABLE uniqueid=\"0x%X\" flags=\"0x0\">\n", i+1)
+		fmt.Fprintf(&b, "    <title>%s</title>\n", xmlEscape(t.Title))
+		if t.Description != "" {
+			fmt.Fprintf(&b, "    <description>%s</description>\n", xmlEscape(t.Description))
+		}
+		fmt.Fprintf(&b, "    <CATEGORYMEM index=\"0\" category=\"%d\" />\n", categoryIndex[t.Category]+1)
+		writeXDFAxis(&b, "x", t.X, t.Cols)
+		writeXDFAxis(&b, "y", t.Y, t.Rows)
+		b.WriteString("    <XDFAXIS id=\"z\">\n")
+		writeXDFEmbedded(&b, &t.Data, t.Rows, t.Cols)
+		fmt.Fprintf(&b, "      <units>%s</units>\n", xmlEscape(t.Units))
+		writeXDFMath(&b, &t.Data)
+		b.WriteString("    </XDFAXIS>\n  </XDFTABLE>\n")
+	}
+	b.WriteString("</XDFFORMAT>\n")
+	return os.WriteFile(path, b.Bytes(), 0o644)
+}
+
+func writeXDFAxis(b *bytes.Buffer, id string, axis *Axis, count int) {
+	fmt.Fprintf(b, "    <XDFAXIS id=\"%s\">\n", id)
+	if axis != nil && axis.Data != nil {
+		writeXDFEmbedded(b, axis.Data, 0, 0)
+	}
+	if axis != nil {
+		fmt.Fprintf(b, "      <units>%s</units>\n", xmlEscape(axis.Title))
+	}
+	fmt.Fprintf(b, "      <indexcount>%d</indexcount>\n", count)
+	if axis != nil && axis.Data == nil {
+		for i, label := range axis.Labels {
+			fmt.Fprintf(b, "      <LABEL index=\"%d\" value=\"%s\" />\n", i, strconv.FormatFloat(label, 'f', -1, 64))
+		}
+	}
+	if axis != nil && axis.Data != nil {
+		writeXDFMath(b, axis.Data)
+	}
+	b.WriteString("    </XDFAXIS>\n")
+}
+
+func writeXDFEmbedded(b *bytes.Buffer, e *Encoding, rows, cols int) {
+	flags := 0
+	if e.Signed {
+		flags |= xdfFlagSigned
+	}
+	if e.LittleEndian {
+		flags |= xdfFlagLSBFirst
+	}
+	if e.ColumnMajor {
+		flags |= xdfFlagColumnMajor
+	}
+	if e.Float {
+		flags |= xdfFlagFloat
+	}
+	fmt.Fprintf(b, "      <EMBEDDEDDATA mmedtypeflags=\"0x%02X\" mmedaddress=\"0x%X\" mmedelementsizebits=\"%d\"", flags, uint32(e.Address), e.Bits)
+	if rows > 0 && cols > 0 {
+		fmt.Fprintf(b, " mmedrowcount=\"%d\" mmedcolcount=\"%d\"", rows, cols)
+	}
+	b.WriteString(" />\n")
+	fmt.Fprintf(b, "      <decimalpl>%d</decimalpl>\n", e.Decimals)
+}
+
+func writeXDFMath(b *bytes.Buffer, e *Encoding) {
+	equation := e.Expr
+	if equation == "" {
+		equation = "X"
+	}
+	fmt.Fprintf(b, "      <MATH equation=\"%s\">\n        <VAR id=\"X\" />\n      </MATH>\n", xmlEscape(equation))
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,333 @@
+package sim
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"huskki/ecus"
+	"huskki/uds"
+)
+
+const (
+	// DefaultMaxBlockLength is the largest TransferData request the virtual ECU accepts, 256 bytes of data plus the
+	// service ID and block sequence counter.
+	DefaultMaxBlockLength = 0x102
+	DefaultEraseDelay     = 500 * time.Millisecond
+
+	// maxKeyAttempts before the ECU locks out security access until it's reset
+	maxKeyAttempts = 3
+	erasedByte     = 0xFF
+)
+
+// ECU is a virtual K701 that answers UDS requests from memory, so anything that writes to an ECU can be developed
+// and exercised before it goes anywhere near a bike. It's a uds.Transport, hand it straight to uds.NewClient.
+//
+// It's deliberately strict: memory access needs security level 3, which needs level 2 first, and downloading needs the
+// programming session, which can only be entered from the extended session.
+type ECU struct {
+	mu        sync.Mutex
+	memory    []byte
+	dids      map[uint16][]byte
+	responses chan []byte
+
+	session   byte
+	unlocked  ecus.SecurityLevel
+	seeds     map[byte][2]byte
+	attempts  int
+	lockedOut bool
+	download  *download
+
+	// MaxBlockLength is reported in RequestDownload responses.
+	MaxBlockLength int
+	// EraseDelay is how long RequestDownload keeps the tester waiting with response pending while it "erases".
+	EraseDelay time.Duration
+}
+
+type download struct {
+	address, size, written uint32
+	sequence               byte
+}
+
+// NewECU creates a virtual ECU with its flash holding memory and answering ReadDataByIdentifier from dids.
+func NewECU(memory []byte, dids map[uint16][]byte) *ECU {
+	if dids == nil {
+		dids = map[uint16][]byte{}
+	}
+	return &ECU{
+		memory:         append([]byte(nil), memory...),
+		dids:           dids,
+		responses:      make(chan []byte, 16),
+		session:        uds.SessionDefault,
+		seeds:          map[byte][2]byte{},
+		MaxBlockLength: DefaultMaxBlockLength,
+		EraseDelay:     DefaultEraseDelay,
+	}
+}
+
+// Memory returns a copy of the ECU's flash.
+func (e *ECU) Memory() []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]byte(nil), e.memory...)
+}
+
+func (e *ECU) SetDID(did uint16, data []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dids[did] = data
+}
+
+func (e *ECU) Send(ctx context.Context, payload []byte) error {
+	if len(payload) == 0 {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	response, delay := e.handle(payload)
+	if response == nil {
+		return nil
+	}
+	if delay == 0 {
+		e.respond(response)
+		return nil
+	}
+	e.respond(negative(payload[0], uds.NrcResponsePending))
+	go func() {
+		time.Sleep(delay)
+		e.respond(response)
+	}()
+	return nil
+}
+
+func (e *ECU) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case response := <-e.responses:
+		return response, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (e *ECU) respond(response []byte) {
+	select {
+	case e.responses <- response:
+	default:
+		// Nobody is reading, a real ECU would just put it on the bus anyway
+	}
+}
+
+// handle returns the response to a request and how long to make the tester wait for it, or nil for no response.
+func (e *ECU) handle(request []byte) ([]byte, time.Duration) {
+	sid := request[0]
+	switch sid {
+	case uds.SidDiagnosticSessionControl:
+		return e.sessionControl(request), 0
+	case uds.SidEcuReset:
+		if len(request) != 2 {
+			return negative(sid, uds.NrcIncorrectMessageLength), 0
+		}
+		e.reset()
+		return []byte{sid + uds.PositiveResponseOffset, request[1]}, 0
+	case uds.SidTesterPresent:
+		if len(request) != 2 {
+			return negative(sid, uds.NrcIncorrectMessageLength), 0
+		}
+		// Bit 7 suppresses the positive response
+		if request[1]&0x80 != 0 {
+			return nil, 0
+		}
+		return []byte{sid + uds.PositiveResponseOffset, request[1]}, 0
+	case uds.SidReadDataByIdentifier:
+		if len(request) != 3 {
+			return negative(sid, uds.NrcIncorrectMessageLength), 0
+		}
+		data, ok := e.dids[uint16(request[1])<<8|uint16(request[2])]
+		if !ok {
+			return negative(sid, uds.NrcRequestOutOfRange), 0
+		}
+		return append([]byte{sid + uds.PositiveResponseOffset, request[1], request[2]}, data...), 0
+	case uds.SidReadMemoryByAddress:
+		return e.readMemory(request), 0
+	case uds.SidSecurityAccess:
+		return e.securityAccess(request), 0
+	case uds.SidRequestDownload:
+		return e.requestDownload(request)
+	case uds.SidTransferData:
+		return e.transferData(request), 0
+	case uds.SidRequestTransferExit:
+		if e.download == nil || e.download.written != e.download.size {
+			return negative(sid, uds.NrcRequestSequenceError), 0
+		}
+		e.download = nil
+		return []byte{sid + uds.PositiveResponseOffset}, 0
+	}
+	return negative(sid, uds.NrcServiceNotSupported), 0
+}
+
+func (e *ECU) sessionControl(request []byte) []byte {
+	sid := request[0]
+	if len(request) != 2 {
+		return negative(sid, uds.NrcIncorrectMessageLength)
+	}
+	session := request[1]
+	switch session {
+	case uds.SessionDefault, uds.SessionExtended:
+	case uds.SessionProgramming:
+		if e.session != uds.SessionExtended && e.session != uds.SessionProgramming {
+			return negative(sid, uds.NrcConditionsNotCorrect)
+		}
+	default:
+		return negative(sid, uds.NrcSubFunctionNotSupported)
+	}
+	// Changing session locks the ECU again and abandons any download
+	if session != e.session {
+		e.unlocked = 0
+		e.seeds = map[byte][2]byte{}
+		e.download = nil
+	}
+	e.session = session
+	// P2 50ms, P2* 5s
+	return []byte{sid + uds.PositiveResponseOffset, session, 0x00, 0x32, 0x01, 0xF4}
+}
+
+func (e *ECU) reset() {
+	e.session = uds.SessionDefault
+	e.unlocked = 0
+	e.seeds = map[byte][2]byte{}
+	e.attempts = 0
+	e.lockedOut = false
+	e.download = nil
+}
+
+func (e *ECU) securityAccess(request []byte) []byte {
+	sid := request[0]
+	if len(request) < 2 {
+		return negative(sid, uds.NrcIncorrectMessageLength)
+	}
+	subFunction := request[1]
+	level := ecus.SecurityLevel((subFunction + 1) / 2)
+	if level != ecus.SecurityLevel2 && level != ecus.SecurityLevel3 {
+		return negative(sid, uds.NrcSubFunctionNotSupported)
+	}
+	if e.lockedOut {
+		return negative(sid, uds.NrcExceededNumberOfAttempts)
+	}
+
+	// Odd sub-functions request a seed
+	if subFunction%2 == 1 {
+		if len(request) != 2 {
+			return negative(sid, uds.NrcIncorrectMessageLength)
+		}
+		if e.unlocked >= level {
+			return []byte{sid + uds.PositiveResponseOffset, subFunction, 0x00, 0x00}
+		}
+		if level == ecus.SecurityLevel3 && e.unlocked < ecus.SecurityLevel2 {
+			return negative(sid, uds.NrcConditionsNotCorrect)
+		}
+		seed := [2]byte{byte(rand.IntN(0xFF) + 1), byte(rand.IntN(0x100))}
+		e.seeds[subFunction] = seed
+		return []byte{sid + uds.PositiveResponseOffset, subFunction, seed[0], seed[1]}
+	}
+
+	// Even ones send the key for the seed before
+	if len(request) != 4 {
+		return negative(sid, uds.NrcIncorrectMessageLength)
+	}
+	seed, ok := e.seeds[subFunction-1]
+	if !ok {
+		return negative(sid, uds.NrcRequestSequenceError)
+	}
+	delete(e.seeds, subFunction-1)
+	keyHi, keyLo, err := ecus.GenerateK701Key(level, seed[0], seed[1])
+	if err != nil || request[2] != keyHi || request[3] != keyLo {
+		e.attempts++
+		if e.attempts >= maxKeyAttempts {
+			e.lockedOut = true
+			return negative(sid, uds.NrcExceededNumberOfAttempts)
+		}
+		return negative(sid, uds.NrcInvalidKey)
+	}
+	e.attempts = 0
+	e.unlocked = level
+	return []byte{sid + uds.PositiveResponseOffset, subFunction}
+}
+
+func (e *ECU) readMemory(request []byte) []byte {
+	sid := request[0]
+	if len(request) != 7 {
+		return negative(sid, uds.NrcIncorrectMessageLength)
+	}
+	if e.unlocked < ecus.SecurityLevel3 {
+		return negative(sid, uds.NrcSecurityAccessDenied)
+	}
+	address := int(request[2])<<16 | int(request[3])<<8 | int(request[4])
+	length := int(request[5])
+	if address+length > len(e.memory) {
+		return negative(sid, uds.NrcRequestOutOfRange)
+	}
+	return append([]byte{sid + uds.PositiveResponseOffset}, e.memory[address:address+length]...)
+}
+
+func (e *ECU) requestDownload(request []byte) ([]byte, time.Duration) {
+	sid := request[0]
+	if e.session != uds.SessionProgramming {
+		return negative(sid, uds.NrcServiceNotSupportedInSession), 0
+	}
+	if e.unlocked < ecus.SecurityLevel3 {
+		return negative(sid, uds.NrcSecurityAccessDenied), 0
+	}
+	// Only uncompressed, unencrypted, 3 byte address and 3 byte size
+	if len(request) != 9 {
+		return negative(sid, uds.NrcIncorrectMessageLength), 0
+	}
+	if request[1] != 0x00 || request[2] != 0x33 {
+		return negative(sid, uds.NrcRequestOutOfRange), 0
+	}
+	if e.download != nil {
+		return negative(sid, uds.NrcConditionsNotCorrect), 0
+	}
+	address := uint32(request[3])<<16 | uint32(request[4])<<8 | uint32(request[5])
+	size := uint32(request[6])<<16 | uint32(request[7])<<8 | uint32(request[8])
+	if size == 0 || int(address+size) > len(e.memory) {
+		return negative(sid, uds.NrcRequestOutOfRange), 0
+	}
+
+	for i := address; i < address+size; i++ {
+		e.memory[i] = erasedByte
+	}
+	e.download = &download{address: address, size: size, sequence: 1}
+	return []byte{sid + uds.PositiveResponseOffset, 0x20, byte(e.MaxBlockLength >> 8), byte(e.MaxBlockLength)}, e.EraseDelay
+}
+
+func (e *ECU) transferData(request []byte) []byte {
+	sid := request[0]
+	if e.download == nil {
+		return negative(sid, uds.NrcRequestSequenceError)
+	}
+	if len(request) < 3 || len(request) > e.MaxBlockLength {
+		return negative(sid, uds.NrcIncorrectMessageLength)
+	}
+	d := e.download
+	sequence := request[1]
+	// Repeating the last block is allowed in case its response was lost
+	if sequence == d.sequence-1 && d.written > 0 {
+		return []byte{sid + uds.PositiveResponseOffset, sequence}
+	}
+	if sequence != d.sequence {
+		return negative(sid, uds.NrcWrongBlockSequenceCounter)
+	}
+	data := request[2:]
+	if d.written+uint32(len(data)) > d.size {
+		return negative(sid, uds.NrcTransferDataSuspended)
+	}
+	copy(e.memory[d.address+d.written:], data)
+	d.written += uint32(len(data))
+	d.sequence++
+	return []byte{sid + uds.PositiveResponseOffset, sequence}
+}
+
+func negative(sid, nrc byte) []byte {
+	return []byte{uds.NegativeResponse, sid, nrc}
+}
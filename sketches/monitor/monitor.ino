@@ -1,6 +1,11 @@
 // ECU DID logger — Serial only (initial snapshot, then change-only)
 // Uses autowp/arduino-mcp2515. ISO-TP + UDS (0x22, 0x3E, 0x27).
-// Output rows to Serial (CSV): millis,DID,data_hex
+// Output to Serial: numbered binary AA 57 frames, or CSV rows (millis,DID,data_hex) with OUTPUT_CSV.
+// huskki's arduino driver reads either, see -serial-protocol.
+//
+// The host can change what's polled without reflashing, commands come in as [AA 5A][cmd][len][payload][crc8] and are
+// answered with [AA 5B][cmd][len][status, data][crc8], or "!cmd,status data" lines with OUTPUT_CSV. The CRC covers
+// everything after the magic. See drivers/arduino_commands.go for the commands.
 //
 // Depends on your did_list.h providing:
 //   extern const uint16_t DID_LIST[] PROGMEM;
@@ -11,6 +16,7 @@
 #include "did_list.h"
 
 #define LOG_ONLY_ON_CHANGE 1   // after first snapshot, only log when payload changes
+#define OUTPUT_CSV         0   // 1 = human readable rows e.g. "508,0x100,12 C0" instead of binary frames
 
 // ===== Pins / CAN config =====
 #define CAN_CS_PIN   9
@@ -25,7 +31,9 @@ static const uint32_t CAN_ID_RSP = 0x7E8;
 #define SID_TesterPresent              0x3E
 #define SID_SecurityAccess             0x27
 #define SID_ReadDataByIdentifier       0x22
+#define SID_ReadDTCInformation         0x19
 #define POS_OFFSET                     0x40
+#define SUB_DefaultSession             0x01
 #define SUB_ExtendedSession            0x03
 
 #define SA_L2_RequestSeed              0x03
@@ -39,6 +47,27 @@ const unsigned long SLOW_GAP_MS  = 20;  // between SLOW polls (full list)
 
 #define MIN(a,b) ((a)<(b)?(a):(b))
 
+#define FIRMWARE_VERSION "huskki-monitor 3"
+
+// ===== Host commands =====
+#define CMD_VERSION     0x01
+#define CMD_CLEAR_DIDS  0x02
+#define CMD_ADD_DID     0x03   // did u16 BE, interval ms u16 BE (0 = as often as possible)
+#define CMD_SECURITY    0x04   // levels to unlock in order, none = stay locked
+#define CMD_READ_DTCS   0x05   // ReadDTCInformation reportDTCByStatusMask, all statuses
+#define CMD_DEFAULT_SESSION 0x06 // stop polling and put the ECU back in its default session
+
+#define REPLY_OK          0x00
+#define REPLY_BAD_COMMAND 0x01
+#define REPLY_FULL        0x02
+#define REPLY_ECU_ERROR   0x03
+
+#define MAX_COMMAND_PAYLOAD 32
+
+#ifndef SERIAL_TX_BUFFER_SIZE
+#define SERIAL_TX_BUFFER_SIZE 64
+#endif
+
 // ===== FAST list (short = effectively faster polling) =====
 const uint16_t FAST_DIDS[] PROGMEM = {
   0x0100, // RPM (raw/4)
@@ -51,18 +80,27 @@ const uint16_t FAST_DIDS[] PROGMEM = {
 };
 const size_t FAST_COUNT = sizeof(FAST_DIDS)/sizeof(FAST_DIDS[0]);
 
+// ===== Polled DIDs, FAST_DIDS until the host sends its own list =====
+#define MAX_POLLED 32
+static uint16_t      polledDid[MAX_POLLED];
+static uint16_t      polledIntervalMs[MAX_POLLED];
+static unsigned long polledLast[MAX_POLLED];
+static uint8_t       polledCount = 0;
+
 // ===== Globals =====
 MCP2515 mcp2515(CAN_CS_PIN);
 struct can_frame rxFrame, txFrame;
 
 unsigned long lastTP = 0;
+bool holdSession = true;  // tester present keeps the session, and the security it unlocked, alive
+uint16_t txSeq = 0;   // sequence number of the next binary frame
 unsigned long lastFastReq = 0, lastSlowReq = 0;
-size_t fastIndex = 0, slowIndex = 0;
+size_t pollIndex = 0, slowIndex = 0;
 
-// Per-DID change tracking (FAST and SLOW)
-static uint8_t  lastChkFast[FAST_COUNT];
-static uint8_t  lastLenFast[FAST_COUNT];
-static bool     loggedOnceFast[FAST_COUNT];
+// Per-DID change tracking (polled and SLOW)
+static uint8_t  lastChkPolled[MAX_POLLED];
+static uint8_t  lastLenPolled[MAX_POLLED];
+static bool     loggedOncePolled[MAX_POLLED];
 
 static uint8_t  lastChkSlow[DID_COUNT];
 static uint8_t  lastLenSlow[DID_COUNT];
@@ -287,32 +325,181 @@ static inline uint8_t crc8_ccitt_buf(uint8_t crc, const uint8_t* p, size_t n) {
 void sendFrame(uint16_t did, const uint8_t* data, uint8_t len) {
   uint32_t ms = millis();
 
-  // Build header exactly as Go expects
-  uint8_t hdr[7];
-  hdr[0] = (uint8_t)(ms);
-  hdr[1] = (uint8_t)(ms >> 8);
-  hdr[2] = (uint8_t)(ms >> 16);
-  hdr[3] = (uint8_t)(ms >> 24);
-  hdr[4] = (uint8_t)(did >> 8);   // DID big-endian
-  hdr[5] = (uint8_t)(did);
-  hdr[6] = len;
-
-  // Compute CRC over millis + DID + len + data (NOT the magic)
+#if OUTPUT_CSV
+  Serial.print(ms);
+  Serial.print(F(",0x"));
+  Serial.print(did, HEX);
+  Serial.print(',');
+  for (uint8_t i = 0; i < len; i++) {
+    if (i) Serial.print(' ');
+    if (data[i] < 0x10) Serial.print('0');
+    Serial.print(data[i], HEX);
+  }
+  Serial.println();
+  return;
+#endif
+
+  // Numbered even when it's dropped below, the gap tells the host how many went missing
+  uint16_t seq = txSeq++;
+
+  // Build header exactly as Go expects (v3)
+  uint8_t hdr[10];
+  hdr[0] = (uint8_t)(seq);        // seq little-endian
+  hdr[1] = (uint8_t)(seq >> 8);
+  hdr[2] = (uint8_t)(ms);
+  hdr[3] = (uint8_t)(ms >> 8);
+  hdr[4] = (uint8_t)(ms >> 16);
+  hdr[5] = (uint8_t)(ms >> 24);
+  hdr[6] = 0;                     // ECU index, this sketch only polls one
+  hdr[7] = (uint8_t)(did >> 8);   // DID big-endian
+  hdr[8] = (uint8_t)(did);
+  hdr[9] = len;
+
+  // Drop the frame rather than stall polling when the host isn't keeping up
+  uint16_t frameLen = 2 + sizeof(hdr) + len + 1;
+  if (Serial.availableForWrite() < (int)MIN(frameLen, SERIAL_TX_BUFFER_SIZE - 1)) return;
+
+  // Compute CRC over seq + millis + ECU + DID + len + data (NOT the magic)
   uint8_t crc = 0x00;
-  crc = crc8_ccitt_buf(crc, hdr, 4);         // millis (4 LE)
-  crc = crc8_ccitt_update(crc, hdr[4]);        // DID hi
-  crc = crc8_ccitt_update(crc, hdr[5]);        // DID lo
-  crc = crc8_ccitt_update(crc, hdr[6]);        // len
+  crc = crc8_ccitt_buf(crc, hdr, sizeof(hdr));
   crc = crc8_ccitt_buf(crc, data, len);      // payload
 
   // Write the frame bytes (no newlines, no prints)
   Serial.write(0xAA);
-  Serial.write(0x55);
-  Serial.write(hdr, 7);
+  Serial.write(0x57);
+  Serial.write(hdr, sizeof(hdr));
   Serial.write(data, len);
   Serial.write(crc);
 }
 
+// Replies to a host command, status first then any data
+void sendReply(uint8_t cmd, uint8_t status, const uint8_t* data, uint8_t len) {
+#if OUTPUT_CSV
+  Serial.print('!');
+  if (cmd < 0x10) Serial.print('0');
+  Serial.print(cmd, HEX);
+  Serial.print(',');
+  if (status < 0x10) Serial.print('0');
+  Serial.print(status, HEX);
+  for (uint8_t i = 0; i < len; i++) {
+    Serial.print(' ');
+    if (data[i] < 0x10) Serial.print('0');
+    Serial.print(data[i], HEX);
+  }
+  Serial.println();
+  return;
+#endif
+
+  uint8_t hdr[3] = { cmd, (uint8_t)(len + 1), status };
+  uint8_t crc = crc8_ccitt_buf(0x00, hdr, 3);
+  crc = crc8_ccitt_buf(crc, data, len);
+
+  Serial.write(0xAA);
+  Serial.write(0x5B);
+  Serial.write(hdr, 3);
+  Serial.write(data, len);
+  Serial.write(crc);
+}
+
+bool addPolled(uint16_t did, uint16_t intervalMs) {
+  if (polledCount >= MAX_POLLED) return false;
+  polledDid[polledCount] = did;
+  polledIntervalMs[polledCount] = intervalMs;
+  polledLast[polledCount] = 0;
+  loggedOncePolled[polledCount] = false;
+  polledCount++;
+  return true;
+}
+
+void runCommand(uint8_t cmd, const uint8_t* payload, uint8_t len) {
+  switch (cmd) {
+    case CMD_VERSION:
+      sendReply(cmd, REPLY_OK, (const uint8_t*)FIRMWARE_VERSION, sizeof(FIRMWARE_VERSION) - 1);
+      return;
+
+    case CMD_CLEAR_DIDS:
+      polledCount = 0;
+      pollIndex = 0;
+      sendReply(cmd, REPLY_OK, nullptr, 0);
+      return;
+
+    case CMD_ADD_DID:
+      if (len != 4) break;
+      if (!addPolled(((uint16_t)payload[0] << 8) | payload[1], ((uint16_t)payload[2] << 8) | payload[3])) {
+        sendReply(cmd, REPLY_FULL, nullptr, 0);
+        return;
+      }
+      holdSession = true;
+      sendReply(cmd, REPLY_OK, nullptr, 0);
+      return;
+
+    case CMD_SECURITY:
+      holdSession = true;
+      for (uint8_t i = 0; i < len; i++) {
+        if (!securityAccessLevel(payload[i])) {
+          sendReply(cmd, REPLY_ECU_ERROR, &payload[i], 1);
+          return;
+        }
+      }
+      sendReply(cmd, REPLY_OK, nullptr, 0);
+      return;
+
+    case CMD_READ_DTCS: {
+      uint8_t req[] = { SID_ReadDTCInformation, 0x02, 0xFF };
+      uint8_t rsp[128]; uint16_t rlen = 0;
+      if (!udsRequest(req, sizeof(req), rsp, rlen, sizeof(rsp), 3000)) {
+        sendReply(cmd, REPLY_ECU_ERROR, nullptr, 0);
+        return;
+      }
+      sendReply(cmd, REPLY_OK, rsp, (uint8_t)rlen);
+      return;
+    }
+
+    case CMD_DEFAULT_SESSION: {
+      polledCount = 0;
+      pollIndex = 0;
+      holdSession = false;
+      uint8_t req[] = { SID_DiagnosticSessionControl, SUB_DefaultSession };
+      uint8_t rsp[8]; uint16_t rlen = 0;
+      if (!udsRequest(req, sizeof(req), rsp, rlen, sizeof(rsp)) || rlen < 2 ||
+          rsp[0] != (SID_DiagnosticSessionControl + POS_OFFSET)) {
+        sendReply(cmd, REPLY_ECU_ERROR, nullptr, 0);
+        return;
+      }
+      sendReply(cmd, REPLY_OK, nullptr, 0);
+      return;
+    }
+  }
+  sendReply(cmd, REPLY_BAD_COMMAND, nullptr, 0);
+}
+
+// Reads host commands a byte at a time so polling never waits on the host, resyncing on AA 5A after a bad CRC
+void readCommands() {
+  static uint8_t state = 0, cmd = 0, len = 0, pos = 0, crc = 0;
+  static uint8_t payload[MAX_COMMAND_PAYLOAD];
+
+  while (Serial.available() > 0) {
+    uint8_t b = Serial.read();
+    switch (state) {
+      case 0: state = (b == 0xAA) ? 1 : 0; break;
+      case 1: state = (b == 0x5A) ? 2 : (b == 0xAA ? 1 : 0); break;
+      case 2: cmd = b; crc = crc8_ccitt_update(0x00, b); state = 3; break;
+      case 3:
+        len = b; pos = 0; crc = crc8_ccitt_update(crc, b);
+        state = (len > MAX_COMMAND_PAYLOAD) ? 0 : (len ? 4 : 5);
+        break;
+      case 4:
+        payload[pos++] = b; crc = crc8_ccitt_update(crc, b);
+        if (pos == len) state = 5;
+        break;
+      case 5:
+        state = 0;
+        if (b == crc) runCommand(cmd, payload, len);
+        break;
+    }
+  }
+}
+
 // ===== Setup / Loop =====
 void setup() {
   Serial.begin(115200);
@@ -332,7 +519,14 @@ void setup() {
   (void)securityAccessLevel(2);
   (void)securityAccessLevel(3);
 
+  for (size_t i = 0; i < FAST_COUNT; i++) {
+    uint16_t did; memcpy_P(&did, &FAST_DIDS[i], sizeof(uint16_t));
+    addPolled(did, 0);
+  }
+
   lastTP = lastFastReq = lastSlowReq = millis();
+  // Say hello so the host knows it can send commands
+  runCommand(CMD_VERSION, nullptr, 0);
 }
 
 void pollOne(uint16_t did, uint8_t* lastChkArr, uint8_t* lastLenArr, bool* loggedOnceArr, size_t idx) {
@@ -365,13 +559,20 @@ void pollOne(uint16_t did, uint8_t* lastChkArr, uint8_t* lastLenArr, bool* logge
 
 void loop() {
   unsigned long now = millis();
-  if (now - lastTP >= TESTER_PRESENT_PERIOD_MS) { testerPresent(); lastTP = now; }
-
-  // FAST round-robin
-  if (now - lastFastReq >= FAST_GAP_MS) {
-    uint16_t did; memcpy_P(&did, &FAST_DIDS[fastIndex], sizeof(uint16_t));
-    pollOne(did, lastChkFast, lastLenFast, loggedOnceFast, fastIndex);
-    fastIndex = (fastIndex + 1) % FAST_COUNT;
+  if (holdSession && now - lastTP >= TESTER_PRESENT_PERIOD_MS) { testerPresent(); lastTP = now; }
+
+  readCommands();
+
+  // Round-robin over the polled DIDs, skipping ones polled within their interval
+  if (polledCount > 0 && now - lastFastReq >= FAST_GAP_MS) {
+    for (uint8_t tried = 0; tried < polledCount; tried++) {
+      size_t i = pollIndex;
+      pollIndex = (pollIndex + 1) % polledCount;
+      if (polledLast[i] != 0 && now - polledLast[i] < polledIntervalMs[i]) continue;
+      pollOne(polledDid[i], lastChkPolled, lastLenPolled, loggedOncePolled, i);
+      polledLast[i] = now;
+      break;
+    }
     lastFastReq = now;
   }
 
@@ -0,0 +1,17 @@
+package store
+
+import "huskki/ecus"
+
+// ECUInfo is what's known about one of the ECUs the dashboard is showing, for the ECU info card and log metadata.
+type ECUInfo struct {
+	// ECU is the registered profile name or the path of the profile file.
+	ECU          string
+	Profile      string
+	Experimental bool
+	// Identification is empty when the driver can't read it, e.g. the Arduino.
+	Identification ecus.Identification
+}
+
+// ECUs are in the same order as the session's ecus.Set and have to be set before the driver or UI start, like the
+// streams.
+var ECUs []*ECUInfo
@@ -0,0 +1,35 @@
+package store
+
+import (
+	"time"
+
+	"huskki/ecus"
+	"huskki/events"
+	"huskki/models"
+)
+
+// StreamFrames adds the values of every frame from sub to their dashboard streams, as of when the frame was read,
+// until sub is closed.
+func StreamFrames(sub *events.Subscription) {
+	for frame := range sub.Frames() {
+		for _, didDatum := range frame.Values {
+			if didDatum.StreamKey == "" {
+				continue
+			}
+			if stream, ok := DashboardStreams[didDatum.StreamKey]; ok {
+				addPointToStream(stream, didDatum, frame.At)
+			}
+		}
+	}
+}
+
+func addPointToStream(stream *models.Stream, didDatum *ecus.DIDData, at time.Time) {
+	if stream.Discrete() {
+		// Add point with same timestamp and the last point's value if this is discrete data so we get that nice
+		// stepped look
+		// Set time back 1 ms so we don't have multiple points on the same timestamp
+		stream.Add(int(at.UnixMilli())-1, stream.Latest().Value())
+	}
+
+	stream.Add(int(at.UnixMilli()), didDatum.DidValue)
+}
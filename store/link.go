@@ -0,0 +1,31 @@
+package store
+
+import "sync/atomic"
+
+// LinkStats counts what came over the Arduino's serial link, for the link card.
+type LinkStats struct {
+	Frames atomic.Uint64
+	// Dropped are frames the sequence numbers say never arrived, whether the Arduino couldn't send them or they were
+	// lost on the way.
+	Dropped atomic.Uint64
+	// Errors are frames and rows that didn't read, CRC errors and the like.
+	Errors atomic.Uint64
+	// Sequenced is set by the first numbered frame, drops can't be counted for sketches that don't number them.
+	Sequenced atomic.Bool
+	// Connected is whether the Arduino is plugged in, Reconnects how many times it came back after going away.
+	Connected  atomic.Bool
+	Reconnects atomic.Uint64
+}
+
+// DropRate is the percentage of frames that were dropped.
+func (l *LinkStats) DropRate() float64 {
+	dropped := l.Dropped.Load()
+	total := l.Frames.Load() + dropped
+	if total == 0 {
+		return 0
+	}
+	return float64(dropped) / float64(total) * 100
+}
+
+// Link is nil unless the driver reads a serial link, it has to be set before the driver or UI start, like the streams.
+var Link *LinkStats
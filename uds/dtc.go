@@ -0,0 +1,52 @@
+package uds
+
+import (
+	"context"
+	"fmt"
+)
+
+// ReadDTCInformation sub-functions
+const (
+	ReportDTCByStatusMask = 0x02
+)
+
+// DTC is a diagnostic trouble code, Code is the 3 byte DTC and Status its status byte.
+type DTC struct {
+	Code   uint32
+	Status byte
+}
+
+// String writes the DTC the SAE J2012 way with its failure type after the dash, e.g. P0123-00.
+func (d DTC) String() string {
+	system := "PCBU"[d.Code>>22&0x03]
+	return fmt.Sprintf("%c%04X-%02X", system, d.Code>>8&0x3FFF, byte(d.Code))
+}
+
+// ParseDTCs reads the DTCs out of a positive reportDTCByStatusMask response,
+// [59 02][availability mask]([DTC:3][status])...
+func ParseDTCs(response []byte) ([]DTC, error) {
+	if len(response) < 3 || response[0] != SidReadDTCInformation+PositiveResponseOffset || response[1] != ReportDTCByStatusMask {
+		return nil, fmt.Errorf("unexpected DTC response % X", response)
+	}
+	records := response[3:]
+	if len(records)%4 != 0 {
+		return nil, fmt.Errorf("DTC records are %d bytes, not a multiple of 4", len(records))
+	}
+	dtcs := make([]DTC, 0, len(records)/4)
+	for i := 0; i < len(records); i += 4 {
+		dtcs = append(dtcs, DTC{
+			Code:   uint32(records[i])<<16 | uint32(records[i+1])<<8 | uint32(records[i+2]),
+			Status: records[i+3],
+		})
+	}
+	return dtcs, nil
+}
+
+// ReadDTCs reads the DTCs whose status matches statusMask, 0xFF for all of them.
+func (c *Client) ReadDTCs(ctx context.Context, statusMask byte) ([]DTC, error) {
+	response, err := c.Request(ctx, []byte{SidReadDTCInformation, ReportDTCByStatusMask, statusMask})
+	if err != nil {
+		return nil, err
+	}
+	return ParseDTCs(response)
+}
@@ -0,0 +1,135 @@
+package uds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// IsotpSocket is a Transport over a kernel ISO-TP socket, the kernel takes care of segmentation and flow control.
+type IsotpSocket struct {
+	file *os.File
+	buf  []byte
+}
+
+// DialIsotp opens an ISO-TP socket on a SocketCAN interface sending on txID and receiving on rxID.
+func DialIsotp(interfaceName string, txID, rxID uint32) (*IsotpSocket, error) {
+	ifi, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return nil, fmt.Errorf("lookup interface %s: %w", interfaceName, err)
+	}
+	fd, err := unix.Socket(unix.AF_CAN, unix.SOCK_DGRAM, unix.CAN_ISOTP)
+	if err != nil {
+		return nil, fmt.Errorf("open isotp socket: %w", err)
+	}
+	if err = unix.Bind(fd, &unix.SockaddrCAN{Ifindex: ifi.Index, RxID: rxID, TxID: txID}); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("bind isotp socket: %w", err)
+	}
+	// Non-blocking so the runtime poller owns the fd and read deadlines work
+	if err = unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("set isotp socket non-blocking: %w", err)
+	}
+	return &IsotpSocket{os.NewFile(uintptr(fd), "isotp"), make([]byte, 4096)}, nil
+}
+
+func (s *IsotpSocket) Send(ctx context.Context, payload []byte) error {
+	if err := s.file.SetWriteDeadline(deadline(ctx)); err != nil {
+		return err
+	}
+	for {
+		_, err := s.file.Write(payload)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		return err
+	}
+}
+
+func (s *IsotpSocket) Receive(ctx context.Context) ([]byte, error) {
+	if err := s.file.SetReadDeadline(deadline(ctx)); err != nil {
+		return nil, err
+	}
+	for {
+		n, err := s.file.Read(s.buf)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), s.buf[:n]...), nil
+	}
+}
+
+func (s *IsotpSocket) Close() error {
+	return s.file.Close()
+}
+
+// deadline is the context's deadline, or no deadline at all.
+func deadline(ctx context.Context) time.Time {
+	d, _ := ctx.Deadline()
+	return d
+}
+
+// Reassembler puts ISO-TP messages back together from the frames on one CAN ID, for reading captures where the
+// kernel hasn't done it. Flow control frames are the
+// other side's and are skipped.
+type Reassembler struct {
+	buf  []byte
+	want int
+	seq  byte
+}
+
+// Add takes the next frame and returns the message once it's complete.
+func (r *Reassembler) Add(data []byte) ([]byte, bool) {
+	if len(data) == 0 {
+		return nil, false
+	}
+	switch data[0] >> 4 {
+	case 0x0: // single frame
+		length, payload := int(data[0]&0x0F), data[1:]
+		// CAN FD single frames escape lengths over 7 into the next byte
+		if length == 0 && len(data) > 1 {
+			length, payload = int(data[1]), data[2:]
+		}
+		r.buf = nil
+		if length == 0 || len(payload) < length {
+			return nil, false
+		}
+		return payload[:length], true
+	case 0x1: // first frame
+		if len(data) < 2 {
+			return nil, false
+		}
+		r.want = int(data[0]&0x0F)<<8 | int(data[1])
+		r.buf = append([]byte(nil), data[2:]...)
+		r.seq = 1
+	case 0x2: // consecutive frame
+		if r.buf == nil {
+			return nil, false
+		}
+		if data[0]&0x0F != r.seq {
+			// Lost a frame, this message can't be trusted
+			r.buf = nil
+			return nil, false
+		}
+		r.buf = append(r.buf, data[1:]...)
+		r.seq = (r.seq + 1) & 0x0F
+	default:
+		return nil, false
+	}
+	if r.buf != nil && len(r.buf) >= r.want {
+		message := r.buf[:r.want]
+		r.buf = nil
+		return message, true
+	}
+	return nil, false
+}
@@ -0,0 +1,310 @@
+package uds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Service IDs
+const (
+	SidDiagnosticSessionControl = 0x10
+	SidEcuReset                 = 0x11
+	SidClearDiagnosticInfo      = 0x14
+	SidReadDTCInformation       = 0x19
+	SidReadDataByIdentifier     = 0x22
+	SidReadMemoryByAddress      = 0x23
+	SidSecurityAccess           = 0x27
+	SidCommunicationControl     = 0x28
+	SidWriteDataByIdentifier    = 0x2E
+	SidIOControlByIdentifier    = 0x2F
+	SidRoutineControl           = 0x31
+	SidRequestDownload          = 0x34
+	SidRequestUpload            = 0x35
+	SidTransferData             = 0x36
+	SidRequestTransferExit      = 0x37
+	SidWriteMemoryByAddress     = 0x3D
+	SidTesterPresent            = 0x3E
+	SidControlDTCSetting        = 0x85
+
+	PositiveResponseOffset = 0x40
+	NegativeResponse       = 0x7F
+)
+
+// Diagnostic sessions
+const (
+	SessionDefault     = 0x01
+	SessionProgramming = 0x02
+	SessionExtended    = 0x03
+)
+
+// ECU reset types
+const (
+	ResetHard = 0x01
+)
+
+// Negative response codes
+const (
+	NrcGeneralReject                    = 0x10
+	NrcServiceNotSupported              = 0x11
+	NrcSubFunctionNotSupported          = 0x12
+	NrcIncorrectMessageLength           = 0x13
+	NrcConditionsNotCorrect             = 0x22
+	NrcRequestSequenceError             = 0x24
+	NrcRequestOutOfRange                = 0x31
+	NrcSecurityAccessDenied             = 0x33
+	NrcInvalidKey                       = 0x35
+	NrcExceededNumberOfAttempts         = 0x36
+	NrcRequiredTimeDelayNotExpired      = 0x37
+	NrcUploadDownloadNotAccepted        = 0x70
+	NrcTransferDataSuspended            = 0x71
+	NrcGeneralProgrammingFailure        = 0x72
+	NrcWrongBlockSequenceCounter        = 0x73
+	NrcResponsePending                  = 0x78
+	NrcServiceNotSupportedInSession     = 0x7F
+	NrcSubFunctionNotSupportedInSession = 0x7E
+)
+
+var serviceNames = map[byte]string{
+	SidDiagnosticSessionControl: "DiagnosticSessionControl",
+	SidEcuReset:                 "ECUReset",
+	SidClearDiagnosticInfo:      "ClearDiagnosticInformation",
+	SidReadDTCInformation:       "ReadDTCInformation",
+	SidReadDataByIdentifier:     "ReadDataByIdentifier",
+	SidReadMemoryByAddress:      "ReadMemoryByAddress",
+	SidSecurityAccess:           "SecurityAccess",
+	SidCommunicationControl:     "CommunicationControl",
+	SidWriteDataByIdentifier:    "WriteDataByIdentifier",
+	SidIOControlByIdentifier:    "InputOutputControlByIdentifier",
+	SidRoutineControl:           "RoutineControl",
+	SidRequestDownload:          "RequestDownload",
+	SidRequestUpload:            "RequestUpload",
+	SidTransferData:             "TransferData",
+	SidRequestTransferExit:      "RequestTransferExit",
+	SidWriteMemoryByAddress:     "WriteMemoryByAddress",
+	SidTesterPresent:            "TesterPresent",
+	SidControlDTCSetting:        "ControlDTCSetting",
+}
+
+// ServiceName names a request's service ID, e.g. "ReadDataByIdentifier" for 0x22.
+func ServiceName(sid byte) string {
+	if name, ok := serviceNames[sid]; ok {
+		return name
+	}
+	return fmt.Sprintf("service 0x%02X", sid)
+}
+
+var nrcNames = map[byte]string{
+	NrcGeneralReject:                    "general reject",
+	NrcServiceNotSupported:              "service not supported",
+	NrcSubFunctionNotSupported:          "sub-function not supported",
+	NrcIncorrectMessageLength:           "incorrect message length",
+	NrcConditionsNotCorrect:             "conditions not correct",
+	NrcRequestSequenceError:             "request sequence error",
+	NrcRequestOutOfRange:                "request out of range",
+	NrcSecurityAccessDenied:             "security access denied",
+	NrcInvalidKey:                       "invalid key",
+	NrcExceededNumberOfAttempts:         "exceeded number of attempts",
+	NrcRequiredTimeDelayNotExpired:      "required time delay not expired",
+	NrcUploadDownloadNotAccepted:        "upload/download not accepted",
+	NrcTransferDataSuspended:            "transfer data suspended",
+	NrcGeneralProgrammingFailure:        "general programming failure",
+	NrcWrongBlockSequenceCounter:        "wrong block sequence counter",
+	NrcResponsePending:                  "response pending",
+	NrcServiceNotSupportedInSession:     "service not supported in active session",
+	NrcSubFunctionNotSupportedInSession: "sub-function not supported in active session",
+}
+
+const (
+	DefaultTimeout = 300 * time.Millisecond
+	// DefaultPendingTimeout is how long to wait after the ECU says it's busy, erasing flash can take seconds.
+	DefaultPendingTimeout = 10 * time.Second
+)
+
+// NegativeResponseError is a 0x7F response from the ECU.
+type NegativeResponseError struct {
+	SID byte
+	NRC byte
+}
+
+func (e *NegativeResponseError) Error() string {
+	return fmt.Sprintf("service 0x%02X: NRC 0x%02X (%s)", e.SID, e.NRC, NRCName(e.NRC))
+}
+
+// NRCName says what a negative response code means, e.g. "request out of range" for 0x31.
+func NRCName(nrc byte) string {
+	if name, ok := nrcNames[nrc]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// IsNRC reports whether err is a negative response with the given code.
+func IsNRC(err error, nrc byte) bool {
+	var nre *NegativeResponseError
+	return errors.As(err, &nre) && nre.NRC == nrc
+}
+
+// Transport carries whole UDS messages to and from the ECU, it's up to the transport to do any ISO-TP framing.
+type Transport interface {
+	Send(ctx context.Context, payload []byte) error
+	Receive(ctx context.Context) ([]byte, error)
+}
+
+// Client makes UDS requests over a Transport.
+type Client struct {
+	transport Transport
+	// Timeout is how long to wait for a response, PendingTimeout replaces it each time the ECU says it's busy.
+	Timeout        time.Duration
+	PendingTimeout time.Duration
+}
+
+func NewClient(transport Transport) *Client {
+	return &Client{transport, DefaultTimeout, DefaultPendingTimeout}
+}
+
+// Request sends a request and waits for its positive response, waiting out any response pending replies on the way.
+// Negative responses come back as a *NegativeResponseError.
+func (c *Client) Request(ctx context.Context, request []byte) ([]byte, error) {
+	if len(request) == 0 {
+		return nil, errors.New("empty request")
+	}
+	sid := request[0]
+	if err := c.transport.Send(ctx, request); err != nil {
+		return nil, fmt.Errorf("send service 0x%02X: %w", sid, err)
+	}
+
+	timeout := c.Timeout
+	for {
+		receiveCtx, cancel := context.WithTimeout(ctx, timeout)
+		response, err := c.transport.Receive(receiveCtx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("receive service 0x%02X: %w", sid, err)
+		}
+		switch {
+		case len(response) >= 3 && response[0] == NegativeResponse && response[1] == sid:
+			if response[2] == NrcResponsePending {
+				timeout = c.PendingTimeout
+				continue
+			}
+			return nil, &NegativeResponseError{sid, response[2]}
+		case len(response) >= 1 && response[0] == sid+PositiveResponseOffset:
+			return response, nil
+		}
+		// Anything else is a late response to an earlier request, skip it
+	}
+}
+
+func (c *Client) DiagnosticSessionControl(ctx context.Context, session byte) error {
+	_, err := c.Request(ctx, []byte{SidDiagnosticSessionControl, session})
+	return err
+}
+
+func (c *Client) EcuReset(ctx context.Context, resetType byte) error {
+	_, err := c.Request(ctx, []byte{SidEcuReset, resetType})
+	return err
+}
+
+func (c *Client) TesterPresent(ctx context.Context) error {
+	_, err := c.Request(ctx, []byte{SidTesterPresent, 0x00})
+	return err
+}
+
+// SecurityAccess requests a seed with seedSubFunction and answers it with whatever key returns. A seed of all zeros
+// means the level is already unlocked.
+func (c *Client) SecurityAccess(ctx context.Context, seedSubFunction byte, key func(seed []byte) ([]byte, error)) error {
+	response, err := c.Request(ctx, []byte{SidSecurityAccess, seedSubFunction})
+	if err != nil {
+		return fmt.Errorf("request seed: %w", err)
+	}
+	if len(response) < 3 || response[1] != seedSubFunction {
+		return fmt.Errorf("unexpected seed response % X", response)
+	}
+	seed := response[2:]
+	unlocked := true
+	for _, b := range seed {
+		if b != 0 {
+			unlocked = false
+			break
+		}
+	}
+	if unlocked {
+		return nil
+	}
+
+	k, err := key(seed)
+	if err != nil {
+		return fmt.Errorf("generate key: %w", err)
+	}
+	response, err = c.Request(ctx, append([]byte{SidSecurityAccess, seedSubFunction + 1}, k...))
+	if err != nil {
+		return fmt.Errorf("send key: %w", err)
+	}
+	if len(response) < 2 || response[1] != seedSubFunction+1 {
+		return fmt.Errorf("unexpected key response % X", response)
+	}
+	return nil
+}
+
+func (c *Client) ReadDataByIdentifier(ctx context.Context, did uint16) ([]byte, error) {
+	response, err := c.Request(ctx, []byte{SidReadDataByIdentifier, byte(did >> 8), byte(did)})
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 3 || response[1] != byte(did>>8) || response[2] != byte(did) {
+		return nil, fmt.Errorf("unexpected response for DID 0x%04X: % X", did, response)
+	}
+	return response[3:], nil
+}
+
+// ReadMemoryByAddress reads length bytes from a 24 bit address, the way the K701 expects it.
+func (c *Client) ReadMemoryByAddress(ctx context.Context, address uint32, length uint8) ([]byte, error) {
+	response, err := c.Request(ctx, []byte{SidReadMemoryByAddress, 0x00, byte(address >> 16), byte(address >> 8), byte(address), length, 0x00})
+	if err != nil {
+		return nil, err
+	}
+	return response[1:], nil
+}
+
+// RequestDownload asks the ECU to accept size bytes at a 24 bit address and returns the largest TransferData request
+// it will take, including the service ID and block sequence counter.
+func (c *Client) RequestDownload(ctx context.Context, address, size uint32) (int, error) {
+	// No compression or encryption, 3 byte size, 3 byte address
+	request := []byte{SidRequestDownload, 0x00, 0x33,
+		byte(address >> 16), byte(address >> 8), byte(address),
+		byte(size >> 16), byte(size >> 8), byte(size)}
+	response, err := c.Request(ctx, request)
+	if err != nil {
+		return 0, err
+	}
+	if len(response) < 2 {
+		return 0, fmt.Errorf("unexpected download response % X", response)
+	}
+	lengthBytes := int(response[1] >> 4)
+	if lengthBytes == 0 || len(response) < 2+lengthBytes {
+		return 0, fmt.Errorf("unexpected download response % X", response)
+	}
+	var maxBlockLength int
+	for _, b := range response[2 : 2+lengthBytes] {
+		maxBlockLength = maxBlockLength<<8 | int(b)
+	}
+	return maxBlockLength, nil
+}
+
+func (c *Client) TransferData(ctx context.Context, sequence byte, data []byte) error {
+	response, err := c.Request(ctx, append([]byte{SidTransferData, sequence}, data...))
+	if err != nil {
+		return err
+	}
+	if len(response) < 2 || response[1] != sequence {
+		return fmt.Errorf("unexpected transfer response % X", response)
+	}
+	return nil
+}
+
+func (c *Client) RequestTransferExit(ctx context.Context) error {
+	_, err := c.Request(ctx, []byte{SidRequestTransferExit})
+	return err
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// HexUint32 is a uint32 that can be written in JSON as either a number or a hex string like "0x7E0", which is how
+// addresses, DIDs and CAN IDs are always written down everywhere else.
+type HexUint32 uint32
+
+func (h *HexUint32) UnmarshalJSON(data []byte) error {
+	var number uint32
+	if err := json.Unmarshal(data, &number); err == nil {
+		*h = HexUint32(number)
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("expected number or hex string, got %s", data)
+	}
+	v, err := ParseHexUint32(text)
+	if err != nil {
+		return err
+	}
+	*h = v
+	return nil
+}
+
+func (h HexUint32) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.String())
+}
+
+func (h HexUint32) String() string {
+	return fmt.Sprintf("0x%X", uint32(h))
+}
+
+// ParseHexUint32 parses "0x1F", "1F" or "1fh" as hex.
+func ParseHexUint32(text string) (HexUint32, error) {
+	s := strings.TrimSpace(strings.ToLower(text))
+	s = strings.TrimPrefix(s, "0x")
+	s = strings.TrimSuffix(s, "h")
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad hex value %q", text)
+	}
+	return HexUint32(v), nil
+}
@@ -0,0 +1,147 @@
+package web
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"huskki/rom"
+	"huskki/store"
+
+	ds "github.com/starfederation/datastar-go/datastar"
+)
+
+type Calibration struct {
+	templates *template.Template
+
+	definition *rom.Definition
+	tables     []*rom.TableData
+}
+
+type tableCategory struct {
+	Name   string
+	Tables []*rom.TableData
+}
+
+func NewCalibration(definition *rom.Definition, image *rom.Image) (calibration *Calibration, err error) {
+	calibration = &Calibration{definition: definition}
+	calibration.tables, err = definition.ReadAll(image)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := template.New("").Funcs(template.FuncMap{
+		"heat":   heatColour,
+		"format": func(v float64, decimals int) string { return fmt.Sprintf("%.*f", decimals, v) },
+		"title": func(s string) string {
+			if s == "" {
+				return s
+			}
+			return strings.ToUpper(s[:1]) + s[1:]
+		},
+	})
+	calibration.templates, err = templates.ParseGlob("web/templates/calibration/*.gohtml")
+	return calibration, err
+}
+
+func (c *Calibration) Handlers() map[string]func(w http.ResponseWriter, r *http.Request) {
+	return map[string]func(w http.ResponseWriter, r *http.Request){
+		"/calibration":      c.IndexHandler,
+		"/calibration/tick": c.TickHandler,
+	}
+}
+
+func (c *Calibration) Data() map[string]interface{} {
+	return map[string]interface{}{
+		"name":       c.definition.Name,
+		"categories": c.categories(),
+	}
+}
+
+// IndexHandler renders every table in the definition grouped by category.
+func (c *Calibration) IndexHandler(w http.ResponseWriter, _ *http.Request) {
+	err := c.templates.ExecuteTemplate(w, "calibration", c.Data())
+	if err != nil {
+		log.Printf("couldn't execute template for calibration %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// TickHandler streams the live cell and trail for every table whose axes are indexed by live streams. Each client
+// gets its own trail starting from when it connected.
+func (c *Calibration) TickHandler(w http.ResponseWriter, r *http.Request) {
+	var tracers []*tableTracer
+	for _, t := range c.tables {
+		if tracer := newTableTracer(t); tracer != nil {
+			tracers = append(tracers, tracer)
+		}
+	}
+	if len(tracers) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	sse := ds.NewSSE(w, r)
+
+	ctx := r.Context()
+	ticker := time.NewTicker(1000 / store.DASHBOARD_FRAMERATE * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case tick := <-ticker.C:
+			for _, tracer := range tracers {
+				script := tracer.OnTick(tick)
+				if script == "" {
+					continue
+				}
+				if err := sse.ExecuteScript(script); err != nil {
+					log.Printf("error executing trace function: %s", err)
+					return
+				}
+			}
+		}
+	}
+}
+
+// categories groups tables by category with the well known categories first.
+func (c *Calibration) categories() []*tableCategory {
+	byName := map[string]*tableCategory{}
+	var categories []*tableCategory
+	for _, t := range c.tables {
+		category, ok := byName[t.Category]
+		if !ok {
+			category = &tableCategory{Name: t.Category}
+			byName[t.Category] = category
+			categories = append(categories, category)
+		}
+		category.Tables = append(category.Tables, t)
+	}
+	slices.SortStableFunc(categories, func(a, b *tableCategory) int {
+		return categoryRank(a.Name) - categoryRank(b.Name)
+	})
+	return categories
+}
+
+func categoryRank(name string) int {
+	if i := slices.Index(rom.CategoryOrder, name); i >= 0 {
+		return i
+	}
+	return len(rom.CategoryOrder)
+}
+
+// heatColour maps a value between min and max onto a blue (low) to red (high) hue.
+func heatColour(value, min, max float64) template.CSS {
+	t := 0.5
+	if max > min {
+		t = math.Max(0, math.Min(1, (value-min)/(max-min)))
+	}
+	return template.CSS(fmt.Sprintf("hsl(%.0f, 75%%, 38%%)", 240*(1-t)))
+}
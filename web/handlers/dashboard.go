@@ -48,6 +48,8 @@ func (d *Dashboard) Handlers() map[string]func(w http.ResponseWriter, r *http.Re
 func (d *Dashboard) Data() map[string]interface{} {
 	return map[string]interface{}{
 		"charts": store.OrderedCharts(),
+		"ecus":   store.ECUs,
+		"link":   store.Link,
 	}
 }
 
@@ -80,6 +82,12 @@ func (d *Dashboard) OnTick(sse *ds.ServerSentEventGenerator, currentTimeMs int)
 		stream.ClearStream()
 	}
 
+	if store.Link != nil {
+		if err := d.templates.ExecuteTemplate(&writer, "linkStats", store.Link); err != nil {
+			log.Printf("error executing linkStats template: %s", err)
+		}
+	}
+
 	// Patcherino
 	if writer.String() != "" {
 		err := sse.PatchElements(writer.String())
@@ -1,9 +1,12 @@
 package web
 
 import (
+	"context"
+	"errors"
 	"huskki/store"
 	"huskki/web"
 	"log"
+	"net"
 	"net/http"
 	"time"
 
@@ -34,9 +37,38 @@ func NewServer(renderer Renderer) *Server {
 	return s
 }
 
-func (s *Server) Start(addr string) error {
+// AddHandlers registers handlers for extra pages alongside the main renderer.
+func (s *Server) AddHandlers(handlers map[string]func(w http.ResponseWriter, r *http.Request)) {
+	for path, handler := range handlers {
+		s.handler.HandleFunc(path, handler)
+	}
+}
+
+// shutdownTimeout is how long Start waits for requests to finish once ctx is cancelled.
+const shutdownTimeout = 5 * time.Second
+
+// Start serves until ctx is cancelled. Requests get ctx as their context so the tick streams end with it.
+func (s *Server) Start(ctx context.Context, addr string) error {
+	server := &http.Server{
+		Addr:        addr,
+		Handler:     s.handler,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	shutdown := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("couldn't shut the server down: %v", err)
+		}
+	})
+	defer shutdown()
+
 	log.Printf("listening on %s …", addr)
-	return http.ListenAndServe(addr, s.handler)
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
 // IndexHandler is the main entrypoint for the UI
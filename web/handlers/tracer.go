@@ -0,0 +1,112 @@
+package web
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"huskki/models"
+	"huskki/rom"
+	"huskki/store"
+)
+
+// TRAIL_DURATION is how long a visited cell stays highlighted after the engine leaves it.
+const TRAIL_DURATION = 5 * time.Second
+
+type cellVisit struct {
+	row, col int
+	at       time.Time
+}
+
+// tableTracer follows the cell a table is currently being read from using the live streams its axes are indexed by,
+// and remembers recently visited cells so they can be drawn as a fading trail.
+type tableTracer struct {
+	table   *rom.TableData
+	xStream *models.Stream
+	yStream *models.Stream
+	trail   []cellVisit
+}
+
+// newTableTracer returns nil if the table's axes can't be matched to live streams.
+func newTableTracer(table *rom.TableData) *tableTracer {
+	xStream := axisStream(table.Table.X)
+	if xStream == nil {
+		return nil
+	}
+	var yStream *models.Stream
+	if table.Is3D() {
+		yStream = axisStream(table.Table.Y)
+		if yStream == nil {
+			return nil
+		}
+	}
+	return &tableTracer{table: table, xStream: xStream, yStream: yStream}
+}
+
+// axisStream finds the stream an axis is indexed by, either set explicitly in the definition or guessed from the
+// axis title and units.
+func axisStream(axis *rom.Axis) *models.Stream {
+	if axis == nil {
+		return nil
+	}
+	key := axis.Stream
+	if key == "" {
+		key = streamKeyFromName(axis.Title + " " + axis.Units)
+	}
+	return store.DashboardStreams[key]
+}
+
+func streamKeyFromName(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.Contains(lower, "rpm"):
+		return store.RPM_STREAM
+	case strings.Contains(lower, "tps"), strings.Contains(lower, "throttle"):
+		return store.TPS_STREAM
+	case strings.Contains(lower, "iap"), strings.Contains(lower, "map"), strings.Contains(lower, "manifold"):
+		return store.IAP_STREAM
+	}
+	return ""
+}
+
+// OnTick moves the trail along and returns a script call that redraws it, or "" if there is no live data yet.
+func (t *tableTracer) OnTick(now time.Time) string {
+	if t.xStream.Latest().Timestamp() == 0 {
+		return ""
+	}
+	var y float64
+	if t.yStream != nil {
+		if t.yStream.Latest().Timestamp() == 0 {
+			return ""
+		}
+		y = t.yStream.Latest().Value()
+	}
+	row, col := t.table.Cell(t.xStream.Latest().Value(), y)
+
+	if n := len(t.trail); n > 0 && t.trail[n-1].row == row && t.trail[n-1].col == col {
+		t.trail[n-1].at = now
+	} else {
+		t.trail = append(t.trail, cellVisit{row, col, now})
+	}
+
+	// Drop cells that have faded out
+	i := 0
+	for i < len(t.trail) && now.Sub(t.trail[i].at) > TRAIL_DURATION {
+		i++
+	}
+	t.trail = t.trail[i:]
+
+	return buildTraceFunction(t.table.Key, t.trail, now)
+}
+
+// buildTraceFunction builds m(tableKey, [[row, col, opacity], ...]), the last cell is the one the engine is in.
+func buildTraceFunction(tableKey string, trail []cellVisit, now time.Time) string {
+	var cells strings.Builder
+	cells.WriteString("[")
+	for _, visit := range trail {
+		opacity := 1 - float64(now.Sub(visit.at))/float64(TRAIL_DURATION)
+		cells.WriteString(fmt.Sprintf("[%d,%d,%.2f],", visit.row, visit.col, opacity))
+	}
+	cells.WriteString("]")
+	return fmt.Sprintf(`m('%s',%s)`, tableKey, cells.String())
+}
@@ -0,0 +1,27 @@
+// Cells currently marked per table, so they can be cleared before the next trace is drawn
+const marked = {};
+
+function m(tableKey, cells) {
+    const previous = marked[tableKey] || [];
+    for (const cell of previous) {
+        cell.classList.remove("active");
+        cell.style.boxShadow = "";
+    }
+
+    const current = [];
+    for (let i = 0; i < cells.length; i++) {
+        const [row, col, opacity] = cells[i];
+        const cell = document.getElementById(`cell-${tableKey}-${row}-${col}`);
+        if (!cell) continue;
+        // Later entries are more recent so they win if a cell was visited more than once
+        cell.style.boxShadow = `inset 0 0 0 3px rgba(255, 255, 255, ${opacity})`;
+        current.push(cell);
+    }
+
+    // The last cell is where the engine is now
+    if (current.length) {
+        current[current.length - 1].classList.add("active");
+    }
+
+    marked[tableKey] = current;
+}